@@ -230,7 +230,8 @@ func (r benReader) readBenBool() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if len(benInt) != 1 {
+	//benInt includes the 'e'
+	if len(benInt) != 2 {
 		return false, errors.New("bool value with length > 1")
 	}
 	return strconv.ParseBool(string(benInt[0]))
@@ -96,6 +96,17 @@ func TestSimpleStruct(t *testing.T) {
 	fmt.Println(s)
 }
 
+func TestDecodeBool(t *testing.T) {
+	var b struct {
+		T bool `bencode:"t"`
+		F bool `bencode:"f"`
+	}
+	require.NoError(t, Decode([]byte("d1:fi0e1:ti1ee"), &b))
+	assert.True(t, b.T)
+	assert.False(t, b.F)
+	assert.Error(t, Decode([]byte("d1:fi0e1:ti10ee"), &b))
+}
+
 type S struct {
 	Ignore int
 	Normal int
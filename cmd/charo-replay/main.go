@@ -0,0 +1,189 @@
+//charo-replay prints the peer wire messages recorded by a Client
+//(see torrent.Config.RecordWire) and can replay one side of the recording
+//against a local Client.
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/torrent"
+)
+
+var replay = flag.Bool("replay", false, "replay the recording against a local client instead of just printing it")
+var torrentFile = flag.String("torrentfile", "", "the torrent `file` of the recorded connection (required for -replay)")
+var side = flag.String("side", "peer", "which side of the recording to replay: `peer` or client")
+var baseDir = flag.String("dir", "", "the data `directory` of the local client (default is a temporary one)")
+var realtime = flag.Bool("realtime", false, "preserve the timing of the recording while replaying")
+var linger = flag.Duration("linger", 2*time.Second, "how long to wait for the local client's messages after replaying")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	records, err := readRecords(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*replay {
+		for _, r := range records {
+			printRecord(records[0].Time, r)
+		}
+		return
+	}
+	dir := peer_wire.RecordRecv
+	switch *side {
+	case "peer":
+	case "client":
+		//extended messages will have the remote peer's extension IDs
+		dir = peer_wire.RecordSent
+	default:
+		log.Fatalf("unknown side %q", *side)
+	}
+	if *torrentFile == "" {
+		log.Fatal("-torrentfile is required for replaying")
+	}
+	if err := replayRecords(records, dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readRecords(filename string) ([]*peer_wire.Record, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rr := peer_wire.NewRecordReader(f)
+	var records []*peer_wire.Record
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("recording is empty")
+	}
+	return records, nil
+}
+
+func printRecord(start time.Time, r *peer_wire.Record) {
+	desc := "undecodable (" + strconv.Itoa(len(r.Raw)) + " bytes)"
+	if hs, err := r.HandShake(); err == nil {
+		desc = fmt.Sprintf("Handshake peer ID %x", hs.PeerID)
+	} else if msg, err := r.Msg(); err == nil {
+		desc = msg.String()
+	}
+	fmt.Printf("%10.3fs %s %s\n", r.Time.Sub(start).Seconds(), r.Dir, desc)
+}
+
+//replayRecords sends the messages of the recording with direction dir to a
+//local client and prints them along with the client's responses.
+func replayRecords(records []*peer_wire.Record, dir peer_wire.RecordDir) error {
+	cfg, err := torrent.DefaultConfig()
+	if err != nil {
+		return err
+	}
+	if *baseDir == "" {
+		if cfg.BaseDir, err = ioutil.TempDir("", "charo-replay"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(cfg.BaseDir)
+	} else {
+		cfg.BaseDir = *baseDir
+	}
+	cfg.DisableTrackers = true
+	cfg.DisableDHT = true
+	cfg.EncryptionPolicy = torrent.EncryptionDisable
+	cl, err := torrent.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	t, err := cl.AddFromFile(*torrentFile)
+	if err != nil {
+		return err
+	}
+	if err = t.StartDataTransfer(); err != nil {
+		return err
+	}
+	nc, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(cl.ListenPort())))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	hs := recordedHandShake(records, dir)
+	hs.InfoHash = t.Metainfo().Info.Hash
+	if _, err = hs.Do(nc); err != nil {
+		return err
+	}
+	start := time.Now()
+	go func() {
+		r := peer_wire.NewReader(nc)
+		for {
+			var msg peer_wire.Msg
+			if err := r.ReadMsg(&msg); err != nil {
+				return
+			}
+			fmt.Printf("%10.3fs %s %s\n", time.Since(start).Seconds(), peer_wire.RecordRecv, msg.String())
+		}
+	}()
+	var prev time.Time
+	for _, r := range records {
+		if _, err := r.HandShake(); r.Dir != dir || err == nil {
+			continue
+		}
+		if *realtime && !prev.IsZero() {
+			time.Sleep(r.Time.Sub(prev))
+		}
+		prev = r.Time
+		if _, err = nc.Write(r.Raw); err != nil {
+			return err
+		}
+		printRecord(start, &peer_wire.Record{
+			Time: time.Now(),
+			Dir:  peer_wire.RecordSent,
+			Raw:  r.Raw,
+		})
+	}
+	time.Sleep(*linger)
+	return nil
+}
+
+//recordedHandShake returns the handshake of the side we replay. Recordings
+//may lack it, then the peer ID is random.
+func recordedHandShake(records []*peer_wire.Record, dir peer_wire.RecordDir) *peer_wire.HandShake {
+	for _, r := range records {
+		if r.Dir != dir {
+			continue
+		}
+		if hs, err := r.HandShake(); err == nil {
+			return hs
+		}
+	}
+	hs := new(peer_wire.HandShake)
+	hs.Reserved.SetExtended()
+	rand.Read(hs.PeerID[:])
+	return hs
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+//access decides which requests the tracker serves. Nil fields don't restrict
+//anything.
+type access struct {
+	whitelist map[[20]byte]bool
+	passkeys  map[string]bool
+	limiter   *rateLimiter
+}
+
+func (a *access) allow(r *tracker.ServerRequest) error {
+	if a.passkeys != nil && !a.passkeys[passkey(r.Path)] {
+		return errors.New("unknown passkey")
+	}
+	if a.whitelist != nil {
+		for _, ih := range r.InfoHashes {
+			if !a.whitelist[ih] {
+				return errors.New("unregistered torrent")
+			}
+		}
+	}
+	if !r.Scrape && a.limiter != nil && !a.limiter.allow(r.IP, time.Now()) {
+		return errors.New("too many announces, slow down")
+	}
+	return nil
+}
+
+//passkey returns the path element before the last one
+//(/<passkey>/announce), empty if there isn't any
+func passkey(p string) string {
+	dir := path.Dir(p)
+	if dir == "/" || dir == "." {
+		return ""
+	}
+	return path.Base(dir)
+}
+
+//rateLimiter is a token bucket per IP
+type rateLimiter struct {
+	mu sync.Mutex
+	//tokens per second
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//newRateLimiter allows n requests per period for every IP
+func newRateLimiter(n int, period time.Duration) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(n) / period.Seconds(),
+		burst:   float64(n),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (rl *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	key := ip.String()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//prune forgets the IPs whose buckets are full again
+func (rl *rateLimiter) prune(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+//charo-tracker runs a BitTorrent tracker (see tracker.Server) that serves
+//announces and scrapes over UDP and HTTP. It can restrict the torrents it
+//tracks to a whitelist, require passkeys in the announce path
+//(http://host/<passkey>/announce) and rate limit announces per IP. The state
+//of the swarms is saved periodically so restarts don't empty them.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+var udpAddr = flag.String("udp", ":6969", "serve UDP requests at `address` (empty to disable)")
+var httpAddr = flag.String("http", ":6969", "serve HTTP requests at `address` (empty to disable)")
+var statsAddr = flag.String("stats", "", "serve the stats of the torrents at `address`")
+var whitelistFile = flag.String("whitelist", "", "track only the info hashes (hex, one per line) of `file`")
+var passkeysFile = flag.String("passkeys", "", "require one of the passkeys (one per line) of `file` in the announce path")
+var rate = flag.Int("rate", 0, "allow that many announces per minute per IP (0 for no limit)")
+var snapshotFile = flag.String("snapshot", "", "save the swarms to `file` and restore them at startup")
+var snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "how often to save the swarms")
+var interval = flag.Duration("interval", 30*time.Minute, "how often peers should announce")
+
+func main() {
+	flag.Parse()
+	if *udpAddr == "" && *httpAddr == "" {
+		log.Fatal("at least one of -udp and -http is required")
+	}
+	var acl access
+	var err error
+	if *whitelistFile != "" {
+		if acl.whitelist, err = readWhitelist(*whitelistFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *passkeysFile != "" {
+		if acl.passkeys, err = readPasskeys(*passkeysFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rate > 0 {
+		acl.limiter = newRateLimiter(*rate, time.Minute)
+	}
+	cfg := tracker.DefaultServerConfig()
+	cfg.Interval = *interval
+	cfg.MinInterval = *interval / 6
+	cfg.PeerTimeout = *interval * 3 / 2
+	cfg.Allow = acl.allow
+	s := tracker.NewServer(cfg)
+	if *snapshotFile != "" {
+		if err = readSnapshot(s, *snapshotFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	errc := make(chan error, 3)
+	if *udpAddr != "" {
+		pc, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving UDP at %s", pc.LocalAddr())
+		go func() { errc <- s.ServeUDP(pc) }()
+	}
+	if *httpAddr != "" {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving HTTP at %s", l.Addr())
+		go func() { errc <- s.Serve(l) }()
+	}
+	if *statsAddr != "" {
+		go func() {
+			errc <- http.ListenAndServe(*statsAddr, statsHandler(s))
+		}()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if acl.limiter != nil {
+				acl.limiter.prune(time.Now())
+			}
+			if *snapshotFile == "" {
+				continue
+			}
+			if err := writeSnapshot(s, *snapshotFile); err != nil {
+				log.Printf("snapshot: %s", err)
+			}
+		case err := <-errc:
+			log.Print(err)
+			shutdown(s)
+			os.Exit(1)
+		case sig := <-sigc:
+			log.Printf("received %s, shutting down", sig)
+			shutdown(s)
+			return
+		}
+	}
+}
+
+func shutdown(s *tracker.Server) {
+	if *snapshotFile != "" {
+		if err := writeSnapshot(s, *snapshotFile); err != nil {
+			log.Printf("snapshot: %s", err)
+		}
+	}
+	s.Close()
+}
+
+func readSnapshot(s *tracker.Server, filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.ReadSnapshot(f)
+}
+
+//writeSnapshot replaces the snapshot atomically so a crash while writing
+//doesn't lose the previous one
+func writeSnapshot(s *tracker.Server, filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err = s.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+//statsHandler lists the torrents with their seeders, leechers and
+//completions
+func statsHandler(s *tracker.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		torrents := s.Torrents()
+		ihashes := make([][20]byte, 0, len(torrents))
+		for ih := range torrents {
+			ihashes = append(ihashes, ih)
+		}
+		sort.Slice(ihashes, func(i, j int) bool {
+			return string(ihashes[i][:]) < string(ihashes[j][:])
+		})
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "INFOHASH\tSEEDERS\tLEECHERS\tCOMPLETED")
+		for _, ih := range ihashes {
+			info := torrents[ih]
+			fmt.Fprintf(tw, "%x\t%d\t%d\t%d\n", ih, info.Seeders, info.Leechers, info.Downloaded)
+		}
+		tw.Flush()
+	})
+}
+
+//readLines returns the non empty lines of filename that aren't comments
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+func readWhitelist(filename string) (map[[20]byte]bool, error) {
+	lines, err := readLines(filename)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[[20]byte]bool, len(lines))
+	for _, line := range lines {
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 20 {
+			return nil, errors.New("whitelist: invalid info hash " + line)
+		}
+		var ih [20]byte
+		copy(ih[:], b)
+		ret[ih] = true
+	}
+	return ret, nil
+}
+
+func readPasskeys(filename string) (map[string]bool, error) {
+	lines, err := readLines(filename)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		ret[line] = true
+	}
+	return ret, nil
+}
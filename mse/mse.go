@@ -0,0 +1,342 @@
+/*
+Package mse implements the Message Stream Encryption protocol (also known as
+Protocol Encryption) that BitTorrent clients use to obfuscate their traffic.
+The initiator of a connection calls Initiate and the recipient calls Receive.
+Both return a stream on which the BitTorrent handshake and all subsequent
+messages should be transfered.
+*/
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+//CryptoMethod is a bitfield of the crypto methods an initiator provides.
+//A recipient selects exactly one of them.
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 1 << iota
+	CryptoRC4
+)
+
+func (cm CryptoMethod) String() string {
+	switch cm {
+	case CryptoPlaintext:
+		return "plaintext"
+	case CryptoRC4:
+		return "rc4"
+	default:
+		return fmt.Sprintf("crypto(%d)", uint32(cm))
+	}
+}
+
+const (
+	keyLen = 96
+	maxPad = 512
+	//bytes of the RC4 keystream that are discarded
+	discardLen = 1024
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	//verification constant
+	vc [8]byte
+)
+
+var (
+	ErrNoCommonMethod = errors.New("mse: no common crypto method")
+	ErrUnknownSKey    = errors.New("mse: unknown skey")
+	errSync           = errors.New("mse: could not synchronize with remote peer")
+)
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	ret := make([]byte, len(a))
+	for i := range a {
+		ret[i] = a[i] ^ b[i]
+	}
+	return ret
+}
+
+type keyPair struct {
+	priv *big.Int
+	pub  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	privBytes := make([]byte, 20)
+	if _, err := rand.Read(privBytes); err != nil {
+		return nil, err
+	}
+	priv := new(big.Int).SetBytes(privBytes)
+	return &keyPair{
+		priv: priv,
+		pub:  paddedBytes(new(big.Int).Exp(generator, priv, prime)),
+	}, nil
+}
+
+func (kp *keyPair) secret(peerPub []byte) []byte {
+	y := new(big.Int).SetBytes(peerPub)
+	return paddedBytes(new(big.Int).Exp(y, kp.priv, prime))
+}
+
+func paddedBytes(x *big.Int) []byte {
+	b := x.Bytes()
+	ret := make([]byte, keyLen)
+	copy(ret[keyLen-len(b):], b)
+	return ret
+}
+
+func newCipher(key string, s, skey []byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(hash([]byte(key), s, skey))
+	if err != nil {
+		panic(err)
+	}
+	discard := make([]byte, discardLen)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+type cipherReader struct {
+	r io.Reader
+	c *rc4.Cipher
+}
+
+func (cr *cipherReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+type cipherWriter struct {
+	w io.Writer
+	c *rc4.Cipher
+}
+
+func (cw *cipherWriter) Write(b []byte) (int, error) {
+	enc := make([]byte, len(b))
+	cw.c.XORKeyStream(enc, b)
+	return cw.w.Write(enc)
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+//synchronize reads from r until it finds `pattern`. The pattern should be found in the
+//first `max` bytes.
+func synchronize(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errSync
+}
+
+//Initiate performs the handshake as the initiator of the connection. skey is
+//the infohash of the torrent we want to connect for. provide are the crypto methods
+//we support. It returns the stream to be used for further communication and
+//the crypto method that the remote peer selected.
+func Initiate(rw io.ReadWriter, skey []byte, provide CryptoMethod) (io.ReadWriter, CryptoMethod, error) {
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err = rw.Write(append(kp.pub, padA...)); err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(rw)
+	peerPub := make([]byte, keyLen)
+	if _, err = io.ReadFull(br, peerPub); err != nil {
+		return nil, 0, err
+	}
+	s := kp.secret(peerPub)
+	enc := &cipherWriter{rw, newCipher("keyA", s, skey)}
+	decCipher := newCipher("keyB", s, skey)
+	padC, err := randomPad()
+	if err != nil {
+		return nil, 0, err
+	}
+	var b bytes.Buffer
+	b.Write(hash([]byte("req1"), s))
+	b.Write(xor(hash([]byte("req2"), skey), hash([]byte("req3"), s)))
+	if _, err = rw.Write(b.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	b.Reset()
+	b.Write(vc[:])
+	binary.Write(&b, binary.BigEndian, provide)
+	binary.Write(&b, binary.BigEndian, uint16(len(padC)))
+	b.Write(padC)
+	//we don't send any initial payload
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	if _, err = enc.Write(b.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	//the encrypted VC is the first bytes of the keystream.
+	encVC := make([]byte, len(vc))
+	newCipher("keyB", s, skey).XORKeyStream(encVC, vc[:])
+	if err = synchronize(br, encVC, maxPad+len(vc)); err != nil {
+		return nil, 0, err
+	}
+	decCipher.XORKeyStream(encVC, encVC)
+	dec := &cipherReader{br, decCipher}
+	var (
+		selected CryptoMethod
+		padDLen  uint16
+	)
+	if err = binary.Read(dec, binary.BigEndian, &selected); err != nil {
+		return nil, 0, err
+	}
+	if err = binary.Read(dec, binary.BigEndian, &padDLen); err != nil {
+		return nil, 0, err
+	}
+	if padDLen > maxPad {
+		return nil, 0, errors.New("mse: padD too long")
+	}
+	if _, err = io.ReadFull(dec, make([]byte, padDLen)); err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case selected&provide == 0:
+		return nil, 0, ErrNoCommonMethod
+	case selected == CryptoRC4:
+		return &readWriter{dec, enc}, selected, nil
+	case selected == CryptoPlaintext:
+		return &readWriter{br, rw}, selected, nil
+	default:
+		return nil, 0, fmt.Errorf("mse: peer selected invalid crypto method %d", selected)
+	}
+}
+
+//Receive performs the handshake as the recipient of the connection. skeys are
+//the infohashes that we accept and choose picks one of the crypto methods
+//the initiator provided (or zero if none is acceptable). It returns the
+//stream to be used for further communication, the skey the initiator used
+//and the crypto method we selected.
+func Receive(rw io.ReadWriter, skeys [][]byte, choose func(provided CryptoMethod) CryptoMethod) (io.ReadWriter, []byte, CryptoMethod, error) {
+	br := bufio.NewReader(rw)
+	peerPub := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, peerPub); err != nil {
+		return nil, nil, 0, err
+	}
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if _, err = rw.Write(append(kp.pub, padB...)); err != nil {
+		return nil, nil, 0, err
+	}
+	s := kp.secret(peerPub)
+	if err = synchronize(br, hash([]byte("req1"), s), maxPad+sha1.Size); err != nil {
+		return nil, nil, 0, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(br, obfuscated); err != nil {
+		return nil, nil, 0, err
+	}
+	req2 := xor(obfuscated, hash([]byte("req3"), s))
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(hash([]byte("req2"), k), req2) {
+			skey = k
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, 0, ErrUnknownSKey
+	}
+	dec := &cipherReader{br, newCipher("keyA", s, skey)}
+	enc := &cipherWriter{rw, newCipher("keyB", s, skey)}
+	var (
+		peerVC  [8]byte
+		provide CryptoMethod
+		padCLen uint16
+		iaLen   uint16
+	)
+	if err = binary.Read(dec, binary.BigEndian, &peerVC); err != nil {
+		return nil, nil, 0, err
+	}
+	if peerVC != vc {
+		return nil, nil, 0, errors.New("mse: bad verification constant")
+	}
+	if err = binary.Read(dec, binary.BigEndian, &provide); err != nil {
+		return nil, nil, 0, err
+	}
+	if err = binary.Read(dec, binary.BigEndian, &padCLen); err != nil {
+		return nil, nil, 0, err
+	}
+	if padCLen > maxPad {
+		return nil, nil, 0, errors.New("mse: padC too long")
+	}
+	if _, err = io.ReadFull(dec, make([]byte, padCLen)); err != nil {
+		return nil, nil, 0, err
+	}
+	if err = binary.Read(dec, binary.BigEndian, &iaLen); err != nil {
+		return nil, nil, 0, err
+	}
+	ia := make([]byte, iaLen)
+	if _, err = io.ReadFull(dec, ia); err != nil {
+		return nil, nil, 0, err
+	}
+	selected := choose(provide)
+	if selected&provide == 0 || (selected != CryptoRC4 && selected != CryptoPlaintext) {
+		return nil, nil, 0, ErrNoCommonMethod
+	}
+	var b bytes.Buffer
+	b.Write(vc[:])
+	binary.Write(&b, binary.BigEndian, selected)
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	if _, err = enc.Write(b.Bytes()); err != nil {
+		return nil, nil, 0, err
+	}
+	//the initial payload is part of the stream
+	if selected == CryptoRC4 {
+		return &readWriter{io.MultiReader(bytes.NewReader(ia), dec), enc}, skey, selected, nil
+	}
+	return &readWriter{io.MultiReader(bytes.NewReader(ia), br), rw}, skey, selected, nil
+}
@@ -0,0 +1,93 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSKeys = [][]byte{
+	[]byte("00000000000000000000"),
+	[]byte("11111111111111111111"),
+}
+
+func preferRC4(provided CryptoMethod) CryptoMethod {
+	if provided&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+	return provided & CryptoPlaintext
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	acceptC := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		require.NoError(t, err)
+		acceptC <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	return c, <-acceptC
+}
+
+func testHandshake(t *testing.T, provide CryptoMethod, expected CryptoMethod) {
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	type result struct {
+		rw     io.ReadWriter
+		skey   []byte
+		method CryptoMethod
+		err    error
+	}
+	resC := make(chan result)
+	go func() {
+		rw, skey, method, err := Receive(b, testSKeys, preferRC4)
+		resC <- result{rw, skey, method, err}
+	}()
+	rwA, method, err := Initiate(a, testSKeys[1], provide)
+	require.NoError(t, err)
+	assert.Equal(t, expected, method)
+	res := <-resC
+	require.NoError(t, res.err)
+	assert.Equal(t, expected, res.method)
+	assert.Equal(t, testSKeys[1], res.skey)
+	//data should pass through in both directions
+	go rwA.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(res.rw, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	go res.rw.Write([]byte("world"))
+	_, err = io.ReadFull(rwA, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+}
+
+func TestHandshakeRC4(t *testing.T) {
+	testHandshake(t, CryptoRC4|CryptoPlaintext, CryptoRC4)
+}
+
+func TestHandshakePlaintext(t *testing.T) {
+	testHandshake(t, CryptoPlaintext, CryptoPlaintext)
+}
+
+func TestHandshakeUnknownSKey(t *testing.T) {
+	a, b := tcpPair(t)
+	defer a.Close()
+	errC := make(chan error)
+	go func() {
+		_, _, _, err := Receive(b, testSKeys, preferRC4)
+		b.Close()
+		errC <- err
+	}()
+	_, _, err := Initiate(a, []byte("22222222222222222222"), CryptoRC4)
+	require.Error(t, err)
+	assert.Equal(t, ErrUnknownSKey, <-errC)
+}
@@ -0,0 +1,169 @@
+package peer_wire
+
+import (
+	"strconv"
+	"strings"
+)
+
+//ClientInfo describes the BitTorrent client software of a peer.
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (ci ClientInfo) String() string {
+	if ci.Version == "" {
+		return ci.Name
+	}
+	return ci.Name + " " + ci.Version
+}
+
+//client codes of Azureus-style peer IDs (-XX1234-)
+var azureusClients = map[string]string{
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"CH": "charo",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GT": "anacrolix/torrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+//client codes of Shadow-style peer IDs (S58B-----)
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+//ParsePeerID identifies the client that generated id. Azureus-style,
+//Shadow-style and Mainline-style peer IDs are recognized. ok is false if
+//id doesn't follow any of them.
+func ParsePeerID(id [20]byte) (ci ClientInfo, ok bool) {
+	if ci, ok = parseAzureusStyle(id); ok {
+		return
+	}
+	if ci, ok = parseMainlineStyle(id); ok {
+		return
+	}
+	return parseShadowStyle(id)
+}
+
+func parseAzureusStyle(id [20]byte) (ci ClientInfo, ok bool) {
+	if id[0] != '-' || id[7] != '-' || !isAlnum(id[1]) || !isAlnum(id[2]) {
+		return
+	}
+	code := string(id[1:3])
+	if ci.Name, ok = azureusClients[code]; !ok {
+		ci.Name = code
+	}
+	parts := make([]string, 4)
+	for i, c := range id[3:7] {
+		v, valid := versionDigit(c)
+		if !valid {
+			return ClientInfo{}, false
+		}
+		parts[i] = strconv.Itoa(v)
+	}
+	ci.Version = strings.Join(parts, ".")
+	return ci, true
+}
+
+//e.g M4-4-6--
+func parseMainlineStyle(id [20]byte) (ci ClientInfo, ok bool) {
+	if id[0] != 'M' {
+		return
+	}
+	end := strings.Index(string(id[1:]), "--")
+	if end <= 0 {
+		return
+	}
+	parts := strings.Split(string(id[1:1+end]), "-")
+	for _, p := range parts {
+		if _, err := strconv.Atoi(p); err != nil {
+			return
+		}
+	}
+	return ClientInfo{
+		Name:    "Mainline",
+		Version: strings.Join(parts, "."),
+	}, true
+}
+
+//one character for the client and up to five for the version, padded with
+//dashes.
+func parseShadowStyle(id [20]byte) (ci ClientInfo, ok bool) {
+	if ci.Name, ok = shadowClients[id[0]]; !ok {
+		return
+	}
+	if string(id[6:9]) != "---" {
+		return ClientInfo{}, false
+	}
+	var parts []string
+	for i, c := range id[1:6] {
+		if c == '-' {
+			//only padding is allowed after the version
+			if strings.Trim(string(id[1+i:6]), "-") != "" {
+				return ClientInfo{}, false
+			}
+			break
+		}
+		v, valid := shadowDigit(c)
+		if !valid {
+			return ClientInfo{}, false
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+	if len(parts) == 0 {
+		return ClientInfo{}, false
+	}
+	ci.Version = strings.Join(parts, ".")
+	return ci, true
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+//Azureus-style versions use letters for numbers greater than 9
+func versionDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10, true
+	}
+	return 0, false
+}
+
+func shadowDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	}
+	return 0, false
+}
@@ -0,0 +1,36 @@
+package peer_wire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerID(t *testing.T) {
+	peerID := func(s string) (id [20]byte) {
+		copy(id[:], s+"xxxxxxxxxxxxxxxxxxxx")
+		return
+	}
+	for _, test := range []struct {
+		id     string
+		client string
+		ok     bool
+	}{
+		{"-qB4250-", "qBittorrent 4.2.5.0", true},
+		{"-TR294Z-", "Transmission 2.9.4.35", true},
+		{"-CH0001-", "charo 0.0.0.1", true},
+		{"-ZZ1000-", "ZZ 1.0.0.0", true},
+		{"M4-4-6--", "Mainline 4.4.6", true},
+		{"M7-10-2--", "Mainline 7.10.2", true},
+		{"S58B-----", "Shadow 5.8.11", true},
+		{"T03I-----", "BitTornado 0.3.18", true},
+		{"-qB4.50-", "", false},
+		{"Mx-1--", "", false},
+		{"S58B-x---", "", false},
+		{"random", "", false},
+	} {
+		ci, ok := ParsePeerID(peerID(test.id))
+		assert.Equal(t, test.ok, ok, test.id)
+		assert.Equal(t, test.client, ci.String(), test.id)
+	}
+}
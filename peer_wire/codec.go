@@ -0,0 +1,221 @@
+package peer_wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+//BlockSize is the size of the blocks kept in the block pool. It is the
+//block size every client requests.
+const BlockSize = 1 << 14
+
+//keep at most 8MiB of free blocks around
+const maxPooledBlocks = 512
+
+var (
+	errMsgTooLong   = errors.New("peer wire: too long msg")
+	errUnknownKind  = errors.New("unknown kind of msg")
+	errMsgMalformed = errors.New("peer wire: malformed msg")
+)
+
+//blocks are the payload of almost every message we exchange at line rate, so
+//we recycle them instead of burdening the GC. A plain free list is used
+//because storing slices at a sync.Pool allocates.
+var blockPool struct {
+	mu   sync.Mutex
+	free [][]byte
+}
+
+//GetBlock returns a block of length n. Blocks of length up to BlockSize are
+//taken from the block pool.
+func GetBlock(n int) []byte {
+	if n > BlockSize {
+		return make([]byte, n)
+	}
+	blockPool.mu.Lock()
+	defer blockPool.mu.Unlock()
+	if l := len(blockPool.free); l > 0 {
+		b := blockPool.free[l-1]
+		blockPool.free = blockPool.free[:l-1]
+		return b[:n]
+	}
+	return make([]byte, n, BlockSize)
+}
+
+//PutBlock returns b to the block pool. b should not be used afterwards.
+//Blocks not obtained by GetBlock are ignored.
+func PutBlock(b []byte) {
+	if cap(b) != BlockSize {
+		return
+	}
+	blockPool.mu.Lock()
+	defer blockPool.mu.Unlock()
+	if len(blockPool.free) < maxPooledBlocks {
+		blockPool.free = append(blockPool.free, b[:0])
+	}
+}
+
+//Reader decodes messages from an underlying reader without allocating
+//for the frequent (fixed size and piece) messages.
+type Reader struct {
+	r   io.Reader
+	hdr [12]byte
+	//BlockBuf returns the memory that the block of a piece message is decoded
+	//into. If nil, blocks are taken from the block pool and the caller should
+	//return them with PutBlock when done with them.
+	BlockBuf func(length int) []byte
+}
+
+//NewReader returns a Reader that buffers r in order to avoid a read call
+//for every field of a message. r shouldn't be read by others afterwards.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+//ReadMsg reads the next message from the underlying reader into m. The block
+//of a piece message is decoded into memory obtained from BlockBuf.
+//Bitfield and extended messages allocate their payload as they are rare.
+func (r *Reader) ReadMsg(m *Msg) error {
+	*m = Msg{}
+	if _, err := io.ReadFull(r.r, r.hdr[:4]); err != nil {
+		return err
+	}
+	msgLen := binary.BigEndian.Uint32(r.hdr[:4])
+	if msgLen > maxMsgLength {
+		return errMsgTooLong
+	}
+	if msgLen == 0 {
+		m.Kind = KeepAlive
+		return nil
+	}
+	if _, err := io.ReadFull(r.r, r.hdr[:1]); err != nil {
+		return err
+	}
+	m.Kind = MessageKind(r.hdr[0])
+	msgLen--
+	switch m.Kind {
+	case Choke, Unchoke, Interested, NotInterested, Have, Request, Cancel, Port:
+		payload, err := r.readFixed(m.Kind, msgLen)
+		if err != nil {
+			return err
+		}
+		switch m.Kind {
+		case Have:
+			m.Index = binary.BigEndian.Uint32(payload)
+		case Request, Cancel:
+			m.Index = binary.BigEndian.Uint32(payload)
+			m.Begin = binary.BigEndian.Uint32(payload[4:])
+			m.Len = binary.BigEndian.Uint32(payload[8:])
+		case Port:
+			m.Port = binary.BigEndian.Uint16(payload)
+		}
+	case Piece:
+		if msgLen < 8 {
+			return errMsgMalformed
+		}
+		if _, err := io.ReadFull(r.r, r.hdr[:8]); err != nil {
+			return err
+		}
+		m.Index = binary.BigEndian.Uint32(r.hdr[:4])
+		m.Begin = binary.BigEndian.Uint32(r.hdr[4:8])
+		blockLen := int(msgLen - 8)
+		if r.BlockBuf != nil {
+			m.Block = r.BlockBuf(blockLen)[:blockLen]
+		} else {
+			m.Block = GetBlock(blockLen)
+		}
+		if _, err := io.ReadFull(r.r, m.Block); err != nil {
+			return err
+		}
+	case Bitfield, Extended:
+		payload := make([]byte, msgLen)
+		if _, err := io.ReadFull(r.r, payload); err != nil {
+			return err
+		}
+		if m.Kind == Bitfield {
+			m.Bf = payload
+			return nil
+		}
+		if len(payload) < 1 {
+			return errMsgMalformed
+		}
+		m.ExtendedID = ExtensionID(payload[0])
+		return readExtension(m.ExtendedID, payload[1:], m)
+	default:
+		return errUnknownKind
+	}
+	return nil
+}
+
+func (r *Reader) readFixed(kind MessageKind, msgLen uint32) ([]byte, error) {
+	var expect uint32
+	switch kind {
+	case Have:
+		expect = 4
+	case Request, Cancel:
+		expect = 12
+	case Port:
+		expect = 2
+	}
+	if msgLen != expect {
+		return nil, fmt.Errorf("peer wire: %s msg has wrong length %d", kind, msgLen)
+	}
+	_, err := io.ReadFull(r.r, r.hdr[:expect])
+	return r.hdr[:expect], err
+}
+
+//Writer buffers encoded messages in a reusable buffer. Piece messages are
+//written along with the buffered data using a vectored write so their block
+//is never copied.
+type Writer struct {
+	w    io.Writer
+	buf  []byte
+	vec  [2][]byte
+	bufs net.Buffers
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:   w,
+		buf: make([]byte, 0, 1<<10),
+	}
+}
+
+//WriteMsg buffers m. If m is a piece message, the buffered messages and m
+//are written to the underlying writer and the block of m can be reused when
+//WriteMsg returns.
+func (w *Writer) WriteMsg(m *Msg) error {
+	if m.Kind != Piece {
+		w.buf = m.appendTo(w.buf)
+		return nil
+	}
+	w.buf = appendPieceHeader(w.buf, m)
+	w.vec[0], w.vec[1] = w.buf, m.Block
+	w.bufs = w.vec[:]
+	_, err := w.bufs.WriteTo(w.w)
+	w.vec[0], w.vec[1] = nil, nil
+	w.buf = w.buf[:0]
+	return err
+}
+
+//Buffered returns the number of bytes that haven't been written yet.
+func (w *Writer) Buffered() int {
+	return len(w.buf)
+}
+
+//Flush writes the buffered messages to the underlying writer.
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
@@ -0,0 +1,140 @@
+package peer_wire
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderWriter(t *testing.T) {
+	msgs := []*Msg{
+		{Kind: KeepAlive},
+		{Kind: Interested},
+		{Kind: Have, Index: 43},
+		{Kind: Bitfield, Bf: []byte{0xff, 0x01}},
+		{Kind: Request, Index: 1, Begin: 1 << 14, Len: 1 << 14},
+		{Kind: Piece, Index: 2, Begin: 3, Block: []byte("block")},
+		{Kind: Cancel, Index: 1, Begin: 1 << 14, Len: 1 << 14},
+		{Kind: Port, Port: 6881},
+		{Kind: Piece, Index: 4, Begin: 5, Block: []byte("another")},
+		{Kind: Choke},
+	}
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for _, m := range msgs {
+		require.NoError(t, w.WriteMsg(m))
+	}
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 0, w.Buffered())
+	//the writer should produce the same bytes as Encode
+	var expect []byte
+	for _, m := range msgs {
+		expect = append(expect, m.Encode()...)
+	}
+	assert.Equal(t, expect, b.Bytes())
+	r := NewReader(&b)
+	for _, m := range msgs {
+		var got Msg
+		require.NoError(t, r.ReadMsg(&got))
+		assert.EqualValues(t, m, &got)
+	}
+}
+
+func TestReaderBlockBuf(t *testing.T) {
+	mem := make([]byte, 32)
+	r := NewReader(bytes.NewReader((&Msg{
+		Kind:  Piece,
+		Block: []byte("hello"),
+	}).Encode()))
+	r.BlockBuf = func(length int) []byte {
+		assert.Equal(t, 5, length)
+		return mem
+	}
+	var m Msg
+	require.NoError(t, r.ReadMsg(&m))
+	assert.Equal(t, "hello", string(m.Block))
+	assert.Equal(t, "hello", string(mem[:5]))
+}
+
+func TestReaderMalformed(t *testing.T) {
+	var m Msg
+	//have msg without index
+	err := NewReader(bytes.NewReader([]byte{0, 0, 0, 1, byte(Have)})).ReadMsg(&m)
+	assert.Error(t, err)
+	//piece msg without begin
+	err = NewReader(bytes.NewReader([]byte{0, 0, 0, 5, byte(Piece), 0, 0, 0, 0})).ReadMsg(&m)
+	assert.Error(t, err)
+	err = NewReader(bytes.NewReader([]byte{0xff, 0, 0, 0})).ReadMsg(&m)
+	assert.Equal(t, errMsgTooLong, err)
+}
+
+func TestBlockPool(t *testing.T) {
+	b := GetBlock(100)
+	assert.Len(t, b, 100)
+	assert.Equal(t, BlockSize, cap(b))
+	PutBlock(b)
+	assert.Len(t, GetBlock(BlockSize), BlockSize)
+	large := GetBlock(BlockSize + 1)
+	assert.Len(t, large, BlockSize+1)
+	//not pooled
+	PutBlock(large)
+}
+
+func TestReaderWriterAllocs(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	r := NewReader(&b)
+	block := make([]byte, BlockSize)
+	msgs := []Msg{
+		{Kind: Request, Index: 1, Len: BlockSize},
+		{Kind: Have, Index: 1},
+		{Kind: Piece, Index: 1, Block: block},
+	}
+	var m Msg
+	allocs := testing.AllocsPerRun(100, func() {
+		for i := range msgs {
+			w.WriteMsg(&msgs[i])
+		}
+		w.Flush()
+		for range msgs {
+			r.ReadMsg(&m)
+		}
+		PutBlock(m.Block)
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkWritePiece(b *testing.B) {
+	w := NewWriter(ioutil.Discard)
+	m := &Msg{
+		Kind:  Piece,
+		Block: make([]byte, BlockSize),
+	}
+	b.SetBytes(BlockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteMsg(m)
+	}
+}
+
+func BenchmarkReadPiece(b *testing.B) {
+	encoded := (&Msg{
+		Kind:  Piece,
+		Block: make([]byte, BlockSize),
+	}).Encode()
+	br := bytes.NewReader(encoded)
+	r := NewReader(br)
+	var m Msg
+	b.SetBytes(BlockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br.Reset(encoded)
+		if err := r.ReadMsg(&m); err != nil {
+			b.Fatal(err)
+		}
+		PutBlock(m.Block)
+	}
+}
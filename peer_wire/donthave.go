@@ -0,0 +1,24 @@
+package peer_wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//DontHaveMsg is the payload of a lt_donthave message (BEP 54). It is the
+//index of a piece the peer no longer has. Unlike other extension messages,
+//it isn't bencoded.
+type DontHaveMsg uint32
+
+func (dh DontHaveMsg) encode() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(dh))
+	return b
+}
+
+func decodeDontHave(payload []byte) (DontHaveMsg, error) {
+	if len(payload) != 4 {
+		return 0, errors.New("donthave msg: payload should be 4 bytes")
+	}
+	return DontHaveMsg(binary.BigEndian.Uint32(payload)), nil
+}
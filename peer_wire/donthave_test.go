@@ -0,0 +1,26 @@
+package peer_wire
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadWriteDontHave(t *testing.T) {
+	msg := &Msg{
+		Kind:        Extended,
+		ExtendedID:  ExtDontHaveID,
+		ExtendedMsg: DontHaveMsg(0x01020304),
+	}
+	b := msg.Encode()
+	//length prefix, kind, extended id and the big endian index
+	assert.Equal(t, []byte{0, 0, 0, 6, byte(Extended), byte(ExtDontHaveID), 1, 2, 3, 4}, b)
+	decoded, err := Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+	//index should be exactly 4 bytes
+	_, err = Decode(bytes.NewReader([]byte{0, 0, 0, 5, byte(Extended), byte(ExtDontHaveID), 1, 2, 3}))
+	assert.Error(t, err)
+}
@@ -2,6 +2,11 @@ package peer_wire
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
 
 	"github.com/lkslts64/charo-torrent/bencode"
 )
@@ -11,12 +16,18 @@ type ExtensionID int8
 const (
 	ExtHandshakeID ExtensionID = iota
 	ExtMetadataID
+	ExtPexID
+	ExtDontHaveID
+	ExtHolepunchID
 )
 
 type ExtensionName string
 
 const (
-	ExtMetadataName ExtensionName = "ut_metadata"
+	ExtMetadataName  ExtensionName = "ut_metadata"
+	ExtPexName       ExtensionName = "ut_pex"
+	ExtDontHaveName  ExtensionName = "lt_donthave"
+	ExtHolepunchName ExtensionName = "ut_holepunch"
 )
 
 type Extensions map[ExtensionName]ExtensionID
@@ -30,7 +41,7 @@ func decodeExtHandshakeMsg(msg []byte) (d ExtHandshakeDict, err error) {
 
 //return 'm' dict contents. we received d from a peer
 func (d ExtHandshakeDict) Extensions() (Extensions, error) {
-	var peerExt Extensions
+	peerExt := make(Extensions)
 	var ok bool
 	var _m interface{}
 	if _m, ok = d["m"]; !ok {
@@ -62,6 +73,103 @@ func (d ExtHandshakeDict) MetadataSize() (msize int64, ok bool) {
 	return
 }
 
+//YourIP returns our IP address as the remote peer sees it.
+func (d ExtHandshakeDict) YourIP() (net.IP, bool) {
+	return d.ip("yourip")
+}
+
+//Reqq returns the number of outstanding requests the remote peer
+//supports without dropping any.
+func (d ExtHandshakeDict) Reqq() (int, bool) {
+	i, ok := d.integer("reqq")
+	if !ok || i <= 0 {
+		return 0, false
+	}
+	return int(i), true
+}
+
+//ListenPort returns the port the remote peer listens to (`p` key). It is
+//useful when the remote peer initiated the connection.
+func (d ExtHandshakeDict) ListenPort() (uint16, bool) {
+	i, ok := d.integer("p")
+	if !ok || i <= 0 || i > math.MaxUint16 {
+		return 0, false
+	}
+	return uint16(i), true
+}
+
+//IPv6 returns the IPv6 address of the remote peer, if it has one.
+func (d ExtHandshakeDict) IPv6() (net.IP, bool) {
+	ip, ok := d.ip("ipv6")
+	if !ok || len(ip) != net.IPv6len {
+		return nil, false
+	}
+	return ip, true
+}
+
+//UploadOnly returns whether the remote peer doesn't want to download any
+//more pieces (BEP 21). ok is false if the peer didn't send the flag.
+func (d ExtHandshakeDict) UploadOnly() (uploadOnly bool, ok bool) {
+	i, ok := d.integer("upload_only")
+	return i != 0, ok
+}
+
+func (d ExtHandshakeDict) integer(key string) (int64, bool) {
+	v, ok := d[key]
+	if !ok {
+		return 0, false
+	}
+	i, ok := v.(int64)
+	return i, ok
+}
+
+//ClientVersion returns the client name and version of the remote peer (`v` key).
+func (d ExtHandshakeDict) ClientVersion() (string, bool) {
+	v, ok := d["v"]
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+//String formats the dict with its compact IP addresses in readable form.
+func (d ExtHandshakeDict) String() string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		v := d[k]
+		switch k {
+		case "yourip", "ipv4", "ipv6":
+			if ip, ok := d.ip(k); ok {
+				v = ip
+			}
+		}
+		fmt.Fprintf(&b, "%s:%v", k, v)
+	}
+	return b.String()
+}
+
+//ip parses a compact IPv4 or IPv6 address
+func (d ExtHandshakeDict) ip(key string) (net.IP, bool) {
+	v, ok := d[key]
+	if !ok {
+		return nil, false
+	}
+	s, ok := v.(string)
+	if !ok || (len(s) != net.IPv4len && len(s) != net.IPv6len) {
+		return nil, false
+	}
+	return net.IP(s), true
+}
+
 const (
 	MetadataReqID ExtensionID = iota
 	MetadataDataID
@@ -15,6 +15,9 @@ var proto = [...]byte{
 	' ', 'p', 'r', 'o', 't', 'o', 'c', 'o', 'l',
 }
 
+//the length of an encoded handshake
+const handshakeLen = 1 + len(proto) + 8 + 20 + 20
+
 type HandShake struct {
 	Reserved Reserved
 	InfoHash [20]byte
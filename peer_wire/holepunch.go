@@ -0,0 +1,105 @@
+package peer_wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+//HolepunchMsgType is the kind of a ut_holepunch message (BEP 55).
+type HolepunchMsgType byte
+
+const (
+	//the initiator asks the relay to connect it with the target
+	HolepunchRendezvous HolepunchMsgType = iota
+	//the relay tells both ends to connect to each other
+	HolepunchConnect
+	//the relay couldn't fulfill a rendezvous request
+	HolepunchError
+)
+
+//HolepunchErrCode is sent by the relay along with HolepunchError messages.
+type HolepunchErrCode uint32
+
+const (
+	//the target endpoint is invalid
+	HolepunchNoSuchPeer HolepunchErrCode = iota + 1
+	//the relay isn't connected to the target
+	HolepunchNotConnected
+	//the target doesn't support hole punching
+	HolepunchNoSupport
+	//the target is the initiator
+	HolepunchNoSelf
+)
+
+func (e HolepunchErrCode) String() string {
+	switch e {
+	case HolepunchNoSuchPeer:
+		return "no such peer"
+	case HolepunchNotConnected:
+		return "not connected"
+	case HolepunchNoSupport:
+		return "no support"
+	case HolepunchNoSelf:
+		return "no self"
+	}
+	return "unknown error"
+}
+
+//address types of a ut_holepunch message
+const (
+	holepunchIPv4 byte = iota
+	holepunchIPv6
+)
+
+//HolepunchMsg is the payload of a ut_holepunch message. IP and Port are the
+//endpoint of the target (rendezvous) or the peer to connect to (connect).
+//Like lt_donthave, it isn't bencoded.
+type HolepunchMsg struct {
+	Type    HolepunchMsgType
+	IP      net.IP
+	Port    uint16
+	ErrCode HolepunchErrCode
+}
+
+func (hm HolepunchMsg) encode() []byte {
+	addrType, ip := holepunchIPv6, hm.IP.To16()
+	if ip4 := hm.IP.To4(); ip4 != nil {
+		addrType, ip = holepunchIPv4, ip4
+	}
+	b := make([]byte, 2+len(ip)+6)
+	b[0] = byte(hm.Type)
+	b[1] = addrType
+	n := 2 + copy(b[2:], ip)
+	binary.BigEndian.PutUint16(b[n:], hm.Port)
+	binary.BigEndian.PutUint32(b[n+2:], uint32(hm.ErrCode))
+	return b
+}
+
+func decodeHolepunch(payload []byte) (hm HolepunchMsg, err error) {
+	if len(payload) < 2 {
+		return hm, errors.New("holepunch msg: too short")
+	}
+	hm.Type = HolepunchMsgType(payload[0])
+	if hm.Type > HolepunchError {
+		return hm, errors.New("holepunch msg: unknown msg type")
+	}
+	var ipLen int
+	switch payload[1] {
+	case holepunchIPv4:
+		ipLen = net.IPv4len
+	case holepunchIPv6:
+		ipLen = net.IPv6len
+	default:
+		return hm, errors.New("holepunch msg: unknown address type")
+	}
+	payload = payload[2:]
+	if len(payload) != ipLen+6 {
+		return hm, errors.New("holepunch msg: wrong length")
+	}
+	hm.IP = make(net.IP, ipLen)
+	copy(hm.IP, payload)
+	hm.Port = binary.BigEndian.Uint16(payload[ipLen:])
+	hm.ErrCode = HolepunchErrCode(binary.BigEndian.Uint32(payload[ipLen+2:]))
+	return hm, nil
+}
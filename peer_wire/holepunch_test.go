@@ -0,0 +1,35 @@
+package peer_wire
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadWriteHolepunch(t *testing.T) {
+	msgs := []HolepunchMsg{
+		{Type: HolepunchRendezvous, IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881},
+		{Type: HolepunchConnect, IP: net.ParseIP("2001:db8::1"), Port: 51413},
+		{Type: HolepunchError, IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881, ErrCode: HolepunchNotConnected},
+	}
+	for _, hm := range msgs {
+		msg := &Msg{
+			Kind:        Extended,
+			ExtendedID:  ExtHolepunchID,
+			ExtendedMsg: hm,
+		}
+		decoded, err := Decode(bytes.NewReader(msg.Encode()))
+		require.NoError(t, err)
+		assert.Equal(t, msg, decoded)
+	}
+	//msg type, IPv4 address type, address, port and error code
+	assert.Equal(t, []byte{2, 0, 1, 2, 3, 4, 0x1a, 0xe1, 0, 0, 0, 2}, msgs[2].encode())
+	//an IPv6 address type with an IPv4 address
+	_, err := decodeHolepunch([]byte{1, 1, 1, 2, 3, 4, 0x1a, 0xe1, 0, 0, 0, 0})
+	assert.Error(t, err)
+	_, err = decodeHolepunch([]byte{3, 0, 1, 2, 3, 4, 0x1a, 0xe1, 0, 0, 0, 0})
+	assert.Error(t, err)
+}
@@ -1,7 +1,6 @@
 package peer_wire
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -78,111 +77,116 @@ type Msg struct {
 	ExtendedMsg interface{}
 }
 
-//Encode m as BitTorrent protocol specifies.
-func (m *Msg) Encode() []byte {
-	try := func(err error) {
-		if err != nil {
-			panic(err)
+//String returns a human readable description of m.
+func (m *Msg) String() string {
+	switch m.Kind {
+	case Have:
+		return fmt.Sprintf("Have index:%d", m.Index)
+	case Bitfield:
+		return fmt.Sprintf("Bitfield len:%d", len(m.Bf))
+	case Request, Cancel:
+		return fmt.Sprintf("%s index:%d begin:%d len:%d", m.Kind, m.Index, m.Begin, m.Len)
+	case Piece:
+		return fmt.Sprintf("Piece index:%d begin:%d len:%d", m.Index, m.Begin, len(m.Block))
+	case Port:
+		return fmt.Sprintf("Port %d", m.Port)
+	case Extended:
+		switch v := m.ExtendedMsg.(type) {
+		case MetadataExtMsg:
+			return fmt.Sprintf("Extended id:%d metadata kind:%d piece:%d total size:%d data len:%d",
+				m.ExtendedID, v.Kind, v.Piece, v.TotalSz, len(v.Data))
+		case ExtHandshakeDict:
+			return fmt.Sprintf("Extended id:%d handshake %s", m.ExtendedID, v)
 		}
+		return fmt.Sprintf("Extended id:%d %+v", m.ExtendedID, m.ExtendedMsg)
 	}
-	var b bytes.Buffer
+	return m.Kind.String()
+}
+
+//Encode m as BitTorrent protocol specifies.
+func (m *Msg) Encode() []byte {
+	return m.appendTo(nil)
+}
+
+//appendTo appends the encoding of m to b.
+func (m *Msg) appendTo(b []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
 	switch m.Kind {
 	case KeepAlive:
 	case Choke, Unchoke, Interested, NotInterested:
-		try(writeBinary(&b, m.Kind))
+		b = append(b, byte(m.Kind))
 	case Have:
-		try(writeBinary(&b, m.Kind, m.Index))
+		b = append(b, byte(m.Kind))
+		b = appendUint32(b, m.Index)
 	case Bitfield:
-		try(writeBinary(&b, m.Kind, m.Bf))
+		b = append(b, byte(m.Kind))
+		b = append(b, m.Bf...)
 	case Request, Cancel:
-		try(writeBinary(&b, m.Kind, m.Index, m.Begin, m.Len))
+		b = append(b, byte(m.Kind))
+		b = appendUint32(b, m.Index)
+		b = appendUint32(b, m.Begin)
+		b = appendUint32(b, m.Len)
 	case Piece:
-		try(writeBinary(&b, m.Kind, m.Index, m.Begin, m.Block))
+		b = appendPieceHeader(b[:start], m)
+		return append(b, m.Block...)
 	case Extended:
-		try(writeBinary(&b, m.Kind, m.ExtendedID, writeExtension(m)))
+		b = append(b, byte(m.Kind), byte(m.ExtendedID))
+		b = append(b, writeExtension(m)...)
 	case Port:
-		try(writeBinary(&b, m.Kind, m.Port))
+		b = append(b, byte(m.Kind), byte(m.Port>>8), byte(m.Port))
 	default:
 		panic("Unknown kind of msg to send")
 	}
-	var msgLen [4]byte
-	binary.BigEndian.PutUint32(msgLen[:], uint32(b.Len()))
-	buf := append(msgLen[:], b.Bytes()...)
-	return buf
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+//appends the length prefix and the fields of a piece msg except the block.
+func appendPieceHeader(b []byte, m *Msg) []byte {
+	b = appendUint32(b, uint32(9+len(m.Block)))
+	b = append(b, byte(Piece))
+	b = appendUint32(b, m.Index)
+	return appendUint32(b, m.Begin)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
 
 //Decode reads from r an encoded BitTorrent message and decode it as the protocol specifies.
+//Every message is allocated, use a Reader to avoid that.
 func Decode(r io.Reader) (*Msg, error) {
 	msg := new(Msg)
-	checkRead := func(err error) {
-		if err != nil {
-			panic(err)
-		}
+	dec := Reader{
+		r: r,
+		BlockBuf: func(length int) []byte {
+			return make([]byte, length)
+		},
 	}
-	msgLen := make([]byte, 4)
-	_, err := io.ReadFull(r, msgLen)
-	if err != nil {
+	if err := dec.ReadMsg(msg); err != nil {
 		return nil, err
 	}
-	_msgLen := binary.BigEndian.Uint32(msgLen)
-	if _msgLen > maxMsgLength {
-		return nil, errors.New("peer wire: too long msg")
-	}
-	if _msgLen == 0 {
-		msg.Kind = KeepAlive
-		return msg, nil
-	}
-	buf := make([]byte, _msgLen)
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-	b := bytes.NewBuffer(buf)
-	checkRead(readFromBinary(b, &msg.Kind))
-	switch msg.Kind {
-	case Choke, Unchoke, Interested, NotInterested:
-	case Have:
-		checkRead(readFromBinary(b, &msg.Index))
-	case Bitfield:
-		msg.Bf = b.Bytes()
-	case Request, Cancel:
-		checkRead(readFromBinary(b, &msg.Index, &msg.Begin, &msg.Len))
-	case Piece:
-		checkRead(readFromBinary(b, &msg.Index, &msg.Begin))
-		msg.Block = b.Bytes()
-	case Port:
-		checkRead(readFromBinary(b, &msg.Port))
-	case Extended:
-		checkRead(readFromBinary(b, &msg.ExtendedID))
-		err = readExtension(msg.ExtendedID, b.Bytes(), msg)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, errors.New("unknown kind of msg")
-	}
 	return msg, nil
 }
 
-//decodes msg.ExtendedMsg
+//encodes msg.ExtendedMsg. msg.ExtendedID is the ID that the remote peer
+//has assigned to the extension so we can't rely on it to determine the
+//kind of the message.
 func writeExtension(msg *Msg) (b []byte) {
+	switch v := msg.ExtendedMsg.(type) {
+	case DontHaveMsg:
+		return v.encode()
+	case HolepunchMsg:
+		return v.encode()
+	}
 	var err error
-	switch msg.ExtendedID {
-	case 0, ExtMetadataID:
-		b, err = bencode.Encode(&msg.ExtendedMsg)
-		if err != nil {
-			panic(err)
-		}
-		if msg.ExtendedID == 0 {
-			return
-		}
-		emsg := msg.ExtendedMsg.(MetadataExtMsg)
-		if emsg.Data == nil {
-			return
-		}
+	b, err = bencode.Encode(&msg.ExtendedMsg)
+	if err != nil {
+		panic(err)
+	}
+	if emsg, ok := msg.ExtendedMsg.(MetadataExtMsg); ok && emsg.Data != nil {
 		b = append(b, emsg.Data...)
-	default:
-		panic("unknown extension id")
 	}
 	return
 }
@@ -214,6 +218,20 @@ func readExtension(extKind ExtensionID, payload []byte, msg *Msg) error {
 			}
 		}
 		msg.ExtendedMsg = metaExt
+	case ExtPexID:
+		var pex PexMsg
+		if err = bencode.Decode(payload, &pex); err != nil {
+			return err
+		}
+		msg.ExtendedMsg = pex
+	case ExtDontHaveID:
+		if msg.ExtendedMsg, err = decodeDontHave(payload); err != nil {
+			return err
+		}
+	case ExtHolepunchID:
+		if msg.ExtendedMsg, err = decodeHolepunch(payload); err != nil {
+			return err
+		}
 	default:
 		return errors.New("unknown extension id")
 	}
@@ -252,17 +270,6 @@ func writeBinaryBitField(w io.Writer, bytefield []bool) error {
 	return binary.Write(w, binary.BigEndian, bitfield)
 }
 
-func readFromBinary(r io.Reader, data ...interface{}) error {
-	var err error
-	for _, d := range data {
-		err = binary.Read(r, binary.BigEndian, d)
-		if err != nil {
-			return fmt.Errorf("read binary: %w", err)
-		}
-	}
-	return nil
-}
-
 func writeBinary(w io.Writer, data ...interface{}) error {
 	var err error
 	for _, d := range data {
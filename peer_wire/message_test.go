@@ -3,6 +3,7 @@ package peer_wire
 import (
 	"encoding/binary"
 	"io"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -153,3 +154,62 @@ func TestReadExtension(t *testing.T) {
 	assert.EqualValues(t, metaExt.TotalSz, 3452)
 	assert.EqualValues(t, metaExt.Data, []byte("\x00\x11\x22\x33\x44"))
 }
+
+func TestExtHandshakeIPs(t *testing.T) {
+	d := ExtHandshakeDict{
+		"yourip": "\x01\x02\x03\x04",
+		"ipv6":   "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01",
+	}
+	ip, ok := d.YourIP()
+	require.True(t, ok)
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(ip))
+	ip, ok = d.IPv6()
+	require.True(t, ok)
+	assert.True(t, net.ParseIP("2001:db8::1").Equal(ip))
+	//ipv6 should be 16 bytes
+	d["ipv6"] = "\x01\x02\x03\x04"
+	_, ok = d.IPv6()
+	assert.False(t, ok)
+	delete(d, "yourip")
+	_, ok = d.YourIP()
+	assert.False(t, ok)
+}
+
+func TestExtHandshakeUploadOnly(t *testing.T) {
+	d := ExtHandshakeDict{}
+	_, ok := d.UploadOnly()
+	assert.False(t, ok)
+	d["upload_only"] = int64(1)
+	uploadOnly, ok := d.UploadOnly()
+	require.True(t, ok)
+	assert.True(t, uploadOnly)
+	d["upload_only"] = int64(0)
+	uploadOnly, ok = d.UploadOnly()
+	require.True(t, ok)
+	assert.False(t, uploadOnly)
+}
+
+func TestExtHandshakeFields(t *testing.T) {
+	d := ExtHandshakeDict{
+		"reqq": int64(500),
+		"p":    int64(6881),
+		"v":    "charo 0.0.0.1",
+		"ipv4": "\x01\x02\x03\x04",
+	}
+	reqq, ok := d.Reqq()
+	require.True(t, ok)
+	assert.Equal(t, 500, reqq)
+	port, ok := d.ListenPort()
+	require.True(t, ok)
+	assert.EqualValues(t, 6881, port)
+	v, ok := d.ClientVersion()
+	require.True(t, ok)
+	assert.Equal(t, "charo 0.0.0.1", v)
+	//invalid values
+	d["p"] = int64(1 << 16)
+	_, ok = d.ListenPort()
+	assert.False(t, ok)
+	d["reqq"] = int64(0)
+	_, ok = d.Reqq()
+	assert.False(t, ok)
+}
@@ -0,0 +1,117 @@
+package peer_wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+//MaxPexPeers is the maximum number of added (and dropped) peers a single
+//PEX message should contain.
+const MaxPexPeers = 50
+
+//PexFlags describe a peer contained in the `added` field of a PEX message.
+type PexFlags byte
+
+const (
+	PexPrefersEncryption PexFlags = 1 << iota
+	PexSeed
+	PexSupportsUTP
+	PexSupportsHolepunch
+	//the peer is reachable (we connected to it and not the other way around)
+	PexOutgoing
+)
+
+//PexMsg is the payload of a ut_pex message (BEP 11). Peers are stored in
+//compact format, use NewPexMsg, AddedPeers and DroppedPeers for convenient access.
+type PexMsg struct {
+	Added       []byte `bencode:"added" empty:"omit"`
+	AddedFlags  []byte `bencode:"added.f" empty:"omit"`
+	Added6      []byte `bencode:"added6" empty:"omit"`
+	Added6Flags []byte `bencode:"added6.f" empty:"omit"`
+	Dropped     []byte `bencode:"dropped" empty:"omit"`
+	Dropped6    []byte `bencode:"dropped6" empty:"omit"`
+}
+
+//PexPeer is a peer exchanged via PEX. Flags are meaningful only for added peers.
+type PexPeer struct {
+	IP    net.IP
+	Port  uint16
+	Flags PexFlags
+}
+
+//NewPexMsg creates a PexMsg. IPv4 and IPv6 peers are placed in their
+//corresponding fields.
+func NewPexMsg(added, dropped []PexPeer) PexMsg {
+	var m PexMsg
+	for _, p := range added {
+		if ip := p.IP.To4(); ip != nil {
+			m.Added = appendCompact(m.Added, ip, p.Port)
+			m.AddedFlags = append(m.AddedFlags, byte(p.Flags))
+		} else if ip := p.IP.To16(); ip != nil {
+			m.Added6 = appendCompact(m.Added6, ip, p.Port)
+			m.Added6Flags = append(m.Added6Flags, byte(p.Flags))
+		}
+	}
+	for _, p := range dropped {
+		if ip := p.IP.To4(); ip != nil {
+			m.Dropped = appendCompact(m.Dropped, ip, p.Port)
+		} else if ip := p.IP.To16(); ip != nil {
+			m.Dropped6 = appendCompact(m.Dropped6, ip, p.Port)
+		}
+	}
+	return m
+}
+
+//AddedPeers returns the IPv4 and IPv6 peers of the `added` fields.
+func (m PexMsg) AddedPeers() ([]PexPeer, error) {
+	peers, err := parseCompact(m.Added, m.AddedFlags, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := parseCompact(m.Added6, m.Added6Flags, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+//DroppedPeers returns the IPv4 and IPv6 peers of the `dropped` fields.
+func (m PexMsg) DroppedPeers() ([]PexPeer, error) {
+	peers, err := parseCompact(m.Dropped, nil, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := parseCompact(m.Dropped6, nil, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+func appendCompact(b []byte, ip net.IP, port uint16) []byte {
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], port)
+	b = append(b, ip...)
+	return append(b, p[:]...)
+}
+
+//flags may be nil or shorter than the number of peers, missing flags are zero.
+func parseCompact(b, flags []byte, ipLen int) ([]PexPeer, error) {
+	sz := ipLen + 2
+	if len(b)%sz != 0 {
+		return nil, errors.New("pex: compact peers length is not valid")
+	}
+	peers := make([]PexPeer, len(b)/sz)
+	for i := range peers {
+		off := i * sz
+		ip := make(net.IP, ipLen)
+		copy(ip, b[off:off+ipLen])
+		peers[i].IP = ip
+		peers[i].Port = binary.BigEndian.Uint16(b[off+ipLen : off+sz])
+		if i < len(flags) {
+			peers[i].Flags = PexFlags(flags[i])
+		}
+	}
+	return peers, nil
+}
@@ -0,0 +1,52 @@
+package peer_wire
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPexMsg(t *testing.T) {
+	added := []PexPeer{
+		{net.IPv4(1, 2, 3, 4).To4(), 6881, PexSeed | PexOutgoing},
+		{net.ParseIP("2001:db8::1"), 51413, PexSupportsUTP},
+	}
+	dropped := []PexPeer{
+		{net.IPv4(5, 6, 7, 8).To4(), 80, 0},
+	}
+	m := NewPexMsg(added, dropped)
+	assert.Len(t, m.Added, 6)
+	assert.Equal(t, []byte{byte(PexSeed | PexOutgoing)}, m.AddedFlags)
+	assert.Len(t, m.Added6, 18)
+	assert.Len(t, m.Dropped, 6)
+	assert.Nil(t, m.Dropped6)
+	peers, err := m.AddedPeers()
+	require.NoError(t, err)
+	assert.Equal(t, added, peers)
+	peers, err = m.DroppedPeers()
+	require.NoError(t, err)
+	assert.Equal(t, dropped, peers)
+	m.Added = m.Added[:5]
+	_, err = m.AddedPeers()
+	require.Error(t, err)
+}
+
+func TestReadWritePex(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	expect := NewPexMsg([]PexPeer{{net.IPv4(10, 0, 0, 1).To4(), 1000, PexSeed}}, nil)
+	go func() {
+		defer w.Close()
+		w.Write((&Msg{
+			Kind:        Extended,
+			ExtendedID:  ExtPexID,
+			ExtendedMsg: expect,
+		}).Encode())
+	}()
+	msg, err := Decode(r)
+	require.NoError(t, err)
+	assert.Equal(t, expect, msg.ExtendedMsg.(PexMsg))
+}
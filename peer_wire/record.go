@@ -0,0 +1,152 @@
+package peer_wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//RecordDir is the direction of a recorded message.
+type RecordDir byte
+
+const (
+	//the message was received from the peer
+	RecordRecv RecordDir = iota
+	//the message was sent to the peer
+	RecordSent
+)
+
+func (d RecordDir) String() string {
+	if d == RecordRecv {
+		return "<-"
+	}
+	return "->"
+}
+
+//timestamp, direction and length
+const recordHeaderLen = 8 + 1 + 4
+
+//Record is a message exchanged with a peer.
+type Record struct {
+	Time time.Time
+	Dir  RecordDir
+	//the message as it was transmitted (length prefix included)
+	Raw []byte
+}
+
+//HandShake decodes the recorded message as a handshake.
+func (r *Record) HandShake() (*HandShake, error) {
+	if len(r.Raw) != handshakeLen {
+		return nil, errors.New("record: not a handshake")
+	}
+	return readHs(bytes.NewReader(r.Raw))
+}
+
+//Msg decodes the recorded message. Extended messages we sent are encoded with the
+//peer's extension IDs so they may not be decoded correctly.
+func (r *Record) Msg() (*Msg, error) {
+	return Decode(bytes.NewReader(r.Raw))
+}
+
+//RecordWriter writes records in a framed format: the timestamp in unix
+//nanoseconds (8 bytes), the direction (1 byte), the length of the message
+//(4 bytes) and the message itself. It is safe for concurrent use.
+type RecordWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	hdr [recordHeaderLen]byte
+}
+
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{
+		w: w,
+	}
+}
+
+func (rw *RecordWriter) WriteRecord(r *Record) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	binary.BigEndian.PutUint64(rw.hdr[:], uint64(r.Time.UnixNano()))
+	rw.hdr[8] = byte(r.Dir)
+	binary.BigEndian.PutUint32(rw.hdr[9:], uint32(len(r.Raw)))
+	if _, err := rw.w.Write(rw.hdr[:]); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(r.Raw)
+	return err
+}
+
+//RecordReader reads records written by a RecordWriter.
+type RecordReader struct {
+	r   *bufio.Reader
+	hdr [recordHeaderLen]byte
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+//ReadRecord returns the next record or io.EOF if there are no more.
+func (rr *RecordReader) ReadRecord() (*Record, error) {
+	if _, err := io.ReadFull(rr.r, rr.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("record: truncated header")
+		}
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(rr.hdr[9:])
+	if l > maxMsgLength+4 {
+		return nil, errMsgTooLong
+	}
+	r := &Record{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(rr.hdr[:]))),
+		Dir:  RecordDir(rr.hdr[8]),
+		Raw:  make([]byte, l),
+	}
+	if _, err := io.ReadFull(rr.r, r.Raw); err != nil {
+		return nil, errors.New("record: truncated message")
+	}
+	return r, nil
+}
+
+//FrameSplitter splits a stream of encoded messages into messages.
+type FrameSplitter struct {
+	//If true, the stream starts with a handshake, which is the first frame
+	Handshake bool
+	buf       []byte
+}
+
+//Write appends b to the stream and calls f for every message that was completed.
+//f shouldn't retain the slice.
+func (fs *FrameSplitter) Write(b []byte, f func(frame []byte)) {
+	fs.buf = append(fs.buf, b...)
+	off := 0
+	if fs.Handshake {
+		if len(fs.buf) < handshakeLen {
+			return
+		}
+		f(fs.buf[:handshakeLen])
+		off = handshakeLen
+		fs.Handshake = false
+	}
+	for len(fs.buf)-off >= 4 {
+		l := 4 + int(binary.BigEndian.Uint32(fs.buf[off:]))
+		if l > maxMsgLength+4 {
+			//not a valid stream, the peer will be dropped
+			fs.buf = fs.buf[:0]
+			return
+		}
+		if len(fs.buf)-off < l {
+			break
+		}
+		f(fs.buf[off : off+l])
+		off += l
+	}
+	fs.buf = append(fs.buf[:0], fs.buf[off:]...)
+}
@@ -0,0 +1,90 @@
+package peer_wire
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReadWrite(t *testing.T) {
+	msgs := []*Msg{
+		{Kind: Interested},
+		{Kind: Request, Index: 1, Len: 1 << 14},
+		{Kind: Piece, Index: 1, Block: []byte("block")},
+	}
+	var b bytes.Buffer
+	rw := NewRecordWriter(&b)
+	now := time.Now()
+	for i, m := range msgs {
+		require.NoError(t, rw.WriteRecord(&Record{
+			Time: now.Add(time.Duration(i) * time.Second),
+			Dir:  RecordDir(i % 2),
+			Raw:  m.Encode(),
+		}))
+	}
+	rr := NewRecordReader(&b)
+	for i, m := range msgs {
+		r, err := rr.ReadRecord()
+		require.NoError(t, err)
+		assert.Equal(t, RecordDir(i%2), r.Dir)
+		assert.True(t, now.Add(time.Duration(i)*time.Second).Equal(r.Time))
+		decoded, err := r.Msg()
+		require.NoError(t, err)
+		assert.Equal(t, m, decoded)
+	}
+	_, err := rr.ReadRecord()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameSplitter(t *testing.T) {
+	var stream []byte
+	msgs := []*Msg{
+		{Kind: KeepAlive},
+		{Kind: Have, Index: 3},
+		{Kind: Piece, Index: 1, Block: make([]byte, 100)},
+	}
+	for _, m := range msgs {
+		stream = append(stream, m.Encode()...)
+	}
+	var fs FrameSplitter
+	var frames [][]byte
+	//feed the stream byte by byte
+	for i := range stream {
+		fs.Write(stream[i:i+1], func(frame []byte) {
+			frames = append(frames, append([]byte{}, frame...))
+		})
+	}
+	require.Len(t, frames, len(msgs))
+	for i, m := range msgs {
+		assert.Equal(t, m.Encode(), frames[i])
+	}
+}
+
+func TestFrameSplitterHandshake(t *testing.T) {
+	var b bytes.Buffer
+	hs := &HandShake{InfoHash: [20]byte{1}, PeerID: [20]byte{2}}
+	require.NoError(t, hs.write(&b))
+	b.Write((&Msg{Kind: Interested}).Encode())
+	stream := b.Bytes()
+	fs := FrameSplitter{Handshake: true}
+	var frames [][]byte
+	for i := range stream {
+		fs.Write(stream[i:i+1], func(frame []byte) {
+			frames = append(frames, append([]byte{}, frame...))
+		})
+	}
+	require.Len(t, frames, 2)
+	r := &Record{Raw: frames[0]}
+	got, err := r.HandShake()
+	require.NoError(t, err)
+	assert.Equal(t, hs, got)
+	_, err = (&Record{Raw: frames[1]}).HandShake()
+	assert.Error(t, err)
+	msg, err := (&Record{Raw: frames[1]}).Msg()
+	require.NoError(t, err)
+	assert.Equal(t, Interested, msg.Kind)
+}
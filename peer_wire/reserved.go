@@ -6,6 +6,15 @@ func (r Reserved) SupportDHT() bool {
 	return r[7]&0x1 != 0
 }
 
-func (r Reserved) SetDHT() {
+func (r *Reserved) SetDHT() {
 	r[7] |= 0x01
 }
+
+//SupportExtended reports whether the extension protocol (BEP 10) is supported.
+func (r Reserved) SupportExtended() bool {
+	return r[5]&0x10 != 0
+}
+
+func (r *Reserved) SetExtended() {
+	r[5] |= 0x10
+}
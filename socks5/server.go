@@ -0,0 +1,217 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+)
+
+//Server is a minimal SOCKS5 server supporting CONNECT and UDP ASSOCIATE. It
+//is meant for tests and simple deployments: it doesn't support BIND or
+//fragmented datagrams.
+type Server struct {
+	//If not nil, clients must authenticate with a username and password that
+	//Auth accepts
+	Auth func(username, password string) bool
+	//If not nil, it is called with the command (CONNECT or UDP ASSOCIATE) and
+	//the address of every request
+	OnRequest func(cmd string, addr string)
+}
+
+//Serve accepts connections on l until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	host, port, err := readAddr(conn)
+	if err != nil {
+		reply(conn, 8, nil)
+		return err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	switch req[1] {
+	case cmdConnect:
+		if s.OnRequest != nil {
+			s.OnRequest("CONNECT", addr)
+		}
+		return s.connect(conn, addr)
+	case cmdUDPAssociate:
+		if s.OnRequest != nil {
+			s.OnRequest("UDP ASSOCIATE", addr)
+		}
+		return s.associate(conn)
+	default:
+		reply(conn, 7, nil)
+		return errors.New("socks5: command not supported")
+	}
+}
+
+func (s *Server) negotiate(conn net.Conn) error {
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != version {
+		return errors.New("socks5: invalid version")
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	want := byte(methodNoAuth)
+	if s.Auth != nil {
+		want = methodUserPass
+	}
+	for _, m := range methods {
+		if m == want {
+			if _, err := conn.Write([]byte{version, want}); err != nil {
+				return err
+			}
+			if want == methodUserPass {
+				return s.authenticate(conn)
+			}
+			return nil
+		}
+	}
+	conn.Write([]byte{version, methodNoAcceptable})
+	return ErrNoAcceptableMethod
+}
+
+func (s *Server) authenticate(conn net.Conn) error {
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+	if !s.Auth(string(user), string(pass)) {
+		conn.Write([]byte{userPassVersion, 1})
+		return ErrAuthFailed
+	}
+	_, err := conn.Write([]byte{userPassVersion, 0})
+	return err
+}
+
+func (s *Server) connect(conn net.Conn, addr string) error {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		reply(conn, 5, nil)
+		return err
+	}
+	defer target.Close()
+	if err = reply(conn, 0, target.LocalAddr()); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+	wg.Wait()
+	return nil
+}
+
+//associate relays datagrams between the client and everyone else until the
+//control connection closes
+func (s *Server) associate(conn net.Conn) error {
+	//the relay listens at the address the client reached us
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		reply(conn, 1, nil)
+		return err
+	}
+	defer relay.Close()
+	if err = reply(conn, 0, relay.LocalAddr()); err != nil {
+		return err
+	}
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	go s.relay(relay, clientIP)
+	//the association lasts as long as the control connection
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
+
+func (s *Server) relay(pc net.PacketConn, clientIP net.IP) {
+	buf := make([]byte, maxDatagramSize)
+	var client net.Addr
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		fromUDP := from.(*net.UDPAddr)
+		if fromUDP.IP.Equal(clientIP) && (client == nil || client.String() == from.String()) {
+			//from the client, the first datagram tells us its port
+			client = from
+			host, port, payload, err := parseUDPHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(payload, dst)
+			continue
+		}
+		if client == nil {
+			continue
+		}
+		pkt, err := appendAddr([]byte{0, 0, 0}, fromUDP.IP.String(), fromUDP.Port)
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(append(pkt, buf[:n]...), client)
+	}
+}
+
+//reply sends a reply with code and the bound address
+func reply(conn net.Conn, code byte, bound net.Addr) error {
+	host, port := "0.0.0.0", 0
+	if bound != nil {
+		var err error
+		if host, port, err = splitHostPort(bound.String()); err != nil {
+			return err
+		}
+	}
+	b, err := appendAddr([]byte{version, code, 0}, host, port)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
@@ -0,0 +1,436 @@
+//Package socks5 implements a SOCKS5 client (RFC 1928) supporting CONNECT and
+//UDP ASSOCIATE with optional username/password authentication (RFC 1929),
+//along with a minimal server.
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	version = 5
+
+	methodNoAuth       = 0
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 1
+
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	//the largest UDP request header (domain of 255 bytes)
+	maxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+	maxDatagramSize = 65535
+)
+
+var (
+	//ErrAuthFailed is returned when the proxy rejects our username and
+	//password
+	ErrAuthFailed = errors.New("socks5: authentication failed")
+	//ErrNoAcceptableMethod is returned when the proxy requires an
+	//authentication method we don't support (or credentials we weren't given)
+	ErrNoAcceptableMethod = errors.New("socks5: no acceptable authentication method")
+)
+
+var replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+//ReplyError is returned when the proxy fails a request
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	if int(e.Code) < len(replies) {
+		return "socks5: " + replies[e.Code]
+	}
+	return "socks5: unknown reply " + strconv.Itoa(int(e.Code))
+}
+
+//Dialer connects to addresses through a SOCKS5 proxy
+type Dialer struct {
+	//host:port of the proxy
+	ProxyAddr string
+	//If not empty, we authenticate with username and password
+	Username string
+	Password string
+}
+
+//Dial connects to addr through the proxy. TCP networks use CONNECT and UDP
+//networks use UDP ASSOCIATE. Hostnames are resolved by the proxy.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+//DialContext is like Dial but ctx bounds connecting to the proxy and the
+//handshake
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ctrl, _, err := d.request(ctx, cmdConnect, host, port)
+		if err != nil {
+			return nil, err
+		}
+		return ctrl, nil
+	case "udp", "udp4", "udp6":
+		pc, err := d.listenPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &udpConn{packetConn: pc, host: host, port: port}, nil
+	default:
+		return nil, errors.New("socks5: unsupported network " + network)
+	}
+}
+
+//ListenPacket returns a PacketConn whose datagrams are relayed by the proxy
+//(UDP ASSOCIATE). The association lasts until the PacketConn is closed.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return d.listenPacket(ctx)
+}
+
+func (d *Dialer) listenPacket(ctx context.Context) (*packetConn, error) {
+	//we don't know the address we will send from
+	ctrl, relay, err := d.request(ctx, cmdUDPAssociate, "0.0.0.0", 0)
+	if err != nil {
+		return nil, err
+	}
+	relayAddr, ok := relay.(*net.UDPAddr)
+	if !ok {
+		ctrl.Close()
+		return nil, errors.New("socks5: relay address isn't an IP")
+	}
+	if relayAddr.IP.IsUnspecified() {
+		//the relay is at the host of the proxy
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	uc, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc := &packetConn{udp: uc, ctrl: ctrl}
+	go pc.watchCtrl()
+	return pc, nil
+}
+
+//request connects to the proxy and sends a request. It returns the control
+//connection and the bound address of the reply.
+func (d *Dialer) request(ctx context.Context, cmd byte, host string, port int) (net.Conn, net.Addr, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	bound, err := d.handshake(conn, cmd, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, cmd byte, host string, port int) (net.Addr, error) {
+	methods := []byte{methodNoAuth}
+	if d.Username != "" {
+		methods = append(methods, methodUserPass)
+	}
+	if _, err := conn.Write(append([]byte{version, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+	if b[0] != version {
+		return nil, errors.New("socks5: proxy responded with version " + strconv.Itoa(int(b[0])))
+	}
+	switch b[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if d.Username == "" {
+			return nil, ErrNoAcceptableMethod
+		}
+		if err := d.authenticate(conn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrNoAcceptableMethod
+	}
+	req := []byte{version, cmd, 0}
+	req, err := appendAddr(req, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return nil, err
+	}
+	var reply [3]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, &ReplyError{reply[1]}
+	}
+	bhost, bport, err := readAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(bhost)
+	if ip == nil {
+		return nil, errors.New("socks5: bound address isn't an IP")
+	}
+	if cmd == cmdUDPAssociate {
+		return &net.UDPAddr{IP: ip, Port: bport}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: bport}, nil
+}
+
+//authenticate with username and password (RFC 1929)
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: username or password is too long")
+	}
+	req := []byte{userPassVersion, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+//packetConn sends and receives datagrams through the UDP relay of the proxy
+type packetConn struct {
+	udp *net.UDPConn
+	//the association ends when it is closed
+	ctrl net.Conn
+}
+
+//watchCtrl closes the socket when the proxy ends the association so reads
+//don't block forever
+func (pc *packetConn) watchCtrl() {
+	io.Copy(ioutil.Discard, pc.ctrl)
+	pc.Close()
+}
+
+//ReadFrom returns the payload and the source of the next datagram the relay
+//forwarded to us
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPHeaderLen+len(b))
+	for {
+		n, err := pc.udp.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		host, port, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			//not for us or fragmented
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		return copy(b, payload), &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+}
+
+//WriteTo sends b to addr through the relay
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	host, port, err := splitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return pc.writeTo(b, host, port)
+}
+
+func (pc *packetConn) writeTo(b []byte, host string, port int) (int, error) {
+	pkt, err := appendAddr([]byte{0, 0, 0}, host, port)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = pc.udp.Write(append(pkt, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *packetConn) Close() error {
+	pc.ctrl.Close()
+	return pc.udp.Close()
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.udp.LocalAddr()
+}
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return pc.udp.SetDeadline(t)
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	return pc.udp.SetReadDeadline(t)
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return pc.udp.SetWriteDeadline(t)
+}
+
+//udpConn exchanges datagrams with a single address through the relay
+type udpConn struct {
+	*packetConn
+	host string
+	port int
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	ip := net.ParseIP(c.host)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		//we can't filter by source if the proxy resolved the host
+		if ip == nil || addr.(*net.UDPAddr).IP.Equal(ip) {
+			return n, nil
+		}
+	}
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.writeTo(b, c.host, c.port)
+}
+
+//RemoteAddr is a *net.UDPAddr if the address we dialed is an IP
+func (c *udpConn) RemoteAddr() net.Addr {
+	if ip := net.ParseIP(c.host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: c.port}
+	}
+	return addr(net.JoinHostPort(c.host, strconv.Itoa(c.port)))
+}
+
+//addr is a UDP address with a hostname
+type addr string
+
+func (a addr) Network() string {
+	return "udp"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+func splitHostPort(hostport string) (string, int, error) {
+	host, sport, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("socks5: invalid port %s", sport)
+	}
+	return host, int(port), nil
+}
+
+//appendAddr appends ATYP, ADDR and PORT to b
+func appendAddr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, atypIPv4), ip4...)
+		} else {
+			b = append(append(b, atypIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: hostname is too long")
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+//readAddr reads ATYP, ADDR and PORT from r
+func readAddr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var b []byte
+	switch atyp[0] {
+	case atypIPv4:
+		b = make([]byte, net.IPv4len+2)
+	case atypIPv6:
+		b = make([]byte, net.IPv6len+2)
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", 0, err
+		}
+		b = make([]byte, int(l[0])+2)
+	default:
+		return "", 0, &ReplyError{8}
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", 0, err
+	}
+	port := int(binary.BigEndian.Uint16(b[len(b)-2:]))
+	if atyp[0] == atypDomain {
+		return string(b[:len(b)-2]), port, nil
+	}
+	return net.IP(b[:len(b)-2]).String(), port, nil
+}
+
+//parseUDPHeader parses the header of a relayed datagram. Fragments aren't
+//supported.
+func parseUDPHeader(b []byte) (string, int, []byte, error) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", 0, nil, errors.New("socks5: invalid or fragmented datagram")
+	}
+	r := bytes.NewReader(b[3:])
+	host, port, err := readAddr(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
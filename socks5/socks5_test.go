@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveProxy(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func TestConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	var mu sync.Mutex
+	var reqs []string
+	proxy := serveProxy(t, &Server{
+		Auth: func(user, pass string) bool {
+			return user == "user" && pass == "pass"
+		},
+		OnRequest: func(cmd, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			reqs = append(reqs, cmd+" "+addr)
+		},
+	})
+	d := &Dialer{ProxyAddr: proxy, Username: "user", Password: "pass"}
+	c, err := d.Dial("tcp", echo.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	mu.Lock()
+	assert.Equal(t, []string{"CONNECT " + echo.Addr().String()}, reqs)
+	mu.Unlock()
+
+	d.Password = "wrong"
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.Equal(t, ErrAuthFailed, err)
+	d.Username = ""
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.Equal(t, ErrNoAcceptableMethod, err)
+}
+
+func TestConnectRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	d := &Dialer{ProxyAddr: serveProxy(t, &Server{})}
+	_, err = d.Dial("tcp", l.Addr().String())
+	var re *ReplyError
+	require.True(t, errors.As(err, &re))
+	assert.EqualValues(t, 5, re.Code)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+	d := &Dialer{ProxyAddr: serveProxy(t, &Server{})}
+	pc, err := d.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = pc.WriteTo([]byte("ping"), echo.LocalAddr())
+	require.NoError(t, err)
+	b := make([]byte, 100)
+	n, addr, err := pc.ReadFrom(b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b[:n]))
+	assert.Equal(t, echo.LocalAddr().String(), addr.String())
+
+	c, err := d.Dial("udp", echo.LocalAddr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Write([]byte("pong"))
+	require.NoError(t, err)
+	n, err = c.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(b[:n]))
+	assert.Equal(t, echo.LocalAddr().String(), c.RemoteAddr().String())
+}
+
+func TestUDPHeader(t *testing.T) {
+	pkt, err := appendAddr([]byte{0, 0, 0}, "tracker.example.org", 6969)
+	require.NoError(t, err)
+	host, port, payload, err := parseUDPHeader(append(pkt, "data"...))
+	require.NoError(t, err)
+	assert.Equal(t, "tracker.example.org", host)
+	assert.Equal(t, 6969, port)
+	assert.Equal(t, "data", string(payload))
+	//fragments aren't supported
+	pkt[2] = 1
+	_, _, _, err = parseUDPHeader(pkt)
+	assert.Error(t, err)
+}
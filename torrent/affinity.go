@@ -0,0 +1,64 @@
+package torrent
+
+//speedClass groups peers by their download rate for piece affinity
+type speedClass int
+
+const (
+	speedNone speedClass = iota
+	speedSlow
+	speedMedium
+	speedFast
+)
+
+//the same thresholds as libtorrent
+const (
+	fastPeerRate   = 512 * (1 << 10)
+	mediumPeerRate = 16 * (1 << 10)
+)
+
+func (c *conn) speedClass() speedClass {
+	switch rate := c.pipeline.rate; {
+	case rate == 0:
+		//not measured yet
+		return speedMedium
+	case rate >= fastPeerRate:
+		return speedFast
+	case rate >= mediumPeerRate:
+		return speedMedium
+	default:
+		return speedSlow
+	}
+}
+
+//canTake reports whether c should request blocks of piece when we respect
+//piece affinity. A piece that has pending blocks belongs to the fast peer
+//that started it or is shared by the peers of the same speed class.
+func (piece *Piece) canTake(c *conn, speed speedClass) bool {
+	if piece.PendingBlocks() == 0 {
+		return true
+	}
+	if piece.owner != nil {
+		return piece.owner == c
+	}
+	return piece.speed == speedNone || piece.speed == speed
+}
+
+//the first conn that requests blocks of a piece sets its affinity
+func (piece *Piece) setAffinity(c *conn, speed speedClass) {
+	if piece.speed != speedNone {
+		return
+	}
+	piece.speed = speed
+	if speed == speedFast {
+		piece.owner = c
+	}
+}
+
+//update reindexes piece after a change of its state or rarity. Pieces that
+//nobody downloads lose their affinity.
+func (p *pieces) update(piece *Piece) {
+	if piece.PendingBlocks() == 0 {
+		piece.speed, piece.owner = speedNone, nil
+	}
+	p.picker.update(piece)
+}
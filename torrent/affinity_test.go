@@ -0,0 +1,62 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/anacrolix/missinggo/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceAffinity(t *testing.T) {
+	selector := NewDefaultPieceSelector()
+	selector.OnPieceDownload(-1)
+	p := newPickerTestPieces(t, 4, selector)
+	p.affinity = true
+	var all bitmap.Bitmap
+	all.AddRange(0, 4)
+	fast1 := &conn{pipeline: pipeline{rate: 2 * fastPeerRate}}
+	fast2 := &conn{pipeline: pipeline{rate: 2 * fastPeerRate}}
+	slow1 := &conn{pipeline: pipeline{rate: 1}}
+	slow2 := &conn{pipeline: pipeline{rate: 1}}
+	reqs := make([]block, 2)
+	pieceOf := func(c *conn) int {
+		require.Equal(t, 2, p.fillRequests(all, reqs, c))
+		assert.Equal(t, reqs[0].pc, reqs[1].pc)
+		return reqs[0].pc
+	}
+	//fast peers keep their pieces to themselves
+	assert.Equal(t, 0, pieceOf(fast1))
+	assert.Equal(t, 1, pieceOf(fast2))
+	assert.Equal(t, 0, pieceOf(fast1))
+	//slow peers share pieces
+	assert.Equal(t, 2, pieceOf(slow1))
+	assert.Equal(t, 2, pieceOf(slow2))
+	assert.Equal(t, speedFast, p.pcs[0].speed)
+	assert.Equal(t, fast2, p.pcs[1].owner)
+	assert.Equal(t, speedSlow, p.pcs[2].speed)
+	//the last piece has 2 blocks
+	assert.Equal(t, 3, pieceOf(slow1))
+	//when nothing else is left, they help the others
+	assert.Equal(t, 1, pieceOf(slow1))
+	//pieces nobody downloads lose their affinity
+	p.discardRequests([]block{{pc: 2, off: 0}, {pc: 2, off: 1 << 14}, {pc: 2, off: 2 << 14}, {pc: 2, off: 3 << 14}})
+	assert.Equal(t, speedNone, p.pcs[2].speed)
+	//without affinity everyone takes the best piece
+	p.affinity = false
+	assert.Equal(t, 2, pieceOf(fast1))
+}
+
+func TestPieceContributors(t *testing.T) {
+	p := newPickerTestPieces(t, 2, NewDefaultPieceSelector())
+	piece := p.pcs[0]
+	c1, c2 := &connInfo{}, &connInfo{}
+	piece.setBlockComplete(c1, 0)
+	piece.setBlockComplete(c1, 1<<14)
+	assert.Equal(t, 1, piece.Contributors())
+	piece.setBlockComplete(c2, 2<<14)
+	piece.setBlockComplete(c1, 3<<14)
+	assert.Equal(t, 2, piece.Contributors())
+	p.pieceHashed(0, true)
+	assert.Equal(t, 2, piece.Contributors())
+}
@@ -85,7 +85,7 @@ func (c *choker) reviewUnchokedPeers() {
 	bestPeers, optimisticCandidates := []*connInfo{}, []*connInfo{}
 	for _, conn := range c.t.conns {
 		switch {
-		case conn.peerSeeding():
+		case conn.peerWantsNothing():
 			conn.choke()
 		case conn.isSnubbed() || !conn.state.isInterested:
 			optimisticCandidates = append(optimisticCandidates, conn)
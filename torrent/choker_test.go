@@ -84,3 +84,31 @@ func resetConns(chk *choker, numNotInterested int) {
 		c.state.amChoking = true
 	}
 }
+
+func TestChokerPartialSeed(t *testing.T) {
+	tr := &Torrent{
+		mi:            &metainfo.MetaInfo{},
+		uploadEnabled: true,
+	}
+	ci := &connInfo{
+		t:     tr,
+		sendC: make(chan interface{}, 50),
+		state: connState{
+			isInterested: true,
+			amChoking:    true,
+			isChoking:    true,
+		},
+		peerUploadOnly: true,
+	}
+	tr.conns = []*connInfo{ci}
+	chk := &choker{
+		t:              tr,
+		maxUploadSlots: 4,
+	}
+	chk.reviewUnchokedPeers()
+	//partial seeds are treated like seeds
+	assert.True(t, ci.state.amChoking)
+	ci.peerUploadOnly = false
+	chk.reviewUnchokedPeers()
+	assert.False(t, ci.state.amChoking)
+}
@@ -5,18 +5,24 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/dht/v2"
 	"github.com/lkslts64/charo-torrent/metainfo"
 	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/socks5"
 	"github.com/lkslts64/charo-torrent/torrent/storage"
 	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/lkslts64/charo-torrent/utp"
 )
 
 const clientID = "CH"
@@ -25,29 +31,46 @@ const logFileName = "charo.log"
 
 //Client manages multiple torrents
 type Client struct {
-	config   *Config
-	peerID   [20]byte
-	logger   *log.Logger
-	torrents map[[20]byte]*Torrent
-	close    chan struct{}
+	config *Config
+	peerID [20]byte
+	logger *log.Logger
+	close  chan struct{}
 
 	listener         listener
 	trackerAnnouncer *trackerAnnouncer
 	dhtServer        *dht.Server
+	//uTP connections are accepted and dialed through this socket
+	utpSocket *utp.Socket
 	//the reserved bytes we'll send at every handshake
 	reserved               peer_wire.Reserved
 	trackerAnnouncerCloseC chan chan struct{}
 	port                   int
+	ipv6                   net.IP //our global IPv6 address, nil if we don't have one
 	counters               *expvar.Map
-	mu                     sync.Mutex //guards following
-	blackList              []net.IP
+	//sent to trackers so they recognize us if our IP changes
+	trackerKey int32
+	//nil if we don't use a proxy
+	proxy *socks5.Dialer
+	//for HTTP trackers if we use a proxy and Config.TrackerHTTPClient is nil
+	proxyHTTPClient *http.Client
+	//votes of peers and trackers about our external IP
+	externalIPs externalIPVotes
+	mu          sync.Mutex //guards following
+	blackList   []net.IP
+	//accessed by the accept goroutine too
+	torrents map[[20]byte]*Torrent
 }
 
 //Config provides configuration for a Client.
 type Config struct {
 	//Returns a new PieceSelector instantiated for each torrent the client manages
 	SelectorF func() PieceSelector
-	//Max outstanding requests per connection we allow for a peer to have
+	//Fast peers download whole pieces by themselves and slower peers share
+	//pieces, so slow peers don't delay pieces that fast peers could finish
+	//and a bad peer taints fewer pieces
+	PieceAffinity bool
+	//Max outstanding requests we pipeline to a peer. The actual number
+	//adapts to the throughput and latency of the peer.
 	MaxOnFlightReqs int
 	//Max active/established connections per torrent
 	MaxEstablishedConns int
@@ -55,6 +78,8 @@ type Config struct {
 	RejectIncomingConnections bool
 	DisableTrackers           bool
 	DisableDHT                bool
+	//Use only TCP for peer connections
+	DisableUTP bool
 	//Directory to store the data
 	BaseDir string
 	//Function to open the storage.Provide your own for a custom storage implementation
@@ -63,10 +88,61 @@ type Config struct {
 	DialTimeout time.Duration
 	//BitTorrent handshakes will fail after this duration
 	HandshakeTiemout time.Duration
+	//How long closing a Torrent (or the Client) waits for the trackers to
+	//receive our Stopped announces. Defaults to 5 seconds if zero.
+	TrackerStopTimeout time.Duration
+	//If not zero, the swarms of all torrents are scraped that often (see
+	//Client.Scrape)
+	ScrapeInterval time.Duration
+	//The client for requests to HTTP trackers, e.g to configure proxies or
+	//TLS roots. Use &http.Client{Transport: rt} for a custom RoundTripper.
+	//If nil, a shared client with the default transport is used. It is used
+	//as is even if ProxyOnly is set, so it must go through the proxy then.
+	TrackerHTTPClient *http.Client
+	//The User-Agent of requests to HTTP trackers. Defaults to
+	//tracker.DefaultUserAgent.
+	TrackerUserAgent string
+	//If not empty, TCP connections with peers, UDP trackers and the DHT go
+	//through this SOCKS5 proxy (host:port). So do HTTP trackers unless
+	//TrackerHTTPClient is set.
+	Socks5Proxy string
+	//Credentials for the proxy if it requires authentication
+	Socks5Username string
+	Socks5Password string
+	//Make no connection that bypasses the proxy. Incoming connections and uTP
+	//are disabled. Requires Socks5Proxy. A TrackerHTTPClient has to use the
+	//proxy by itself.
+	ProxyOnly bool
+	//Whether we should encrypt connections with peers (Message Stream Encryption).
+	EncryptionPolicy EncryptionPolicy
+	//Connections with peers whose client starts with any of these (e.g "Xunlei"
+	//or "Transmission 2.9") are refused. The client is decoded from the peer ID
+	//or taken from the extension handshake and matching is case insensitive.
+	ClientBlacklist []string
+	//If not nil, it is called for every established connection. The messages
+	//exchanged with the peer are recorded at the returned writer (see
+	//peer_wire.RecordReader for reading them back). Return nil to not record
+	//the connection. RecordWireToDir provides a common implementation.
+	RecordWire func(infoHash [20]byte, peer Peer) io.WriteCloser
 }
 
+//EncryptionPolicy determines how connections with peers are obfuscated.
+type EncryptionPolicy byte
+
+const (
+	//Try to establish encrypted connections but fallback to plaintext
+	//if the remote peer doesn't support encryption. Both encrypted and plaintext
+	//incoming connections are accepted.
+	EncryptionPrefer EncryptionPolicy = iota
+	//Only encrypted connections are established or accepted.
+	EncryptionRequire
+	//Encryption is not used at all.
+	EncryptionDisable
+)
+
 //NewClient creates a new Client with the provided configuration.
-//Use `NewClient(nil)` for the default configuration.
+//Use `NewClient(nil)` for the default configuration. cfg is copied, so
+//changing it later doesn't affect the Client.
 func NewClient(cfg *Config) (*Client, error) {
 	var err error
 	if cfg == nil {
@@ -75,12 +151,36 @@ func NewClient(cfg *Config) (*Client, error) {
 			return nil, err
 		}
 	}
+	//we adjust some options below, don't touch the caller's
+	cfgCopy := *cfg
+	cfg = &cfgCopy
 	cl := &Client{
-		peerID:    newPeerID(),
-		config:    cfg,
-		close:     make(chan struct{}),
-		torrents:  make(map[[20]byte]*Torrent),
-		blackList: make([]net.IP, 0),
+		peerID:     newPeerID(),
+		trackerKey: rand.Int31(),
+		config:     cfg,
+		close:      make(chan struct{}),
+		torrents:   make(map[[20]byte]*Torrent),
+		blackList:  make([]net.IP, 0),
+	}
+	cl.reserved.SetExtended()
+	if cfg.Socks5Proxy != "" {
+		cl.proxy = &socks5.Dialer{
+			ProxyAddr: cfg.Socks5Proxy,
+			Username:  cfg.Socks5Username,
+			Password:  cfg.Socks5Password,
+		}
+		cl.proxyHTTPClient = &http.Client{
+			Transport: &http.Transport{DialContext: cl.proxy.DialContext},
+		}
+	}
+	if cfg.ProxyOnly {
+		if cl.proxy == nil {
+			return nil, errors.New("proxy only mode requires a proxy")
+		}
+		cl.config.RejectIncomingConnections = true
+		cl.config.DisableUTP = true
+	} else {
+		cl.ipv6 = getOutboundIPv6()
 	}
 	cl.counters = expvar.NewMap("counters" + string(cl.peerID[:]))
 	logPrefix := fmt.Sprintf("client%x ", cl.peerID[14:]) //last 6 bytes of peerID
@@ -93,23 +193,30 @@ func NewClient(cfg *Config) (*Client, error) {
 		if cl.listener, err = listen(cl); err != nil {
 			cl.logger.Fatal(err)
 		}
-		go func() {
-			log.Fatal(cl.acceptForEver())
-		}()
+		go cl.acceptForEver()
 	} else {
-		cl.config.DisableDHT = true
+		//the DHT would accept incoming packets, unless it goes through the
+		//proxy
+		if !cl.config.ProxyOnly {
+			cl.config.DisableDHT = true
+		}
+		if !cl.config.DisableUTP {
+			//we still need a socket to dial uTP connections
+			if cl.utpSocket, err = utp.NewSocket("udp", ":0"); err != nil {
+				return nil, err
+			}
+			go cl.rejectUTP()
+		}
 	}
 	if !cl.config.DisableTrackers {
-		cl.trackerAnnouncer = &trackerAnnouncer{
-			cl:                            cl,
-			trackerAnnouncerSubmitEventCh: make(chan trackerAnnouncerEvent, 5),
-			trackers:                      make(map[string]*trackerURL),
+		cl.trackerAnnouncer = newTrackerAnnouncer(cl)
+		if cl.config.ScrapeInterval > 0 {
+			go cl.scrapeForEver()
 		}
-		go cl.trackerAnnouncer.run()
 	}
 	if !cl.config.DisableDHT {
 		cl.reserved.SetDHT()
-		if cl.dhtServer, err = dht.NewServer(nil); err == nil {
+		if cl.dhtServer, err = cl.newDHTServer(); err == nil {
 			go func() {
 				ts, err := cl.dhtServer.Bootstrap()
 				if err != nil {
@@ -125,20 +232,28 @@ func NewClient(cfg *Config) (*Client, error) {
 }
 
 //Close calls torrent.Close for all the torrents managed by the client.
+//The torrents are closed in parallel so the trackers of all of them are
+//notified within Config.TrackerStopTimeout.
 func (cl *Client) Close() {
 	close(cl.close)
 	if cl.dhtServer != nil {
 		cl.dhtServer.Close()
 	}
 	wg := sync.WaitGroup{}
-	wg.Add(len(cl.torrents))
-	for _, t := range cl.Torrents() {
+	ts := cl.Torrents()
+	wg.Add(len(ts))
+	for _, t := range ts {
 		go func(t *Torrent) {
 			defer wg.Done()
 			t.Close()
 		}(t)
 	}
 	wg.Wait()
+	if cl.listener != nil {
+		cl.listener.Close()
+	} else if cl.utpSocket != nil {
+		cl.utpSocket.Close()
+	}
 }
 
 //DefaultConfig returns the default configuration for a client
@@ -155,6 +270,8 @@ func DefaultConfig() (*Config, error) {
 		OpenStorage:         storage.OpenFileStorage,
 		DialTimeout:         5 * time.Second,
 		HandshakeTiemout:    4 * time.Second,
+		TrackerStopTimeout:  5 * time.Second,
+		EncryptionPolicy:    EncryptionPrefer,
 	}, nil
 }
 
@@ -210,16 +327,17 @@ func (cl *Client) add(p metainfo.Parser) (*Torrent, error) {
 		return nil, err
 	}
 	t.gotInfoHash()
-	ihash := t.mi.Info.Hash
-	if _, ok := cl.torrents[ihash]; ok {
-		return nil, errors.New("torrent already exists")
+	t.addTrackers(metainfoTrackers(t.mi))
+	if err = cl.addTorrent(t); err != nil {
+		return nil, err
 	}
-	cl.torrents[ihash] = t
 	return t, nil
 }
 
 //dropTorrent removes the Torrent the  torrent with infohash `infohash`.
 func (cl *Client) dropTorrent(infohash [20]byte) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	if _, ok := cl.torrents[infohash]; !ok {
 		return errors.New("torrent doesn't exist")
 	}
@@ -229,6 +347,8 @@ func (cl *Client) dropTorrent(infohash [20]byte) error {
 
 //Torrents returns all torrents that the client manages.
 func (cl *Client) Torrents() []*Torrent {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	ts := []*Torrent{}
 	for _, t := range cl.torrents {
 		ts = append(ts, t)
@@ -247,6 +367,8 @@ func (cl *Client) ID() []byte {
 }
 
 func (cl *Client) addTorrent(t *Torrent) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	ihash := t.mi.Info.Hash
 	if _, ok := cl.torrents[ihash]; ok {
 		return errors.New("torrent already exists")
@@ -255,6 +377,24 @@ func (cl *Client) addTorrent(t *Torrent) error {
 	return nil
 }
 
+func (cl *Client) torrent(ihash [20]byte) (*Torrent, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	t, ok := cl.torrents[ihash]
+	return t, ok
+}
+
+//infoHashes returns the info hashes of the torrents the client manages
+func (cl *Client) infoHashes() [][20]byte {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	ret := make([][20]byte, 0, len(cl.torrents))
+	for ihash := range cl.torrents {
+		ret = append(ret, ihash)
+	}
+	return ret
+}
+
 func (cl *Client) dhtPort() uint16 {
 	ap, err := parseAddr(cl.dhtServer.Addr().String())
 	if err != nil {
@@ -263,10 +403,24 @@ func (cl *Client) dhtPort() uint16 {
 	return ap.port
 }
 
-//TODO: don't leak this goroutine on client.Close
-func (cl *Client) acceptForEver() error {
+//rejectUTP closes incoming uTP connections if we don't accept any
+func (cl *Client) rejectUTP() {
+	for {
+		nc, err := cl.utpSocket.Accept()
+		if err != nil {
+			return
+		}
+		nc.Close()
+	}
+}
+
+//acceptForEver accepts connections until the client is closed
+func (cl *Client) acceptForEver() {
 	for {
 		conn, err := cl.listener.Accept()
+		if err == errClientClosed {
+			return
+		}
 		if err != nil {
 			cl.logger.Println(err)
 			continue
@@ -294,7 +448,7 @@ func (cl *Client) runConnection(c *conn) {
 	var err error
 	defer func() {
 		if err != nil {
-			cl.logger.Println(err)
+			cl.logger.Printf("conn with %s (%s): %s\n", c.peer.P.String(), c.client, err)
 		}
 		c.cn.Close()
 		cl.counters.Add("closed connections", 1)
@@ -324,6 +478,10 @@ func (cl *Client) makeOutgoingConnection(t *Torrent, peer Peer) {
 	}).dial()
 	if err != nil {
 		cl.counters.Add("could not dial", 1)
+		if peer.Source == SourcePEX {
+			//maybe the peer is behind a NAT
+			t.holepunchPeer(peer)
+		}
 		return
 	}
 	cl.runConnection(c)
@@ -343,5 +501,19 @@ func (cl *Client) handshake(tcpConn net.Conn, hs *peer_wire.HandShake, peer Peer
 	if peer.P.ID != nil && !bytes.Equal(peer.P.ID, hs.PeerID[:]) {
 		return nil, errors.New("peer ID not compatible with the one tracker gave us")
 	}
+	if ci, ok := peer_wire.ParsePeerID(hs.PeerID); ok && cl.clientBlacklisted(ci.String()) {
+		cl.counters.Add("blacklisted clients", 1)
+		return nil, fmt.Errorf("client %q is blacklisted", ci)
+	}
 	return hs, nil
 }
+
+func (cl *Client) clientBlacklisted(client string) bool {
+	client = strings.ToLower(client)
+	for _, prefix := range cl.config.ClientBlacklist {
+		if strings.HasPrefix(client, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,6 @@
 package torrent
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -14,10 +13,10 @@ import (
 	"github.com/anacrolix/missinggo/bitmap"
 	"github.com/lkslts64/charo-torrent/peer_wire"
 	"github.com/lkslts64/charo-torrent/torrent/storage"
+	"github.com/lkslts64/charo-torrent/tracker"
 )
 
 const (
-	maxOnFlight = 20
 	//the size could be t.reqq?
 	readCSize = 250
 	sendCSize = 10
@@ -36,10 +35,10 @@ type conn struct {
 	t      *Torrent
 	logger *log.Logger
 	//tcp connection with peer
-	cn      net.Conn
-	bwriter *bufio.Writer
-	peer    Peer
-	exts    peer_wire.Extensions
+	cn   net.Conn
+	w    *peer_wire.Writer
+	peer Peer
+	exts peer_wire.Extensions
 	//main goroutine also has this state - needs to be synced between
 	//the two goroutines
 	state connState
@@ -55,9 +54,15 @@ type conn struct {
 	ban            bool
 	keepAliveTimer *time.Timer
 	peerReqs       map[block]struct{}
-	onFlightReqs   map[block]struct{}
-	muPeerReqs     sync.Mutex
-	haveInfo       bool
+	//requests we sent and when
+	onFlightReqs map[block]time.Time
+	//requests that timed out and were given to other peers. The peer
+	//may still send them until we cancel them.
+	timedOutReqs map[block]time.Time
+	reqTimer     requestTimer
+	pipeline     pipeline
+	muPeerReqs   sync.Mutex
+	haveInfo     bool
 
 	//
 	debugVerifications int
@@ -68,6 +73,20 @@ type conn struct {
 	peerBf   bitmap.Bitmap
 	myBf     bitmap.Bitmap
 	peerID   []byte
+	//the client software of the peer
+	client string
+	//last time we received a PEX msg
+	lastPexRecv time.Time
+	//whether the connection is encrypted with MSE
+	encrypted bool
+	//whether the connection runs over uTP
+	utp bool
+	//reused for every piece msg we upload
+	pieceMsg peer_wire.Msg
+	//we don't want any pieces (BEP 21)
+	uploadOnly bool
+	//the peer doesn't want any pieces (BEP 21)
+	peerUploadOnly bool
 }
 
 //just wraps a msg with an error
@@ -83,18 +102,30 @@ func newConn(t *Torrent, cn net.Conn, peer Peer) *conn {
 		t:            t,
 		logger:       log.New(t.cl.logger.Writer(), logPrefix, log.LstdFlags),
 		cn:           cn,
-		bwriter:      bufio.NewWriter(cn),
+		w:            peer_wire.NewWriter(cn),
 		peer:         peer,
 		state:        newConnState(),
 		recvC:        make(chan interface{}, recvCSize),
 		sendC:        make(chan interface{}, sendCSize),
 		droppedC:     make(chan struct{}),
-		onFlightReqs: make(map[block]struct{}),
+		onFlightReqs: make(map[block]time.Time),
+		timedOutReqs: make(map[block]time.Time),
+		pipeline:     newPipeline(t.cl.config.MaxOnFlightReqs),
 		peerBf:       bitmap.Bitmap{RB: roaring.NewBitmap()},
 		peerReqs:     make(map[block]struct{}),
 	}
 }
 
+func newConnFromHandshake(t *Torrent, cn net.Conn, peer Peer, hs *peer_wire.HandShake) *conn {
+	c := newConn(t, cn, peer)
+	c.reserved = hs.Reserved
+	c.peerID = hs.PeerID[:]
+	if ci, ok := peer_wire.ParsePeerID(hs.PeerID); ok {
+		c.client = ci.String()
+	}
+	return c
+}
+
 //inform Torrent about the new connection
 func (c *conn) informTorrent() error {
 	select {
@@ -112,12 +143,16 @@ func (c *conn) connInfo() *connInfo {
 	return &connInfo{
 		t: c.t,
 		// Torrent should see c.recvC as its send channel and c.sendC as its receive channel.
-		sendC:    c.recvC,
-		recvC:    c.sendC,
-		droppedC: c.droppedC,
-		peer:     c.peer,
-		reserved: c.reserved,
-		state:    c.state,
+		sendC:     c.recvC,
+		recvC:     c.sendC,
+		droppedC:  c.droppedC,
+		peer:      c.peer,
+		reserved:  c.reserved,
+		state:     c.state,
+		encrypted: c.encrypted,
+		utp:       c.utp,
+		peerID:    c.peerID,
+		client:    c.client,
 	}
 }
 
@@ -163,6 +198,8 @@ func (c *conn) mainLoop() error {
 	}()
 	go c.readPeerMsgs(readC, quit, readErrC)
 	c.keepAliveTimer = time.NewTimer(keepAliveInterval)
+	requestsTicker := time.NewTicker(requestsTickInterval)
+	defer requestsTicker.Stop()
 	//debugTick := time.NewTicker(2 * time.Second)
 	//defer debugTick.Stop()
 	for {
@@ -176,6 +213,8 @@ func (c *conn) mainLoop() error {
 			return nil
 		case <-c.keepAliveTimer.C:
 			err = c.sendKeepAlive()
+		case now := <-requestsTicker.C:
+			err = c.onRequestsTick(now)
 		}
 		if err != nil {
 			return err
@@ -197,10 +236,11 @@ func nilOnEOF(err error) error {
 //run on seperate goroutine
 func (c *conn) readPeerMsgs(readC chan<- *peer_wire.Msg, quit chan struct{},
 	errC chan error) {
+	r := peer_wire.NewReader(c.cn)
+	msg := new(peer_wire.Msg)
 	for {
 		c.cn.SetReadDeadline(time.Now().Add(keepAliveInterval + time.Minute)) //lets be forbearing
-		msg, err := peer_wire.Decode(c.cn)
-		if err != nil {
+		if err := r.ReadMsg(msg); err != nil {
 			errC <- err
 			return
 		}
@@ -241,6 +281,8 @@ func (c *conn) readPeerMsgs(readC chan<- *peer_wire.Msg, quit chan struct{},
 		if sendToChan {
 			select {
 			case readC <- msg:
+				//msg is owned by the main goroutine now
+				msg = new(peer_wire.Msg)
 			case <-quit: //we must care for quit here
 				return
 			}
@@ -250,34 +292,131 @@ func (c *conn) readPeerMsgs(readC chan<- *peer_wire.Msg, quit chan struct{},
 
 func (c *conn) wantBlocks() bool {
 	return !c.amSeeding() && c.haveInfo && c.state.canDownload() &&
-		c.peerBf.Len() > 0 && len(c.onFlightReqs) < maxOnFlight/2
+		c.peerBf.Len() > 0 && c.numOnFlight() < (c.maxOnFlightReqs()+1)/2
+}
+
+//requests that timed out still occupy the peer's queue
+func (c *conn) numOnFlight() int {
+	return len(c.onFlightReqs) + len(c.timedOutReqs)
+}
+
+//the max number of requests we pipeline to the peer. Peers may advertise
+//a lower limit than ours.
+func (c *conn) maxOnFlightReqs() int {
+	if c.peerReqq > 0 && c.peerReqq < c.pipeline.depth {
+		return c.peerReqq
+	}
+	return c.pipeline.depth
 }
 
 func (c *conn) maybeSendRequests() {
 	if !c.wantBlocks() {
 		return
 	}
-	sz := maxOnFlight - len(c.onFlightReqs)
+	sz := c.maxOnFlightReqs() - c.numOnFlight()
 	if sz <= 0 {
 		panic("on flight queue is full")
 	}
-	requests := make([]block, sz)
-	n := c.t.pieces.fillRequests(c.peerBf, requests)
-	if n == 0 {
-		if (requests[0] != block{}) {
-			panic("send requests")
+	//we gave up on the timed out blocks, let other peers have them. They
+	//stay requested until we are done so we don't get them again.
+	var timedOut []block
+	defer func() {
+		if len(timedOut) > 0 {
+			c.t.pieces.discardRequests(timedOut)
+		}
+	}()
+	seen := make(map[block]struct{})
+	for sent := 0; sent < sz; {
+		requests := make([]block, sz-sent)
+		n := c.t.pieces.fillRequests(c.peerBf, requests, c)
+		if n == 0 {
+			if (requests[0] != block{}) {
+				panic("send requests")
+			}
+			if sent == 0 && len(timedOut) == 0 {
+				c.cl.counters.Add("nonUsefulRequestReads", 1)
+			}
+			return
+		}
+		progress := false
+		for _, req := range requests[:n] {
+			if _, ok := seen[req]; ok {
+				continue
+			}
+			seen[req] = struct{}{}
+			progress = true
+			if _, ok := c.onFlightReqs[req]; ok {
+				continue
+			}
+			if _, ok := c.timedOutReqs[req]; ok {
+				timedOut = append(timedOut, req)
+				continue
+			}
+			c.onFlightReqs[req] = time.Now()
+			c.sendMsgToPeer(req.reqMsg())
+			sent++
+		}
+		//the picker has nothing else for us (e.g at end game)
+		if !progress {
+			return
 		}
-		c.cl.counters.Add("nonUsefulRequestReads", 1)
-		return
 	}
-	requests = requests[:n]
-	for _, req := range requests {
-		if _, ok := c.onFlightReqs[req]; ok {
-			continue
+}
+
+//resizes the pipeline and checks for requests that timed out
+func (c *conn) onRequestsTick(now time.Time) error {
+	prevDepth := c.pipeline.depth
+	c.pipeline.update(now, c.numOnFlight() == 0, c.t.blockRequestSize)
+	if err := c.checkRequestTimeouts(); err != nil {
+		return err
+	}
+	if c.cancelLateRequests() > 0 || c.pipeline.depth > prevDepth {
+		c.maybeSendRequests()
+	}
+	return nil
+}
+
+//checkRequestTimeouts releases the requests that the peer didn't satisfy in
+//time so other peers can request them. We don't cancel them yet because the
+//peer may still send them.
+func (c *conn) checkRequestTimeouts() error {
+	if len(c.onFlightReqs) == 0 {
+		return nil
+	}
+	timeout := c.reqTimer.timeout()
+	var timedOut []block
+	for req, sent := range c.onFlightReqs {
+		if time.Since(sent) >= timeout {
+			timedOut = append(timedOut, req)
+			c.timedOutReqs[req] = sent
+			delete(c.onFlightReqs, req)
+		}
+	}
+	if len(timedOut) == 0 {
+		return nil
+	}
+	c.cl.counters.Add("timedOutRequests", int64(len(timedOut)))
+	c.reqTimer.timedOut()
+	c.t.pieces.discardRequests(timedOut)
+	return c.sendMsgToTorrent(requestsTimedOut(len(timedOut)))
+}
+
+//cancelLateRequests gives up on the requests that timed out and the peer
+//still didn't send after lateRequestTimeout, so they stop occupying its
+//queue. Returns the number of cancelled requests.
+func (c *conn) cancelLateRequests() int {
+	var n int
+	for req, sent := range c.timedOutReqs {
+		if time.Since(sent) >= lateRequestTimeout {
+			c.sendMsgToPeer(req.cancelMsg())
+			delete(c.timedOutReqs, req)
+			n++
 		}
-		c.onFlightReqs[req] = struct{}{}
-		c.sendMsgToPeer(req.reqMsg())
 	}
+	if n > 0 {
+		c.cl.counters.Add("cancelledLateRequests", int64(n))
+	}
+	return n
 }
 
 //returns false if its worth to keep the conn alive
@@ -285,7 +424,17 @@ func (c *conn) notUseful() bool {
 	if !c.haveInfo {
 		return false
 	}
-	return c.peerSeeding() && c.amSeeding()
+	return c.peerWantsNothing() && c.wantNothing()
+}
+
+//true if the peer is a seed or a partial seed
+func (c *conn) peerWantsNothing() bool {
+	return c.peerUploadOnly || c.peerSeeding()
+}
+
+//true if we are a seed or a partial seed
+func (c *conn) wantNothing() bool {
+	return c.uploadOnly || c.amSeeding()
 }
 
 func (c *conn) peerSeeding() bool {
@@ -318,6 +467,7 @@ func (c *conn) onTorrentMsg(cmd interface{}) (err error) {
 			defer c.maybeSendRequests()
 		case peer_wire.NotInterested:
 			c.state.amInterested = false
+			c.timedOutReqs = make(map[block]time.Time)
 			//due to inconsistent states between Torrent and conn we may have requests on flight
 			//which we'll be lost (hopefully I think this doesn't happen too much)
 			c.cl.counters.Add("lostBlocksDueToSync", int64(len(c.onFlightReqs)))
@@ -350,6 +500,7 @@ func (c *conn) onTorrentMsg(cmd interface{}) (err error) {
 			if _, ok := c.onFlightReqs[reqMsgToBlock(v)]; !ok {
 				return
 			}
+		case peer_wire.Extended:
 		default:
 			panic("unknown msg type")
 		}
@@ -364,6 +515,29 @@ func (c *conn) onTorrentMsg(cmd interface{}) (err error) {
 			Kind: peer_wire.Bitfield,
 			Bf:   c.bitfield(c.myBf),
 		})
+	case pieceLost:
+		c.myBf.Set(int(v), false)
+		//we can't satisfy requests for this piece anymore
+		c.muPeerReqs.Lock()
+		for req := range c.peerReqs {
+			if req.pc == int(v) {
+				delete(c.peerReqs, req)
+			}
+		}
+		c.muPeerReqs.Unlock()
+		if id, ok := c.exts[peer_wire.ExtDontHaveName]; ok {
+			err = c.sendMsgToPeer(&peer_wire.Msg{
+				Kind:        peer_wire.Extended,
+				ExtendedID:  id,
+				ExtendedMsg: peer_wire.DontHaveMsg(v),
+			})
+		}
+	case uploadOnly:
+		c.uploadOnly = bool(v)
+		if c.notUseful() {
+			err = io.EOF
+			return
+		}
 	case requestsAvailable:
 		c.maybeSendRequests()
 	case haveInfo:
@@ -379,23 +553,30 @@ func (c *conn) onTorrentMsg(cmd interface{}) (err error) {
 
 func (c *conn) sendMsgToPeer(msg *peer_wire.Msg) error {
 	limit := 1 << 16 //64KiB
-	n, err := c.bwriter.Write(msg.Encode())
-	if n > 0 {
-		c.cl.counters.Add(fmt.Sprintf("%s sent", msg.Kind.String()), 1)
-	}
-	if err != nil {
+	if err := c.w.WriteMsg(msg); err != nil {
 		return err
 	}
-	if c.bwriter.Buffered() > limit {
+	c.cl.counters.Add(fmt.Sprintf("%s sent", msg.Kind.String()), 1)
+	if msg.Kind == peer_wire.Piece {
+		//piece msgs are written immediately
+		c.resetKeepAlive()
+		return nil
+	}
+	if c.w.Buffered() > limit {
 		return c.flushWriter()
 	}
 	return nil
 }
 
 func (c *conn) flushWriter() error {
-	if c.bwriter.Buffered() <= 0 {
+	if c.w.Buffered() <= 0 {
 		return nil
 	}
+	c.resetKeepAlive()
+	return c.w.Flush()
+}
+
+func (c *conn) resetKeepAlive() {
 	if !c.keepAliveTimer.Stop() {
 		select {
 		case <-c.keepAliveTimer.C:
@@ -403,7 +584,6 @@ func (c *conn) flushWriter() error {
 		}
 	}
 	c.keepAliveTimer.Reset(keepAliveInterval)
-	return c.bwriter.Flush()
 }
 
 func (c *conn) onPeerMsg(msg *peer_wire.Msg) (err error) {
@@ -421,6 +601,8 @@ func (c *conn) onPeerMsg(msg *peer_wire.Msg) (err error) {
 	case peer_wire.NotInterested:
 		err = changeState(&c.state.isInterested, false)
 	case peer_wire.Choke:
+		//the peer discarded all of our requests
+		c.timedOutReqs = make(map[block]time.Time)
 		err = c.discardBlocks(true, false)
 		if err != nil {
 			return err
@@ -467,7 +649,7 @@ func (c *conn) onPeerMsg(msg *peer_wire.Msg) (err error) {
 		}
 		err = c.sendMsgToTorrent(c.peerBf.Copy())
 	case peer_wire.Extended:
-		c.onExtended(msg)
+		err = c.onExtended(msg)
 	case peer_wire.Port:
 		pingAddr, err := net.ResolveUDPAddr("udp", c.cn.RemoteAddr().String())
 		if err != nil {
@@ -555,14 +737,43 @@ type metainfoSize int64
 func (c *conn) onExtended(msg *peer_wire.Msg) (err error) {
 	switch v := msg.ExtendedMsg.(type) {
 	case peer_wire.ExtHandshakeDict:
-		c.exts, err = v.Extensions()
+		if c.exts, err = v.Extensions(); err != nil {
+			c.cl.counters.Add("invalid ext handshakes", 1)
+			return err
+		}
+		if ip, ok := v.YourIP(); ok {
+			c.cl.externalIPs.vote(c.peer.P.IP.String(), ip)
+		}
+		if reqq, ok := v.Reqq(); ok {
+			c.peerReqq = reqq
+		}
+		if client, ok := v.ClientVersion(); ok {
+			c.client = client
+			if c.cl.clientBlacklisted(client) {
+				c.cl.counters.Add("blacklisted clients", 1)
+				return fmt.Errorf("client %q is blacklisted", client)
+			}
+		}
+		if uploadOnly, ok := v.UploadOnly(); ok {
+			c.peerUploadOnly = uploadOnly
+			if c.notUseful() {
+				return io.EOF
+			}
+		}
 		if _, ok := c.exts[peer_wire.ExtMetadataName]; ok {
 			if msize, ok := v.MetadataSize(); ok {
 				if err = c.sendMsgToTorrent(metainfoSize(msize)); err != nil {
-					//error
+					return
 				}
 			}
 		}
+		return c.sendMsgToTorrent(v)
+	case peer_wire.PexMsg:
+		return c.onPexMsg(v)
+	case peer_wire.DontHaveMsg:
+		return c.onDontHave(int(v))
+	case peer_wire.HolepunchMsg:
+		return c.onHolepunch(v)
 	case peer_wire.MetadataExtMsg:
 		switch v.Kind {
 		case peer_wire.MetadataDataID:
@@ -587,6 +798,67 @@ func (c *conn) onExtended(msg *peer_wire.Msg) (err error) {
 	return nil
 }
 
+//the peer lost a piece (BEP 54)
+func (c *conn) onDontHave(i int) error {
+	if _, ok := c.exts[peer_wire.ExtDontHaveName]; !ok {
+		return errors.New("peer send donthave msg without having negotiated it")
+	}
+	if c.haveInfo && !c.t.pieces.isValid(i) {
+		return errors.New("peer send donthave for piece that doesn't exist")
+	}
+	if !c.peerBf.Get(i) {
+		return nil
+	}
+	c.peerBf.Set(i, false)
+	if c.haveInfo {
+		c.t.pieces.onDontHave(i)
+		if err := c.discardPieceRequests(i); err != nil {
+			return err
+		}
+	}
+	return c.sendMsgToTorrent(peer_wire.DontHaveMsg(i))
+}
+
+func (c *conn) onPexMsg(msg peer_wire.PexMsg) error {
+	if _, ok := c.exts[peer_wire.ExtPexName]; !ok {
+		return errors.New("peer send PEX msg without having negotiated it")
+	}
+	if !c.lastPexRecv.IsZero() && time.Since(c.lastPexRecv) < pexMinRecvInterval {
+		c.cl.counters.Add("pexFlood", 1)
+		return nil
+	}
+	c.lastPexRecv = time.Now()
+	added, err := msg.AddedPeers()
+	if err != nil {
+		c.logger.Printf("bad PEX msg: %s\n", err)
+		return nil
+	}
+	if len(added) > peer_wire.MaxPexPeers {
+		added = added[:peer_wire.MaxPexPeers]
+	}
+	var peers pexPeers
+	for _, p := range added {
+		if p.Port == 0 {
+			continue
+		}
+		peer := Peer{
+			P: tracker.Peer{
+				IP:   p.IP,
+				Port: p.Port,
+			},
+			Source: SourcePEX,
+		}
+		peers.peers = append(peers.peers, peer)
+		if p.Flags&peer_wire.PexSupportsHolepunch != 0 {
+			peers.holepunch = append(peers.holepunch, peer)
+		}
+	}
+	if len(peers.peers) == 0 {
+		return nil
+	}
+	return c.sendMsgToTorrent(peers)
+}
+
 func (c *conn) discardBlocks(notifyTorrent, sendCancels bool) error {
 	if len(c.onFlightReqs) > 0 {
 		unsatisfiedRequests := []block{}
@@ -597,7 +869,7 @@ func (c *conn) discardBlocks(notifyTorrent, sendCancels bool) error {
 			unsatisfiedRequests = append(unsatisfiedRequests, req)
 		}
 		c.t.pieces.discardRequests(unsatisfiedRequests)
-		c.onFlightReqs = make(map[block]struct{})
+		c.onFlightReqs = make(map[block]time.Time)
 		var err error
 		if notifyTorrent {
 			err = c.sendMsgToTorrent(discardedRequests{})
@@ -607,6 +879,27 @@ func (c *conn) discardBlocks(notifyTorrent, sendCancels bool) error {
 	return nil
 }
 
+//discards the on flight requests for blocks of piece i
+func (c *conn) discardPieceRequests(i int) error {
+	discarded := []block{}
+	for req := range c.onFlightReqs {
+		if req.pc == i {
+			discarded = append(discarded, req)
+			delete(c.onFlightReqs, req)
+		}
+	}
+	for req := range c.timedOutReqs {
+		if req.pc == i {
+			delete(c.timedOutReqs, req)
+		}
+	}
+	if len(discarded) == 0 {
+		return nil
+	}
+	c.t.pieces.discardRequests(discarded)
+	return c.sendMsgToTorrent(discardedRequests{})
+}
+
 //TODO:Store bad peer so we wont accept them again if they try to reconnect
 func (c *conn) upload() error {
 	c.muPeerReqs.Lock()
@@ -627,29 +920,34 @@ func (c *conn) upload() error {
 			c.ban = true
 			return fmt.Errorf("request length out of range: %d", req.len)
 		}
-		//check that we have the requested piece
-		//dont ban we may have dropped a piece
+		//check that we have the requested piece.
+		//dont drop, we may have lost the piece after the peer requested it
 		if !c.myBf.Get(req.pc) {
-			return fmt.Errorf("peer requested piece we do not have")
+			c.cl.counters.Add("requestsOfPiecesWeDontHave", 1)
+			continue
 		}
 		//ensure the we dont exceed the end of the piece
 		if endOff := req.off + req.len; endOff > c.t.pieceLen(uint32(req.pc)) {
 			c.ban = true
 			return fmt.Errorf("peer request exceeded length of piece: %d", endOff)
 		}
-		data := make([]byte, req.len)
 		err := func() error {
 			c.muPeerReqs.Unlock()
 			defer c.muPeerReqs.Lock()
+			data := peer_wire.GetBlock(req.len)
+			//the block is written to the peer before sendMsgToPeer returns
+			defer peer_wire.PutBlock(data)
 			if err := c.t.readBlock(data, req.pc, req.off); err != nil {
-				return nil
+				//maybe the data were deleted, Torrent will check if we lost the piece
+				return c.sendMsgToTorrent(pieceReadFailed(req.pc))
 			}
-			c.sendMsgToPeer(&peer_wire.Msg{
+			c.pieceMsg = peer_wire.Msg{
 				Kind:  peer_wire.Piece,
 				Index: uint32(req.pc),
 				Begin: uint32(req.off),
 				Block: data,
-			})
+			}
+			c.sendMsgToPeer(&c.pieceMsg)
 			return c.sendMsgToTorrent(uploadedBlock(req))
 		}()
 		if err != nil {
@@ -667,10 +965,25 @@ func (c *conn) requestCanceldOrFullfiled(b block) bool {
 }
 
 func (c *conn) onPieceMsg(msg *peer_wire.Msg) error {
-	//var ready block
-	var ok bool
+	//the block was taken from the pool by the reader
+	defer peer_wire.PutBlock(msg.Block)
 	bl := reqMsgToBlock(msg.Request())
-	if _, ok = c.onFlightReqs[bl]; !ok {
+	sent, ok := c.onFlightReqs[bl]
+	sentLate, late := c.timedOutReqs[bl]
+	switch {
+	case ok:
+		delete(c.onFlightReqs, bl)
+		c.reqTimer.sample(time.Since(sent))
+		c.pipeline.onBlock(bl.len, time.Since(sent))
+		c.maybeSendRequests()
+	case late:
+		//still useful if nobody else sent it yet
+		c.cl.counters.Add("lateBlocksRecv", 1)
+		delete(c.timedOutReqs, bl)
+		c.reqTimer.sample(time.Since(sentLate))
+		c.pipeline.bytes += bl.len
+		c.maybeSendRequests()
+	default:
 		//remote peer send us a block that doesn't exists in onFlight requests.
 		//we may have requested it previously and discard it, but remote peer didn't,
 		//maybe because of network inconsistencies (latency).
@@ -708,10 +1021,6 @@ func (c *conn) onPieceMsg(msg *peer_wire.Msg) error {
 			return nil
 		}
 	}
-	if ok {
-		delete(c.onFlightReqs, bl)
-		c.maybeSendRequests()
-	}
 	if err := c.t.writeBlock(msg.Block, bl.pc, bl.off); err != nil {
 		if errors.Is(err, storage.ErrAlreadyWritten) {
 			//propably another conn got the same block
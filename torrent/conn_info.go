@@ -12,9 +12,11 @@ import (
 //some informations like state,bitmap which also conn holds too -
 //we dont share, we communicate so we have some duplicate data-.
 type connInfo struct {
-	t        *Torrent
-	peer     Peer
-	reserved peer_wire.Reserved
+	t         *Torrent
+	peer      Peer
+	reserved  peer_wire.Reserved
+	encrypted bool
+	utp       bool
 	//we communicate with conn with these channels - conn also has them
 	sendC    chan interface{}
 	recvC    chan interface{}
@@ -24,6 +26,35 @@ type connInfo struct {
 	numWant int           //how many pieces are we interested to download from peer
 	state   connState     //also conn has this
 	stats   connStats
+	//the extensions that the peer supports (received at the extension handshake)
+	exts peer_wire.Extensions
+	//true if we have sent the first PEX msg to this conn
+	pexInit bool
+	//the sequence number of the first PEX event this conn doesn't know about
+	pexSeq      int
+	lastPexSent time.Time
+	//the peer doesn't want any pieces (BEP 21)
+	peerUploadOnly bool
+	peerID         []byte
+	//the client software of the peer as decoded from its peer ID or as
+	//advertised at the extension handshake
+	client string
+	//the port an incoming peer listens to, as advertised at the extension handshake
+	listenPort uint16
+}
+
+//listenAddr returns the address the peer accepts connections at. ok is false
+//if the peer connected to us and didn't advertise its listen port.
+func (cn *connInfo) listenAddr() (p Peer, ok bool) {
+	if cn.peer.Source != SourceIncoming {
+		return cn.peer, true
+	}
+	if cn.listenPort == 0 {
+		return
+	}
+	p = cn.peer
+	p.P.Port = cn.listenPort
+	return p, true
 }
 
 func (cn *connInfo) sendMsgToConn(msg interface{}) {
@@ -61,7 +92,7 @@ func (cn *connInfo) interested() {
 	if cn.numWant <= 0 {
 		return
 	}
-	if !cn.state.amInterested && cn.t.downloadEnabled {
+	if !cn.state.amInterested && cn.t.downloadEnabled && !cn.t.isUploadOnly {
 		cn.sendMsgToConn(&peer_wire.Msg{
 			Kind: peer_wire.Interested,
 		})
@@ -93,6 +124,40 @@ func (cn *connInfo) sendBitfield() {
 	cn.sendMsgToConn(cn.t.pieces.ownedPieces.Copy())
 }
 
+func (cn *connInfo) sendExtHandshake() {
+	cl := cn.t.cl
+	ipv4, ipv6 := cl.ExternalIPs()
+	if cl.ipv6 != nil {
+		ipv6 = cl.ipv6
+	}
+	var port int
+	if !cl.config.RejectIncomingConnections {
+		port = cl.port
+	}
+	cn.sendMsgToConn(extensionHandshakeMsg(extHandshake{
+		metaSize:   cn.t.infoSize,
+		yourIP:     cn.peer.P.IP,
+		ipv4:       ipv4,
+		ipv6:       ipv6,
+		reqq:       cn.t.reqq,
+		port:       port,
+		uploadOnly: cn.t.isUploadOnly,
+	}, cl.peerID))
+}
+
+func (cn *connInfo) supportsExtended() bool {
+	return cn.reserved.SupportExtended() && cn.t.cl.reserved.SupportExtended()
+}
+
+//tells conn whether we want pieces and lets the peer know by resending
+//the extension handshake
+func (cn *connInfo) sendUploadOnly(v bool) {
+	cn.sendMsgToConn(uploadOnly(v))
+	if cn.supportsExtended() {
+		cn.sendExtHandshake()
+	}
+}
+
 func (cn *connInfo) sendPort() {
 	cn.sendMsgToConn(&peer_wire.Msg{
 		Kind: peer_wire.Port,
@@ -154,6 +219,36 @@ func (cn *connInfo) reviewInterestsOnHave(i int) {
 	}
 }
 
+//manages if we are interested in peer after it lost a piece
+func (cn *connInfo) reviewInterestsOnDontHave(i int) {
+	cn.peerBf.Set(i, false)
+	if !cn.t.haveInfo() || cn.t.haveAll() {
+		return
+	}
+	if !cn.t.pieces.ownedPieces.Get(i) && cn.numWant > 0 {
+		cn.numWant--
+		if cn.numWant <= 0 {
+			cn.notInterested()
+		}
+	}
+}
+
+//counts from scratch the pieces we want from peer
+func (cn *connInfo) reviewInterests() {
+	cn.numWant = 0
+	cn.peerBf.IterTyped(func(i int) bool {
+		if !cn.t.pieces.ownedPieces.Get(i) {
+			cn.numWant++
+		}
+		return true
+	})
+	if cn.numWant > 0 {
+		cn.interested()
+	} else {
+		cn.notInterested()
+	}
+}
+
 func (cn *connInfo) durationDownloading() time.Duration {
 	if cn.state.canDownload() {
 		return cn.stats.sumDownloading + time.Since(cn.stats.lastStartedDownloading)
@@ -212,6 +307,11 @@ func (cn *connInfo) peerSeeding() bool {
 	return cn.peerBf.Len() == cn.t.numPieces()
 }
 
+//true if the peer is a seed or a partial seed
+func (cn *connInfo) peerWantsNothing() bool {
+	return cn.peerUploadOnly || cn.peerSeeding()
+}
+
 func (cn *connInfo) rate() float64 {
 	safeDiv := func(bytes, dur float64) float64 {
 		if dur == 0 {
@@ -225,13 +325,25 @@ func (cn *connInfo) rate() float64 {
 	return safeDiv(float64(cn.stats.downloadUsefulBytes), float64(cn.durationDownloading()))
 }
 
+//clientName returns the client software of the peer if we know it
+func (cn *connInfo) clientName() string {
+	if cn.client == "" {
+		return "unknown"
+	}
+	return cn.client
+}
+
 func (cn *connInfo) String() string {
-	return fmt.Sprintf(`peer seeding: %t
+	return fmt.Sprintf(`client: %s
+	peer seeding: %t
+	peer upload only: %t
 	client interested in %d pieces which peer offers
 	downloading for %s
 	uploading for %s
 	`,
+		cn.clientName(),
 		cn.peerSeeding(),
+		cn.peerUploadOnly,
 		cn.numWant, cn.durationDownloading().String(),
 		cn.durationUploading().String()) + cn.state.String() + cn.stats.String()
 }
@@ -23,7 +23,9 @@ type connStats struct {
 	//duration we are in downloading state
 	sumDownloading time.Duration
 	//duration we are in uploading state
-	sumUploading            time.Duration
+	sumUploading time.Duration
+	//the peer didn't send us blocks for a long time or our requests timed
+	//out. It is reset when the peer sends a block.
 	snubbed                 bool
 	badPiecesContributions  int
 	goodPiecesContributions int
@@ -41,6 +43,7 @@ func (cs *connStats) onBlockDownload(len int) {
 	cs.downloadUsefulBytes += len
 	cs.blocksDownloaded++
 	cs.lastReceivedPieceMsg = time.Now()
+	cs.snubbed = false
 }
 
 func (cs *connStats) onBlockUpload(len int) {
@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/anacrolix/missinggo/bitmap"
 	"github.com/lkslts64/charo-torrent/metainfo"
 	"github.com/lkslts64/charo-torrent/peer_wire"
@@ -77,6 +79,121 @@ func TestConnState(t *testing.T) {
 	assert.Equal(t, peer_wire.Unchoke, msg.Kind)
 }
 
+//a seed should drop a partial seed since none wants anything from the other
+func TestConnPeerUploadOnly(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	cn := newConn(tr, r, Peer{})
+	cn.recvC <- haveInfo{}
+	go cn.mainLoop()
+	bm := bitmap.Bitmap{RB: roaring.NewBitmap()}
+	bm.AddRange(0, tr.numPieces())
+	cn.recvC <- bm
+	w.Write((&peer_wire.Msg{
+		Kind:       peer_wire.Extended,
+		ExtendedID: peer_wire.ExtHandshakeID,
+		ExtendedMsg: peer_wire.ExtHandshakeDict{
+			"m":           map[string]interface{}{},
+			"upload_only": 1,
+		},
+	}).Encode())
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-cn.sendC:
+			if _, ok := e.(connDroped); ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("conn wasn't dropped")
+		}
+	}
+}
+
+//a malformed extension handshake drops the conn
+func TestConnInvalidExtHandshake(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	cn := newConn(tr, r, Peer{})
+	go cn.mainLoop()
+	w.Write((&peer_wire.Msg{
+		Kind:       peer_wire.Extended,
+		ExtendedID: peer_wire.ExtHandshakeID,
+		ExtendedMsg: peer_wire.ExtHandshakeDict{
+			"m": map[string]interface{}{string(peer_wire.ExtPexName): "one"},
+		},
+	}).Encode())
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-cn.sendC:
+			if _, ok := e.(connDroped); ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("conn wasn't dropped")
+		}
+	}
+}
+
+func TestConnDontHave(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	tr.blockRequestSize = tr.blockSize()
+	tr.pieces = newPieces(tr)
+	cn := newConn(tr, r, Peer{})
+	cn.recvC <- haveInfo{}
+	go cn.mainLoop()
+	cn.recvC <- bitmap.Bitmap{RB: roaring.NewBitmap()}
+	var b []byte
+	for _, m := range []*peer_wire.Msg{
+		{
+			Kind:       peer_wire.Extended,
+			ExtendedID: peer_wire.ExtHandshakeID,
+			ExtendedMsg: peer_wire.ExtHandshakeDict{
+				"m": map[string]interface{}{string(peer_wire.ExtDontHaveName): int64(peer_wire.ExtDontHaveID)},
+			},
+		},
+		{Kind: peer_wire.Have, Index: 2},
+		{
+			Kind:        peer_wire.Extended,
+			ExtendedID:  peer_wire.ExtDontHaveID,
+			ExtendedMsg: peer_wire.DontHaveMsg(2),
+		},
+	} {
+		b = append(b, m.Encode()...)
+	}
+	w.Write(b)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-cn.sendC:
+			switch v := e.(type) {
+			case peer_wire.DontHaveMsg:
+				assert.EqualValues(t, 2, v)
+				return
+			case connDroped:
+				t.Fatal("conn was dropped")
+			}
+		case <-timeout:
+			t.Fatal("didn't receive donthave")
+		}
+	}
+}
+
 type dummyStorage struct{}
 
 func (ds dummyStorage) ReadBlock(b []byte, off int64) (n int, err error) {
@@ -134,19 +251,21 @@ func TestPeerRequestAndCancel(t *testing.T) {
 		}
 	}()
 	for i := 0; i < numPieces-1; i++ {
-		w.Write((&peer_wire.Msg{
+		b := (&peer_wire.Msg{
 			Kind:  peer_wire.Request,
 			Index: uint32(i),
 			Len:   1 << 14,
-		}).Encode())
-		//send cancel for the piece we dont have
+		}).Encode()
+		//send cancel for the piece we dont have. Write it along with the
+		//request so conn reads both at once.
 		if i == numPieces-2 {
-			w.Write((&peer_wire.Msg{
+			b = append(b, (&peer_wire.Msg{
 				Kind:  peer_wire.Cancel,
 				Index: uint32(i),
 				Len:   1 << 14,
-			}).Encode())
+			}).Encode()...)
 		}
+		w.Write(b)
 	}
 	<-ch
 	assert.Nil(t, tr.cl.counters.Get("latecomerCancels"))
@@ -167,6 +286,7 @@ func BenchmarkPeerPieceMsg(b *testing.B) {
 	msgBytes := msg.Encode()
 	require.NoError(b, err)
 	b.SetBytes(int64(len(msg.Block)))
+	b.ReportAllocs()
 	var n int
 	//send unexpected blocks to conn
 	for i := 0; i < b.N; i++ {
@@ -177,6 +297,37 @@ func BenchmarkPeerPieceMsg(b *testing.B) {
 	}
 }
 
+func BenchmarkConnUpload(b *testing.B) {
+	w, r := net.Pipe()
+	cn, tr, err := loadTorrentFile(b, w, r, "testdata/blockchain.torrent")
+	require.NoError(b, err)
+	tr.storage = dummyStorage{}
+	//read the Unchoke msg
+	unchokeC := make(chan error)
+	go func() {
+		_, err := io.ReadFull(w, make([]byte, 5))
+		unchokeC <- err
+	}()
+	allowUpload(cn, w)
+	require.NoError(b, <-unchokeC)
+	cn.myBf.Set(0, true)
+	req := (&peer_wire.Msg{
+		Kind: peer_wire.Request,
+		Len:  1 << 14,
+	}).Encode()
+	piece := make([]byte, 4+9+1<<14)
+	b.SetBytes(1 << 14)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = w.Write(req)
+		require.NoError(b, err)
+		_, err = io.ReadFull(w, piece)
+		require.NoError(b, err)
+		<-cn.sendC
+	}
+}
+
 func readForever(r io.Reader) {
 	b := make([]byte, 1000)
 	for {
@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"net"
+
 	"github.com/lkslts64/charo-torrent/peer_wire"
 )
 
@@ -8,22 +10,69 @@ import (
 //hardcoded.Change this?
 
 var extensions = peer_wire.Extensions{
-	peer_wire.ExtMetadataName: peer_wire.ExtMetadataID,
+	peer_wire.ExtMetadataName:  peer_wire.ExtMetadataID,
+	peer_wire.ExtPexName:       peer_wire.ExtPexID,
+	peer_wire.ExtDontHaveName:  peer_wire.ExtDontHaveID,
+	peer_wire.ExtHolepunchName: peer_wire.ExtHolepunchID,
+}
+
+//extHandshake holds what we advertise at the extension handshake
+type extHandshake struct {
+	metaSize int64
+	//the IP of the remote peer
+	yourIP net.IP
+	//our external addresses, nil if unknown
+	ipv4, ipv6 net.IP
+	reqq       int
+	//the port we listen to, zero if we don't accept connections
+	port       int
+	uploadOnly bool
 }
 
 //prepare client's handshake msg for send
-func extensionHandshakeMsg(metaSz int64) *peer_wire.Msg {
+func extensionHandshakeMsg(eh extHandshake, peerID [20]byte) *peer_wire.Msg {
+	var uploadOnly int64
+	if eh.uploadOnly {
+		uploadOnly = 1
+	}
+	var v string
+	if client, ok := peer_wire.ParsePeerID(peerID); ok {
+		v = client.String()
+	}
 	return &peer_wire.Msg{
 		Kind:       peer_wire.Extended,
 		ExtendedID: 0,
 		ExtendedMsg: struct {
 			ExtMap peer_wire.Extensions `bencode:"m"`
 			MetaSz int64                `bencode:"metadata_size" empty:"omit"`
+			YourIP []byte               `bencode:"yourip" empty:"omit"`
+			IPv4   []byte               `bencode:"ipv4" empty:"omit"`
+			IPv6   []byte               `bencode:"ipv6" empty:"omit"`
+			Reqq   int64                `bencode:"reqq" empty:"omit"`
+			Port   int64                `bencode:"p" empty:"omit"`
+			V      string               `bencode:"v" empty:"omit"`
+			//always sent because the handshake is resent when it changes
+			UploadOnly int64 `bencode:"upload_only"`
 		}{
-			ExtMap: extensions,
-			MetaSz: metaSz,
+			ExtMap:     extensions,
+			MetaSz:     eh.metaSize,
+			YourIP:     compactIP(eh.yourIP),
+			IPv4:       eh.ipv4.To4(),
+			IPv6:       compactIP(eh.ipv6),
+			Reqq:       int64(eh.reqq),
+			Port:       int64(eh.port),
+			V:          v,
+			UploadOnly: uploadOnly,
 		},
 	}
 }
 
+//4 bytes for IPv4 and 16 for IPv6 addresses
+func compactIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 //func extensionMetadataMsg(){ }
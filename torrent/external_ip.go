@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+)
+
+//we forget all votes but the consensus when there are that many voters, so
+//we adapt if our IP changes
+const maxIPVoters = 500
+
+//externalIPVotes reaches a consensus about our external IP address. Peers
+//(yourip key of the extension handshake) and trackers vote and each voter
+//counts once. IPv4 and IPv6 addresses are counted separately.
+type externalIPVotes struct {
+	mu sync.Mutex
+	//voter -> the IP it voted for
+	votes map[string]string
+}
+
+func (ev *externalIPVotes) vote(voter string, ip net.IP) {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.votes == nil {
+		ev.votes = make(map[string]string)
+	}
+	if _, ok := ev.votes[voter]; !ok && len(ev.votes) >= maxIPVoters {
+		ipv4, ipv6 := ev.consensus()
+		//keep the consensus as a single vote
+		ev.votes = make(map[string]string)
+		if ipv4 != nil {
+			ev.votes["consensus ipv4"] = ipv4.String()
+		}
+		if ipv6 != nil {
+			ev.votes["consensus ipv6"] = ipv6.String()
+		}
+	}
+	ev.votes[voter] = ip.String()
+}
+
+//consensus returns the IPv4 and IPv6 addresses with the most votes. They
+//are nil if there are no votes. Callers should hold the lock.
+func (ev *externalIPVotes) consensus() (ipv4, ipv6 net.IP) {
+	counts := make(map[string]int)
+	for _, ip := range ev.votes {
+		counts[ip]++
+	}
+	var max4, max6 int
+	for s, n := range counts {
+		ip := net.ParseIP(s)
+		if ip.To4() != nil {
+			if n > max4 || n == max4 && s < ipv4.String() {
+				ipv4, max4 = ip.To4(), n
+			}
+		} else if n > max6 || n == max6 && s < ipv6.String() {
+			ipv6, max6 = ip, n
+		}
+	}
+	return
+}
+
+//ExternalIPs returns our external IPv4 and IPv6 addresses as reported by
+//peers and trackers. Any of them may be nil if it is unknown.
+func (cl *Client) ExternalIPs() (ipv4, ipv6 net.IP) {
+	cl.externalIPs.mu.Lock()
+	defer cl.externalIPs.mu.Unlock()
+	return cl.externalIPs.consensus()
+}
@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/missinggo/bitmap"
+	"github.com/lkslts64/charo-torrent/metainfo"
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalIPVotes(t *testing.T) {
+	var ev externalIPVotes
+	ipv4, ipv6 := ev.consensus()
+	assert.Nil(t, ipv4)
+	assert.Nil(t, ipv6)
+	ev.vote("a", net.ParseIP("1.2.3.4"))
+	ev.vote("b", net.ParseIP("1.2.3.4"))
+	ev.vote("c", net.ParseIP("5.6.7.8"))
+	ev.vote("d", net.ParseIP("2001:db8::1"))
+	//ignored
+	ev.vote("e", net.ParseIP("127.0.0.1"))
+	ev.vote("f", net.IPv4zero)
+	ev.vote("g", nil)
+	ipv4, ipv6 = ev.consensus()
+	assert.EqualValues(t, net.ParseIP("1.2.3.4").To4(), ipv4)
+	assert.EqualValues(t, net.ParseIP("2001:db8::1"), ipv6)
+	//each voter counts once
+	ev.vote("c", net.ParseIP("5.6.7.8"))
+	ev.vote("a", net.ParseIP("5.6.7.8"))
+	ipv4, _ = ev.consensus()
+	assert.EqualValues(t, net.ParseIP("5.6.7.8").To4(), ipv4)
+	//votes are forgotten but the consensus survives
+	for i := 0; i < maxIPVoters; i++ {
+		ev.vote(strconv.Itoa(i), net.ParseIP("9.9.9.9"))
+	}
+	assert.True(t, len(ev.votes) < maxIPVoters)
+	ipv4, ipv6 = ev.consensus()
+	assert.EqualValues(t, net.ParseIP("9.9.9.9").To4(), ipv4)
+	assert.EqualValues(t, net.ParseIP("2001:db8::1"), ipv6)
+}
+
+func TestExtHandshakeMsg(t *testing.T) {
+	var peerID [20]byte
+	copy(peerID[:], "-CH0001-")
+	msg := extensionHandshakeMsg(extHandshake{
+		metaSize: 100,
+		yourIP:   net.ParseIP("1.2.3.4"),
+		ipv4:     net.ParseIP("5.6.7.8"),
+		reqq:     250,
+		port:     6881,
+	}, peerID)
+	decoded, err := peer_wire.Decode(bytes.NewReader(msg.Encode()))
+	require.NoError(t, err)
+	d := decoded.ExtendedMsg.(peer_wire.ExtHandshakeDict)
+	ip, ok := d.YourIP()
+	require.True(t, ok)
+	assert.True(t, ip.Equal(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, "\x05\x06\x07\x08", d["ipv4"])
+	_, ok = d.IPv6()
+	assert.False(t, ok)
+	reqq, ok := d.Reqq()
+	require.True(t, ok)
+	assert.Equal(t, 250, reqq)
+	port, ok := d.ListenPort()
+	require.True(t, ok)
+	assert.EqualValues(t, 6881, port)
+	v, ok := d.ClientVersion()
+	require.True(t, ok)
+	assert.Equal(t, "charo 0.0.0.1", v)
+}
+
+func TestConnVotesExternalIP(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	cn := newConn(tr, r, addrToPeer("10.0.0.1:6881", SourceDHT))
+	cn.recvC <- haveInfo{}
+	go cn.mainLoop()
+	cn.recvC <- bitmap.Bitmap{}
+	w.Write((&peer_wire.Msg{
+		Kind:       peer_wire.Extended,
+		ExtendedID: peer_wire.ExtHandshakeID,
+		ExtendedMsg: peer_wire.ExtHandshakeDict{
+			"m":      map[string]interface{}{},
+			"yourip": string(net.ParseIP("80.1.2.3").To4()),
+		},
+	}).Encode())
+	timeout := time.After(5 * time.Second)
+	for {
+		if ipv4, _ := cl.ExternalIPs(); ipv4 != nil {
+			assert.True(t, ipv4.Equal(net.ParseIP("80.1.2.3")))
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatal("conn didn't vote")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
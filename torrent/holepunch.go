@@ -0,0 +1,178 @@
+package torrent
+
+import (
+	"errors"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+func (cn *connInfo) supportsHolepunch() bool {
+	_, ok := cn.exts[peer_wire.ExtHolepunchName]
+	return ok
+}
+
+func (cn *connInfo) sendHolepunch(msg peer_wire.HolepunchMsg) {
+	cn.sendMsgToConn(&peer_wire.Msg{
+		Kind:        peer_wire.Extended,
+		ExtendedID:  cn.exts[peer_wire.ExtHolepunchName],
+		ExtendedMsg: msg,
+	})
+}
+
+func (c *conn) onHolepunch(msg peer_wire.HolepunchMsg) error {
+	if _, ok := c.exts[peer_wire.ExtHolepunchName]; !ok {
+		return errors.New("peer send holepunch msg without having negotiated it")
+	}
+	return c.sendMsgToTorrent(msg)
+}
+
+func (t *Torrent) onHolepunchMsg(ci *connInfo, msg peer_wire.HolepunchMsg) {
+	switch msg.Type {
+	case peer_wire.HolepunchRendezvous:
+		t.relayHolepunch(ci, msg)
+	case peer_wire.HolepunchConnect:
+		t.holepunchConnect(Peer{
+			P: tracker.Peer{
+				IP:   msg.IP,
+				Port: msg.Port,
+			},
+			Source: SourceHolepunch,
+		})
+	case peer_wire.HolepunchError:
+		t.cl.counters.Add("holepunchErrors", 1)
+		t.logger.Printf("holepunch to %s failed: %s\n", (&tracker.Peer{IP: msg.IP, Port: msg.Port}).String(), msg.ErrCode)
+	}
+}
+
+//we act as the relay. Inform both the initiator and the target about each
+//other so they connect simultaneously.
+func (t *Torrent) relayHolepunch(initiator *connInfo, msg peer_wire.HolepunchMsg) {
+	sendErr := func(code peer_wire.HolepunchErrCode) {
+		msg.Type, msg.ErrCode = peer_wire.HolepunchError, code
+		initiator.sendHolepunch(msg)
+	}
+	targetAddr := (&tracker.Peer{IP: msg.IP, Port: msg.Port}).String()
+	if msg.Port == 0 || msg.IP.IsUnspecified() {
+		sendErr(peer_wire.HolepunchNoSuchPeer)
+		return
+	}
+	if initiator.hasAddr(targetAddr) {
+		sendErr(peer_wire.HolepunchNoSelf)
+		return
+	}
+	target := t.connByAddr(targetAddr)
+	if target == nil {
+		sendErr(peer_wire.HolepunchNotConnected)
+		return
+	}
+	if !target.supportsHolepunch() {
+		sendErr(peer_wire.HolepunchNoSupport)
+		return
+	}
+	t.cl.counters.Add("holepunchRelayed", 1)
+	targetListen, initiatorListen := target.holepunchAddr(), initiator.holepunchAddr()
+	initiator.sendHolepunch(peer_wire.HolepunchMsg{
+		Type: peer_wire.HolepunchConnect,
+		IP:   targetListen.IP,
+		Port: targetListen.Port,
+	})
+	target.sendHolepunch(peer_wire.HolepunchMsg{
+		Type: peer_wire.HolepunchConnect,
+		IP:   initiatorListen.IP,
+		Port: initiatorListen.Port,
+	})
+}
+
+//holepunchAddr is the address we tell others to connect to cn at. It is the
+//address cn listens to if we know it, the one it connected from otherwise.
+func (cn *connInfo) holepunchAddr() tracker.Peer {
+	if p, ok := cn.listenAddr(); ok {
+		return p.P
+	}
+	return cn.peer.P
+}
+
+//hasAddr reports whether cn connected from addr or listens to it
+func (cn *connInfo) hasAddr(addr string) bool {
+	if cn.peer.P.String() == addr {
+		return true
+	}
+	p, ok := cn.listenAddr()
+	return ok && p.P.String() == addr
+}
+
+//a relay told us to connect to peer. The peer connects to us at the same
+//time so the NATs on both sides let the connection through.
+func (t *Torrent) holepunchConnect(peer Peer) {
+	if !t.wantConns() || t.peerInActiveConns(peer) {
+		return
+	}
+	addr := peer.P.String()
+	t.halfOpenmu.Lock()
+	defer t.halfOpenmu.Unlock()
+	if _, ok := t.halfOpen[addr]; ok {
+		return
+	}
+	t.cl.counters.Add("holepunchConnects", 1)
+	t.halfOpen[addr] = peer
+	go t.cl.makeOutgoingConnection(t, peer)
+}
+
+//we act as the initiator. We couldn't connect to peer, so we ask the conn that
+//informed us about it to relay a connection.
+func (t *Torrent) holepunch(peer Peer) {
+	addr := peer.P.String()
+	relay, ok := t.holepunchRelays[addr]
+	if !ok {
+		return
+	}
+	delete(t.holepunchRelays, addr)
+	if _, ok := t.connIndex(relay); !ok || !relay.supportsHolepunch() || t.peerInActiveConns(peer) {
+		return
+	}
+	t.cl.counters.Add("holepunchRendezvous", 1)
+	relay.sendHolepunch(peer_wire.HolepunchMsg{
+		Type: peer_wire.HolepunchRendezvous,
+		IP:   peer.P.IP,
+		Port: peer.P.Port,
+	})
+}
+
+//remember that relay can introduce us to the peers it sent via PEX and
+//support hole punching
+func (t *Torrent) addHolepunchRelay(relay *connInfo, peers []Peer) {
+	if !relay.supportsHolepunch() {
+		return
+	}
+	for _, p := range peers {
+		t.holepunchRelays[p.P.String()] = relay
+	}
+}
+
+func (t *Torrent) removeHolepunchRelay(relay *connInfo) {
+	for addr, ci := range t.holepunchRelays {
+		if ci == relay {
+			delete(t.holepunchRelays, addr)
+		}
+	}
+}
+
+func (t *Torrent) connByAddr(addr string) *connInfo {
+	for _, ci := range t.conns {
+		if ci.hasAddr(addr) {
+			return ci
+		}
+	}
+	return nil
+}
+
+//holepunchPeer is called by the dialer goroutine when it fails to connect to peer
+func (t *Torrent) holepunchPeer(peer Peer) {
+	l := t.newLocker()
+	if l.lock(); l.closed {
+		return
+	}
+	defer l.unlock()
+	t.holepunch(peer)
+}
@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"expvar"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//waits until f (invoked with tr locked) returns true
+func waitTorrent(t *testing.T, tr *Torrent, f func() bool) {
+	for i := 0; i < 200; i++ {
+		l := tr.newLocker()
+		l.lock()
+		ok := f()
+		l.unlock()
+		if ok {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+//A and B are both connected to the relay. B doesn't accept incoming connections
+//(i.e it is behind a NAT), so A asks the relay to introduce it to B.
+func TestHolepunch(t *testing.T) {
+	newClient := func(dir string, rejectIncoming bool) (*Client, *Torrent) {
+		cfg := testingConfig()
+		cfg.BaseDir += "/holepunch" + dir
+		cfg.RejectIncomingConnections = rejectIncoming
+		cl, tr := newClientWithTorrent(t, cfg, blockchainTorrentFile, nil)
+		require.NoError(t, tr.StartDataTransfer())
+		return cl, tr
+	}
+	relay, relayTr := newClient("relay", false)
+	defer os.RemoveAll(relay.config.BaseDir)
+	defer relay.Close()
+	a, aTr := newClient("A", false)
+	defer os.RemoveAll(a.config.BaseDir)
+	defer a.Close()
+	b, bTr := newClient("B", true)
+	defer os.RemoveAll(b.config.BaseDir)
+	defer b.Close()
+	require.NoError(t, aTr.AddPeers(addrToPeer(relay.addr(), SourceUser)))
+	require.NoError(t, bTr.AddPeers(addrToPeer(relay.addr(), SourceUser)))
+	waitTorrent(t, relayTr, func() bool {
+		if len(relayTr.conns) != 2 {
+			return false
+		}
+		for _, ci := range relayTr.conns {
+			if !ci.supportsHolepunch() {
+				return false
+			}
+		}
+		return true
+	})
+	//the address of B as the relay sees it
+	var bPeer Peer
+	waitTorrent(t, relayTr, func() bool {
+		for _, ci := range relayTr.conns {
+			if int(ci.peer.P.Port) != a.ListenPort() {
+				bPeer = ci.peer
+			}
+		}
+		return true
+	})
+	bPeer.Source = SourcePEX
+	//pretend that the relay informed A about B via PEX
+	waitTorrent(t, aTr, func() bool {
+		if len(aTr.conns) != 1 || !aTr.conns[0].supportsHolepunch() {
+			return false
+		}
+		aTr.gotPexPeers(aTr.conns[0], pexPeers{
+			peers:     []Peer{bPeer},
+			holepunch: []Peer{bPeer},
+		})
+		return true
+	})
+	//B connects to A after the relay tells it to
+	var source PeerSource
+	waitTorrent(t, aTr, func() bool {
+		if len(aTr.conns) != 2 {
+			return false
+		}
+		source = aTr.conns[1].peer.Source
+		return true
+	})
+	assert.Equal(t, SourceIncoming, source)
+	assert.Equal(t, "1", a.counters.Get("holepunchRendezvous").String())
+	assert.Equal(t, "1", relay.counters.Get("holepunchRelayed").String())
+}
+
+//peers that connected to the relay are found by the address they listen to
+func TestRelayHolepunchListenAddr(t *testing.T) {
+	tr := &Torrent{cl: &Client{counters: new(expvar.Map).Init()}}
+	newIncoming := func(ip byte, port, listenPort uint16) *connInfo {
+		return &connInfo{
+			t: tr,
+			peer: Peer{
+				P:      tracker.Peer{IP: net.IPv4(10, 0, 0, ip).To4(), Port: port},
+				Source: SourceIncoming,
+			},
+			sendC:      make(chan interface{}, 1),
+			exts:       peer_wire.Extensions{peer_wire.ExtHolepunchName: 1},
+			listenPort: listenPort,
+		}
+	}
+	initiator := newIncoming(1, 50001, 6881)
+	target := newIncoming(2, 50002, 6882)
+	tr.conns = []*connInfo{initiator, target}
+	recv := func(ci *connInfo) peer_wire.HolepunchMsg {
+		return (<-ci.sendC).(*peer_wire.Msg).ExtendedMsg.(peer_wire.HolepunchMsg)
+	}
+	tr.relayHolepunch(initiator, peer_wire.HolepunchMsg{
+		Type: peer_wire.HolepunchRendezvous,
+		IP:   target.peer.P.IP,
+		Port: 6882,
+	})
+	msg := recv(initiator)
+	assert.Equal(t, peer_wire.HolepunchConnect, msg.Type)
+	assert.True(t, target.peer.P.IP.Equal(msg.IP))
+	assert.EqualValues(t, 6882, msg.Port)
+	msg = recv(target)
+	assert.Equal(t, peer_wire.HolepunchConnect, msg.Type)
+	assert.True(t, initiator.peer.P.IP.Equal(msg.IP))
+	assert.EqualValues(t, 6881, msg.Port)
+	//the initiator's own listen address
+	tr.relayHolepunch(initiator, peer_wire.HolepunchMsg{
+		Type: peer_wire.HolepunchRendezvous,
+		IP:   initiator.peer.P.IP,
+		Port: 6881,
+	})
+	msg = recv(initiator)
+	assert.Equal(t, peer_wire.HolepunchError, msg.Type)
+	assert.Equal(t, peer_wire.HolepunchNoSelf, msg.ErrCode)
+}
@@ -27,6 +27,21 @@ func getOutboundIP() net.IP {
 	return localAddr.IP
 }
 
+//getOutboundIPv6 returns the IPv6 address that we would use to reach
+//other peers or nil if we don't have a global IPv6 address.
+func getOutboundIPv6() net.IP {
+	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:80") //never write to this conn
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if !ip.IsGlobalUnicast() || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
 func flipCoin() bool {
 	return rand.Intn(2) == 0
 }
@@ -49,8 +64,11 @@ func parseAddr(address string) (*addrPort, error) {
 	if ip == nil {
 		return nil, err
 	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 	return &addrPort{
-		ip:   ip.To4(),
+		ip:   ip,
 		port: uint16(port),
 	}, nil
 }
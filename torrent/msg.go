@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"time"
+
 	"github.com/lkslts64/charo-torrent/tracker"
 )
 
@@ -14,19 +16,32 @@ type drop struct{}
 // try to request some blocks
 type requestsAvailable struct{}
 
+//Torrent sends this when we stop or start wanting pieces (BEP 21)
+type uploadOnly bool
+
+//Torrent sends this to conns when we lost a piece
+type pieceLost int
+
 //obsolete?
 type downloadPieces struct{}
 
 type trackerAnnouncerEvent struct {
 	//which Torrent submited the event
-	t     *Torrent
-	event tracker.Event
-	stats Stats
+	t        *Torrent
+	infoHash [20]byte
+	event    tracker.Event
+	stats    Stats
+	//where the response is sent, unless the Torrent is closed
+	respC  chan trackerAnnouncerResponse
+	closed chan struct{}
 }
 
 type trackerAnnouncerResponse struct {
+	url  string
 	resp *tracker.AnnounceResp
 	err  error
+	//when we should announce again
+	next time.Duration
 }
 
 //conn sends this struct to Torrent as the first message to bootstrap
@@ -62,6 +77,20 @@ type uploadedBlock block
 //conn sends this to signal that a conn was dropped
 type connDroped struct{}
 
+//conn sends this when it couldn't read a piece we own from the storage
+type pieceReadFailed int
+
+//conn sends this when it receives peers via PEX
+type pexPeers struct {
+	peers []Peer
+	//the ones that support hole punching (BEP 55)
+	holepunch []Peer
+}
+
 //when a conn discards requests,it sends this message to notify other conns that
 //some blocks are available for requesting.
 type discardedRequests struct{}
+
+//conn sends this when requests timed out and were made available to other
+//conns. The value is how many.
+type requestsTimedOut int
@@ -1,32 +1,80 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io"
 	"net"
 	"strconv"
+	"time"
 
+	"github.com/anacrolix/dht/v2"
+	"github.com/lkslts64/charo-torrent/mse"
 	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/utp"
 )
 
+var errClientClosed = errors.New("client closed")
+
+//enough for the SYN to be retransmitted once
+const utpDialTimeout = 2 * time.Second
+
 type dialer struct {
 	cl   *Client
 	t    *Torrent
 	peer Peer
+	//true if we managed to establish a TCP connection with the peer
+	connected bool
 }
 
 func (d *dialer) dial() (*conn, error) {
-	var err error
 	defer d.t.removeHalfOpen(d.peer.P.String())
-	tcpConn, err := net.DialTimeout("tcp", d.peer.P.String(), d.cl.config.DialTimeout)
+	var c *conn
+	var err error
+	//try uTP first and fallback to TCP
+	if d.cl.utpSocket != nil {
+		if c, err = d.dialNetwork("utp"); err == nil {
+			return c, nil
+		}
+		d.cl.counters.Add("utp fallbacks", 1)
+	}
+	return d.dialNetwork("tcp")
+}
+
+func (d *dialer) dialNetwork(network string) (*conn, error) {
+	d.connected = false
+	policy := d.cl.config.EncryptionPolicy
+	c, err := d.dialAndHandshake(network, policy != EncryptionDisable)
+	if err != nil && d.connected && policy == EncryptionPrefer {
+		//maybe the peer doesn't support encryption, retry with plaintext
+		d.cl.counters.Add("encryption fallbacks", 1)
+		c, err = d.dialAndHandshake(network, false)
+	}
+	return c, err
+}
+
+func (d *dialer) dialAndHandshake(network string, encrypt bool) (*conn, error) {
+	var err error
+	tcpConn, err := d.cl.dialTimeout(network, d.peer.P.String())
 	if err != nil {
 		return nil, err
 	}
+	d.connected = true
 	defer func() {
 		if err != nil {
 			tcpConn.Close()
 		}
 	}()
-	_, err = d.cl.handshake(tcpConn, &peer_wire.HandShake{
+	nc := tcpConn
+	var method mse.CryptoMethod
+	if encrypt {
+		if nc, method, err = d.cl.initiateEncryption(tcpConn, d.t.mi.Info.Hash); err != nil {
+			return nil, err
+		}
+	}
+	nc = d.cl.recordConn(nc, d.peer)
+	hs, err := d.cl.handshake(nc, &peer_wire.HandShake{
 		Reserved: d.cl.reserved,
 		PeerID:   d.cl.peerID,
 		InfoHash: d.t.mi.Info.Hash,
@@ -34,7 +82,57 @@ func (d *dialer) dial() (*conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newConn(d.t, tcpConn, d.peer), nil
+	startRecording(nc, d.t.mi.Info.Hash)
+	c := newConnFromHandshake(d.t, nc, d.peer, hs)
+	c.encrypted = method == mse.CryptoRC4
+	c.utp = network == "utp"
+	return c, nil
+}
+
+func (cl *Client) dialTimeout(network, addr string) (net.Conn, error) {
+	if network == "utp" {
+		//we fall back to TCP if the peer doesn't answer, don't wait for long
+		timeout := utpDialTimeout
+		if cl.config.DialTimeout > 0 && cl.config.DialTimeout < timeout {
+			timeout = cl.config.DialTimeout
+		}
+		return cl.utpSocket.DialTimeout(addr, timeout)
+	}
+	if cl.proxy != nil {
+		ctx, cancel := cl.dialContext()
+		defer cancel()
+		return cl.proxy.DialContext(ctx, network, addr)
+	}
+	return net.DialTimeout(network, addr, cl.config.DialTimeout)
+}
+
+//dialContext bounds dials with Config.DialTimeout
+func (cl *Client) dialContext() (context.Context, context.CancelFunc) {
+	if cl.config.DialTimeout > 0 {
+		return context.WithTimeout(context.Background(), cl.config.DialTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+//newDHTServer creates a DHT server whose packets go through the proxy if we
+//use one
+func (cl *Client) newDHTServer() (*dht.Server, error) {
+	if cl.proxy == nil {
+		return dht.NewServer(nil)
+	}
+	ctx, cancel := cl.dialContext()
+	defer cancel()
+	pc, err := cl.proxy.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dht.NewServer(&dht.ServerConfig{
+		Conn:          pc,
+		NoSecurity:    true,
+		StartingNodes: dht.GlobalBootstrapAddrs,
+		//only the peers we query can reach us
+		Passive: cl.config.ProxyOnly,
+	})
 }
 
 type listener interface {
@@ -43,38 +141,85 @@ type listener interface {
 	Addr() net.Addr
 }
 
+//btListener accepts TCP and uTP connections at the same port.
 type btListener struct {
 	l  net.Listener
 	cl *Client
+	//raw connections from both TCP and uTP
+	acceptC chan acceptResult
+}
+
+type acceptResult struct {
+	nc  net.Conn
+	err error
 }
 
 func listen(cl *Client) (*btListener, error) {
 	l := &btListener{
-		cl: cl,
+		cl:      cl,
+		acceptC: make(chan acceptResult),
 	}
 	var err error
 	//try ports 6881-6889 first
 	for i := 6881; i < 6890; i++ {
-		//we dont support IPv6
-		l.l, err = net.Listen("tcp4", ":"+strconv.Itoa(int(i)))
-		if err == nil {
-			l.cl.port = i
+		if err = l.listenPort(i); err == nil {
 			return l, nil
 		}
 	}
 	//if none of the above ports were avaialable, try other ones.
-	if l.l, err = net.Listen("tcp4", ":"); err != nil {
-		return nil, errors.New("could not find port to listen")
+	for i := 0; i < 10; i++ {
+		if err = l.listenPort(0); err == nil {
+			return l, nil
+		}
 	}
-	ap, err := parseAddr(l.l.Addr().String())
+	return nil, errors.New("could not find port to listen")
+}
+
+//listenPort listens for TCP and uTP (unless disabled) connections at port.
+//If port is zero, a random port is picked.
+func (btl *btListener) listenPort(port int) error {
+	//dual-stack
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	ap, err := parseAddr(l.Addr().String())
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if !btl.cl.config.DisableUTP {
+		//uTP shares the port with TCP
+		if btl.cl.utpSocket, err = utp.NewSocket("udp", ":"+strconv.Itoa(int(ap.port))); err != nil {
+			l.Close()
+			return err
+		}
+		go btl.acceptFrom(btl.cl.utpSocket)
+	}
+	btl.l = l
+	btl.cl.port = int(ap.port)
+	go btl.acceptFrom(l)
+	return nil
+}
+
+func (btl *btListener) acceptFrom(l net.Listener) {
+	for {
+		nc, err := l.Accept()
+		select {
+		case btl.acceptC <- acceptResult{nc, err}:
+		case <-btl.cl.close:
+			if nc != nil {
+				nc.Close()
+			}
+			return
+		}
 	}
-	l.cl.port = int(ap.port)
-	return l, nil
 }
 
 func (btl *btListener) Close() error {
+	if btl.cl.utpSocket != nil {
+		btl.cl.utpSocket.Close()
+	}
 	return btl.l.Close()
 }
 
@@ -84,26 +229,127 @@ func (btl *btListener) Addr() net.Addr {
 
 func (btl *btListener) Accept() (*conn, error) {
 	var err error
-	tcpConn, err := btl.l.Accept()
-	if err != nil {
-		return nil, err
+	var res acceptResult
+	select {
+	case res = <-btl.acceptC:
+	case <-btl.cl.close:
+		return nil, errClientClosed
+	}
+	if res.err != nil {
+		return nil, res.err
 	}
+	tcpConn := res.nc
 	defer func() {
 		if err != nil {
 			tcpConn.Close()
 		}
 	}()
 	peer := addrToPeer(tcpConn.RemoteAddr().String(), SourceIncoming)
-	hs, err := btl.cl.handshake(tcpConn, &peer_wire.HandShake{
+	tcpConn.SetDeadline(time.Now().Add(btl.cl.config.HandshakeTiemout))
+	nc, method, err := btl.cl.receiveEncryption(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	nc = btl.cl.recordConn(nc, peer)
+	hs, err := btl.cl.handshake(nc, &peer_wire.HandShake{
 		Reserved: btl.cl.reserved,
 		PeerID:   btl.cl.peerID,
 	}, peer)
 	if err != nil {
 		return nil, err
 	}
-	t, ok := btl.cl.torrents[hs.InfoHash]
+	t, ok := btl.cl.torrent(hs.InfoHash)
 	if !ok {
-		return nil, errors.New("peer handshake contain infohash that client doesn't manage")
+		err = errors.New("peer handshake contain infohash that client doesn't manage")
+		return nil, err
+	}
+	startRecording(nc, hs.InfoHash)
+	c := newConnFromHandshake(t, nc, peer, hs)
+	c.encrypted = method == mse.CryptoRC4
+	_, c.utp = tcpConn.(*utp.Conn)
+	return c, nil
+}
+
+//the first bytes of a plaintext BitTorrent handshake
+var plaintextHandshakePrefix = append([]byte{byte(len(peer_wire.Proto))}, peer_wire.Proto...)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+//streamConn is a net.Conn whose reads and writes go through another stream
+//(e.g an encrypted one).
+type streamConn struct {
+	net.Conn
+	rw io.ReadWriter
+}
+
+func (sc *streamConn) Read(b []byte) (int, error) {
+	return sc.rw.Read(b)
+}
+
+func (sc *streamConn) Write(b []byte) (int, error) {
+	return sc.rw.Write(b)
+}
+
+//the crypto methods we provide when we initiate an encrypted connection
+func (cl *Client) cryptoProvide() mse.CryptoMethod {
+	if cl.config.EncryptionPolicy == EncryptionRequire {
+		return mse.CryptoRC4
+	}
+	return mse.CryptoRC4 | mse.CryptoPlaintext
+}
+
+//pick one of the crypto methods the initiator of an encrypted connection provided
+func (cl *Client) chooseCrypto(provided mse.CryptoMethod) mse.CryptoMethod {
+	if provided&mse.CryptoRC4 != 0 {
+		return mse.CryptoRC4
+	}
+	if cl.config.EncryptionPolicy == EncryptionRequire {
+		return 0
+	}
+	return provided & mse.CryptoPlaintext
+}
+
+func (cl *Client) initiateEncryption(nc net.Conn, infoHash [20]byte) (net.Conn, mse.CryptoMethod, error) {
+	nc.SetDeadline(time.Now().Add(cl.config.HandshakeTiemout))
+	defer nc.SetDeadline(time.Time{})
+	rw, method, err := mse.Initiate(nc, infoHash[:], cl.cryptoProvide())
+	if err != nil {
+		return nil, 0, err
+	}
+	cl.counters.Add("encrypted connections initiated", 1)
+	return &streamConn{nc, rw}, method, nil
+}
+
+//receiveEncryption detects whether the remote peer initiated a plaintext or an
+//encrypted handshake. In the latter case, the skey is looked up at the torrents
+//that the client manages.
+func (cl *Client) receiveEncryption(nc net.Conn) (net.Conn, mse.CryptoMethod, error) {
+	prefix := make([]byte, len(plaintextHandshakePrefix))
+	if _, err := io.ReadFull(nc, prefix); err != nil {
+		return nil, 0, err
+	}
+	rw := &readWriter{io.MultiReader(bytes.NewReader(prefix), nc), nc}
+	if bytes.Equal(prefix, plaintextHandshakePrefix) {
+		if cl.config.EncryptionPolicy == EncryptionRequire {
+			return nil, 0, errors.New("rejected plaintext connection")
+		}
+		return &streamConn{nc, rw}, mse.CryptoPlaintext, nil
+	}
+	if cl.config.EncryptionPolicy == EncryptionDisable {
+		return nil, 0, errors.New("rejected encrypted connection")
+	}
+	skeys := [][]byte{}
+	for _, ihash := range cl.infoHashes() {
+		ihash := ihash
+		skeys = append(skeys, ihash[:])
+	}
+	ers, _, method, err := mse.Receive(rw, skeys, cl.chooseCrypto)
+	if err != nil {
+		return nil, 0, err
 	}
-	return newConn(t, tcpConn, peer), nil
+	cl.counters.Add("encrypted connections received", 1)
+	return &streamConn{nc, ers}, method, nil
 }
@@ -14,6 +14,10 @@ const (
 	SourceDHT
 	//The peer was given to us by a tracker
 	SourceTracker
+	//The peer was given to us by another peer via Peer Exchange
+	SourcePEX
+	//A relay peer told us to connect to this peer (NAT hole punching)
+	SourceHolepunch
 )
 
 //Holds basic information about a peer
@@ -21,3 +25,15 @@ type Peer struct {
 	P      tracker.Peer
 	Source PeerSource
 }
+
+//PeerConn describes an established connection with a peer
+type PeerConn struct {
+	Peer Peer
+	//the peer ID the peer sent at the handshake
+	ID [20]byte
+	//the client software of the peer as decoded from its peer ID or as
+	//advertised at the extension handshake. Empty if unknown.
+	Client    string
+	Encrypted bool
+	UTP       bool
+}
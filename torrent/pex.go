@@ -0,0 +1,230 @@
+package torrent
+
+import (
+	"time"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+//BEP 11 says that we shouldn't send PEX messages more often than once a minute.
+const pexInterval = time.Minute
+
+//if a peer sends PEX messages more often than this, we ignore them.
+//We are a little bit forbearing because peers may not have the same clock granularity.
+const pexMinRecvInterval = pexInterval / 2
+
+type pexEventKind byte
+
+const (
+	pexAdd pexEventKind = iota
+	pexDrop
+)
+
+type pexEvent struct {
+	kind pexEventKind
+	peer peer_wire.PexPeer
+}
+
+//pexState keeps a log of the connections that were established or dropped.
+//Every connInfo remembers until which event it has informed its peer, so each
+//PEX message contains only the delta since the previous one.
+type pexState struct {
+	events []pexEvent
+	//sequence number of events[0]
+	base int
+}
+
+//the sequence number of the next event to be added
+func (ps *pexState) seq() int {
+	return ps.base + len(ps.events)
+}
+
+func (ps *pexState) add(kind pexEventKind, peer peer_wire.PexPeer) {
+	ps.events = append(ps.events, pexEvent{kind, peer})
+}
+
+//delta returns the net added and dropped peers that happened after event with
+//sequence number `from`. Peers with address `skip` are not included (we don't want
+//to tell a peer about itself). At most peer_wire.MaxPexPeers added and dropped peers
+//are returned. next is the sequence number of the first event that wasn't consumed.
+func (ps *pexState) delta(from int, skip string) (added, dropped []peer_wire.PexPeer, next int) {
+	if from < ps.base {
+		from = ps.base
+	}
+	addedM := make(map[string]peer_wire.PexPeer)
+	droppedM := make(map[string]peer_wire.PexPeer)
+	next = from
+	for _, ev := range ps.events[from-ps.base:] {
+		if len(addedM) >= peer_wire.MaxPexPeers || len(droppedM) >= peer_wire.MaxPexPeers {
+			break
+		}
+		next++
+		addr := pexPeerAddr(ev.peer)
+		if addr == skip {
+			continue
+		}
+		switch ev.kind {
+		case pexAdd:
+			delete(droppedM, addr)
+			addedM[addr] = ev.peer
+		case pexDrop:
+			//the peer didn't learn about this one, no need to tell it was dropped
+			if _, ok := addedM[addr]; ok {
+				delete(addedM, addr)
+				continue
+			}
+			droppedM[addr] = ev.peer
+		}
+	}
+	for _, p := range addedM {
+		added = append(added, p)
+	}
+	for _, p := range droppedM {
+		dropped = append(dropped, p)
+	}
+	return
+}
+
+//trim discards all events with sequence number less than `seq`
+func (ps *pexState) trim(seq int) {
+	if seq <= ps.base {
+		return
+	}
+	if seq > ps.seq() {
+		seq = ps.seq()
+	}
+	ps.events = append([]pexEvent{}, ps.events[seq-ps.base:]...)
+	ps.base = seq
+}
+
+func pexPeerAddr(p peer_wire.PexPeer) string {
+	tp := tracker.Peer{IP: p.IP, Port: p.Port}
+	return tp.String()
+}
+
+//pexPeer returns the PEX representation of the peer. ok is false if we
+//don't know the address the peer listens to.
+func (cn *connInfo) pexPeer() (p peer_wire.PexPeer, ok bool) {
+	addr, ok := cn.listenAddr()
+	if !ok {
+		return
+	}
+	p = peer_wire.PexPeer{
+		IP:   addr.P.IP,
+		Port: addr.P.Port,
+	}
+	if cn.peer.Source != SourceIncoming {
+		p.Flags |= peer_wire.PexOutgoing
+	}
+	if cn.peerWantsNothing() {
+		p.Flags |= peer_wire.PexSeed
+	}
+	if cn.encrypted {
+		p.Flags |= peer_wire.PexPrefersEncryption
+	}
+	if cn.utp {
+		p.Flags |= peer_wire.PexSupportsUTP
+	}
+	if cn.supportsHolepunch() {
+		p.Flags |= peer_wire.PexSupportsHolepunch
+	}
+	return p, true
+}
+
+func (cn *connInfo) supportsPex() bool {
+	_, ok := cn.exts[peer_wire.ExtPexName]
+	return ok
+}
+
+//sends a PEX message to conn if enough time has passed since the last one
+//and there is something to send.
+func (cn *connInfo) sendPex() {
+	if !cn.supportsPex() || time.Since(cn.lastPexSent) < pexInterval {
+		return
+	}
+	var added, dropped []peer_wire.PexPeer
+	skip := cn.peer.P.String()
+	if !cn.pexInit {
+		//this is the first msg, send (some of) the peers we are connected to.
+		for _, ci := range cn.t.conns {
+			if len(added) >= peer_wire.MaxPexPeers {
+				break
+			}
+			if p, ok := ci.pexPeer(); ok && ci != cn && pexPeerAddr(p) != skip {
+				added = append(added, p)
+			}
+		}
+		cn.pexSeq = cn.t.pex.seq()
+		cn.pexInit = true
+	} else {
+		added, dropped, cn.pexSeq = cn.t.pex.delta(cn.pexSeq, skip)
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+	cn.lastPexSent = time.Now()
+	cn.sendMsgToConn(&peer_wire.Msg{
+		Kind:        peer_wire.Extended,
+		ExtendedID:  cn.exts[peer_wire.ExtPexName],
+		ExtendedMsg: peer_wire.NewPexMsg(added, dropped),
+	})
+}
+
+func (t *Torrent) pexConnAdded(ci *connInfo) {
+	if p, ok := ci.pexPeer(); ok {
+		t.pex.add(pexAdd, p)
+	}
+}
+
+func (t *Torrent) pexConnDropped(ci *connInfo) {
+	if p, ok := ci.pexPeer(); ok {
+		t.pex.add(pexDrop, p)
+	}
+}
+
+//sendPexMsgs sends PEX messages to all conns that support the extension and
+//discards the events that all conns have been informed about.
+func (t *Torrent) sendPexMsgs() {
+	minSeq := t.pex.seq()
+	for _, ci := range t.conns {
+		ci.sendPex()
+		if ci.pexInit && ci.pexSeq < minSeq {
+			minSeq = ci.pexSeq
+		}
+	}
+	t.pex.trim(minSeq)
+}
+
+//we received peers through PEX from relay.
+func (t *Torrent) gotPexPeers(relay *connInfo, peers pexPeers) {
+	t.addHolepunchRelay(relay, peers.holepunch)
+	unknown := []Peer{}
+	for _, p := range peers.peers {
+		if !t.knownPeer(p) {
+			unknown = append(unknown, p)
+		}
+	}
+	t.cl.counters.Add("pexPeersReceived", int64(len(unknown)))
+	t.gotPeers(unknown)
+}
+
+//true if we are connected/connecting to the peer or we already have it in t.peers.
+func (t *Torrent) knownPeer(peer Peer) bool {
+	if t.peerInActiveConns(peer) {
+		return true
+	}
+	addr := peer.P.String()
+	t.halfOpenmu.Lock()
+	_, ok := t.halfOpen[addr]
+	t.halfOpenmu.Unlock()
+	if ok {
+		return true
+	}
+	for _, p := range t.peers {
+		if p.P.String() == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pexTestPeer(i int) peer_wire.PexPeer {
+	return peer_wire.PexPeer{
+		IP:   net.IPv4(10, 0, 0, byte(i)).To4(),
+		Port: 6881,
+	}
+}
+
+func TestPexStateDelta(t *testing.T) {
+	var ps pexState
+	for i := 0; i < 5; i++ {
+		ps.add(pexAdd, pexTestPeer(i))
+	}
+	//peer 1 was added and dropped, the remote peer shouldn't learn about it at all
+	ps.add(pexDrop, pexTestPeer(1))
+	added, dropped, next := ps.delta(0, pexPeerAddr(pexTestPeer(0)))
+	assert.Len(t, added, 3)
+	assert.Len(t, dropped, 0)
+	assert.Equal(t, ps.seq(), next)
+	ps.add(pexDrop, pexTestPeer(2))
+	added, dropped, next = ps.delta(next, "")
+	assert.Len(t, added, 0)
+	assert.Equal(t, []peer_wire.PexPeer{pexTestPeer(2)}, dropped)
+	ps.trim(next)
+	assert.Len(t, ps.events, 0)
+	assert.Equal(t, next, ps.base)
+}
+
+func TestPexStateDeltaLimit(t *testing.T) {
+	var ps pexState
+	for i := 0; i < peer_wire.MaxPexPeers+10; i++ {
+		ps.add(pexAdd, peer_wire.PexPeer{
+			IP:   net.ParseIP("10.0.1." + strconv.Itoa(i)).To4(),
+			Port: 1,
+		})
+	}
+	added, _, next := ps.delta(0, "")
+	assert.Len(t, added, peer_wire.MaxPexPeers)
+	added, _, next = ps.delta(next, "")
+	assert.Len(t, added, 10)
+	assert.Equal(t, ps.seq(), next)
+}
+
+func TestPexPeerIncoming(t *testing.T) {
+	ci := &connInfo{
+		peer: Peer{
+			P:      tracker.Peer{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 50000},
+			Source: SourceIncoming,
+		},
+		peerUploadOnly: true,
+	}
+	_, ok := ci.pexPeer()
+	assert.False(t, ok)
+	ci.listenPort = 6881
+	p, ok := ci.pexPeer()
+	require.True(t, ok)
+	assert.Equal(t, pexPeerAddr(pexTestPeer(1)), pexPeerAddr(p))
+	assert.Equal(t, peer_wire.PexSeed, p.Flags)
+	ci.peer.Source = SourceTracker
+	p, ok = ci.pexPeer()
+	require.True(t, ok)
+	assert.EqualValues(t, 50000, p.Port)
+	assert.NotZero(t, p.Flags&peer_wire.PexOutgoing)
+}
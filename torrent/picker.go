@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/anacrolix/missinggo/bitmap"
+)
+
+//picker indexes the pieces that have unrequested blocks so we don't have to
+//filter and sort all of them every time a conn wants to request blocks.
+//Pieces that have some of their blocks requested or downloaded are kept in
+//`partial` and pieces that have all of their blocks unrequested (fresh) are
+//kept in availability buckets, one for every rarity. It is updated on every
+//event that changes the state or the rarity of a piece and it is guarded by
+//pieces.mu.
+type picker struct {
+	pcs     []*Piece
+	partial *roaring.Bitmap
+	//buckets[r] holds the fresh pieces with rarity r
+	buckets []*roaring.Bitmap
+	//the bucket of every fresh piece, -1 if the piece isn't fresh
+	bucket []int
+}
+
+func newPicker(pcs []*Piece) *picker {
+	pk := &picker{
+		pcs:    pcs,
+		bucket: make([]int, len(pcs)),
+	}
+	pk.rebuild()
+	return pk
+}
+
+//rebuild indexes all pieces from scratch
+func (pk *picker) rebuild() {
+	pk.partial = roaring.NewBitmap()
+	pk.buckets = nil
+	for i := range pk.bucket {
+		pk.bucket[i] = -1
+	}
+	for _, p := range pk.pcs {
+		pk.update(p)
+	}
+}
+
+//update reindexes p after its state or rarity changed
+func (pk *picker) update(p *Piece) {
+	i := p.index
+	unrequested := p.UnrequestedBlocks()
+	fresh := !p.verified && unrequested > 0 && unrequested == p.blocks
+	if b := pk.bucket[i]; b >= 0 && (!fresh || b != rarityBucket(p)) {
+		pk.buckets[b].Remove(uint32(i))
+		pk.bucket[i] = -1
+	}
+	if fresh && pk.bucket[i] < 0 {
+		b := rarityBucket(p)
+		for len(pk.buckets) <= b {
+			pk.buckets = append(pk.buckets, roaring.NewBitmap())
+		}
+		pk.buckets[b].Add(uint32(i))
+		pk.bucket[i] = b
+	}
+	if !fresh && unrequested > 0 {
+		pk.partial.Add(uint32(i))
+	} else {
+		pk.partial.Remove(uint32(i))
+	}
+}
+
+//true if no piece has unrequested blocks
+func (pk *picker) empty() bool {
+	if !pk.partial.IsEmpty() {
+		return false
+	}
+	for _, b := range pk.buckets {
+		if !b.IsEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+func rarityBucket(p *Piece) int {
+	if p.rarity < 0 {
+		return 0
+	}
+	return p.rarity
+}
+
+//pick calls f for the pieces that have unrequested blocks and the peer owns,
+//in the order the selector prioritizes them, until f returns false. f may
+//change the state of the pieces.
+func (pk *picker) pick(peerPieces bitmap.Bitmap, selector PieceSelector, f func(*Piece) bool) {
+	if peerPieces.RB == nil {
+		return
+	}
+	dfs, ok := selector.(*DefaultPieceSelector)
+	if !ok {
+		pk.pickByLess(peerPieces.RB, selector, f)
+		return
+	}
+	//partial pieces always come first and they are few
+	partial := pk.piecesOf(roaring.And(pk.partial, peerPieces.RB))
+	sort.Slice(partial, func(i, j int) bool {
+		return selector.Less(partial[i], partial[j])
+	})
+	for _, p := range partial {
+		if !f(p) {
+			return
+		}
+	}
+	if dfs.byRarity {
+		for _, b := range pk.buckets {
+			if b.IsEmpty() {
+				continue
+			}
+			it := roaring.And(b, peerPieces.RB).Iterator()
+			for it.HasNext() {
+				if !f(pk.pcs[it.Next()]) {
+					return
+				}
+			}
+		}
+		return
+	}
+	fresh := roaring.FastOr(pk.buckets...)
+	fresh.And(peerPieces.RB)
+	for !fresh.IsEmpty() {
+		i, _ := fresh.Select(uint32(rand.Int63n(int64(fresh.GetCardinality()))))
+		fresh.Remove(i)
+		if !f(pk.pcs[i]) {
+			return
+		}
+	}
+}
+
+//pickByLess is used for selectors we don't know how they order the pieces. We
+//only pay for the pieces we pick instead of sorting all candidates.
+func (pk *picker) pickByLess(peerPieces *roaring.Bitmap, selector PieceSelector, f func(*Piece) bool) {
+	candidates := roaring.FastOr(append([]*roaring.Bitmap{pk.partial}, pk.buckets...)...)
+	candidates.And(peerPieces)
+	h := &pieceHeap{
+		pcs:      pk.piecesOf(candidates),
+		selector: selector,
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		if !f(heap.Pop(h).(*Piece)) {
+			return
+		}
+	}
+}
+
+func (pk *picker) piecesOf(bm *roaring.Bitmap) []*Piece {
+	ret := make([]*Piece, 0, bm.GetCardinality())
+	it := bm.Iterator()
+	for it.HasNext() {
+		ret = append(ret, pk.pcs[it.Next()])
+	}
+	return ret
+}
+
+type pieceHeap struct {
+	pcs      []*Piece
+	selector PieceSelector
+}
+
+func (h *pieceHeap) Len() int           { return len(h.pcs) }
+func (h *pieceHeap) Less(i, j int) bool { return h.selector.Less(h.pcs[i], h.pcs[j]) }
+func (h *pieceHeap) Swap(i, j int)      { h.pcs[i], h.pcs[j] = h.pcs[j], h.pcs[i] }
+
+func (h *pieceHeap) Push(x interface{}) {
+	h.pcs = append(h.pcs, x.(*Piece))
+}
+
+func (h *pieceHeap) Pop() interface{} {
+	last := h.pcs[len(h.pcs)-1]
+	h.pcs = h.pcs[:len(h.pcs)-1]
+	return last
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/anacrolix/missinggo/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//a selector the picker doesn't know, it has to use Less
+type lessSelector struct {
+	*DefaultPieceSelector
+}
+
+func newPickerTestPieces(t testing.TB, numPieces int, selector PieceSelector) *pieces {
+	tr := newTestTorrent(numPieces, 4*(1<<14), 2*(1<<14), 1<<14)
+	cfg := testingConfig()
+	cfg.SelectorF = func() PieceSelector { return selector }
+	var err error
+	tr.cl, err = NewClient(cfg)
+	require.NoError(t, err)
+	p := newPieces(tr)
+	p.setDownloadEnabled(true)
+	return p
+}
+
+func TestPickerOrder(t *testing.T) {
+	for _, selector := range []PieceSelector{
+		NewDefaultPieceSelector(),
+		lessSelector{NewDefaultPieceSelector().(*DefaultPieceSelector)},
+	} {
+		selector.OnPieceDownload(-1)
+		p := newPickerTestPieces(t, 1000, selector)
+		var peerPieces bitmap.Bitmap
+		for i := 0; i < 1000; i++ {
+			if rand.Intn(4) > 0 {
+				peerPieces.Add(i)
+			}
+			for j := rand.Intn(10); j > 0; j-- {
+				p.onHave(i)
+			}
+		}
+		//make some pieces partial and some fully requested
+		reqs := make([]block, 300)
+		p.fillRequests(peerPieces, reqs, nil)
+		p.discardRequests(reqs[:rand.Intn(len(reqs))])
+		var picked []*Piece
+		p.picker.pick(peerPieces, selector, func(piece *Piece) bool {
+			picked = append(picked, piece)
+			return true
+		})
+		var expect int
+		for _, piece := range p.pcs {
+			if piece.hasUnrequestedBlocks() && peerPieces.Get(piece.index) {
+				expect++
+			}
+		}
+		require.Equal(t, expect, len(picked))
+		for i := 1; i < len(picked); i++ {
+			assert.False(t, selector.Less(picked[i], picked[i-1]), "%d before %d", picked[i-1].index, picked[i].index)
+		}
+	}
+}
+
+func TestPickerUpdate(t *testing.T) {
+	p := newPickerTestPieces(t, 10, NewDefaultPieceSelector())
+	p.selector.OnPieceDownload(-1)
+	var all bitmap.Bitmap
+	all.AddRange(0, 10)
+	p.onBitfield(all)
+	p.onHave(3)
+	p.onDontHave(5)
+	reqs := make([]block, 1)
+	require.Equal(t, 1, p.fillRequests(all, reqs, nil))
+	//the rarest one
+	assert.Equal(t, 5, reqs[0].pc)
+	//partial pieces come first
+	require.Equal(t, 1, p.fillRequests(all, reqs, nil))
+	assert.Equal(t, 5, reqs[0].pc)
+	//fully requested pieces aren't picked
+	reqs = make([]block, 10*4)
+	assert.Equal(t, 9*4+2-2, p.fillRequests(all, reqs, nil))
+	assert.True(t, p.allRequested())
+	p.discardRequests([]block{{pc: 3, off: 0, len: 1 << 14}})
+	assert.False(t, p.allRequested())
+	reqs = make([]block, 10)
+	require.Equal(t, 1, p.fillRequests(all, reqs, nil))
+	assert.Equal(t, 3, reqs[0].pc)
+	//the piece was lost, it can be requested again
+	p.pieceLost(7)
+	require.Equal(t, 4, p.fillRequests(all, reqs, nil))
+	assert.Equal(t, 7, reqs[0].pc)
+}
+
+func benchmarkFillRequests(b *testing.B, selector PieceSelector) {
+	const numPieces = 100000
+	p := newPickerTestPieces(b, numPieces, selector)
+	var all bitmap.Bitmap
+	all.AddRange(0, numPieces)
+	for i := 0; i < 50; i++ {
+		var peerPieces bitmap.Bitmap
+		for j := 0; j < numPieces; j++ {
+			if rand.Intn(2) == 0 {
+				peerPieces.Add(j)
+			}
+		}
+		p.onBitfield(peerPieces)
+	}
+	reqs := make([]block, initialPipeline)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := p.fillRequests(all, reqs, nil)
+		p.discardRequests(reqs[:n])
+	}
+}
+
+func BenchmarkFillRequestsRandom(b *testing.B) {
+	benchmarkFillRequests(b, NewDefaultPieceSelector())
+}
+
+func BenchmarkFillRequestsRarest(b *testing.B) {
+	selector := NewDefaultPieceSelector()
+	selector.OnPieceDownload(-1)
+	benchmarkFillRequests(b, selector)
+}
+
+func BenchmarkFillRequestsLess(b *testing.B) {
+	selector := lessSelector{NewDefaultPieceSelector().(*DefaultPieceSelector)}
+	selector.OnPieceDownload(-1)
+	benchmarkFillRequests(b, selector)
+}
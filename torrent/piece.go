@@ -2,7 +2,6 @@ package torrent
 
 import (
 	"errors"
-	"sort"
 	"sync"
 
 	"github.com/anacrolix/missinggo/bitmap"
@@ -21,12 +20,15 @@ type pieces struct {
 	//that these methods access.
 	mu       sync.Mutex //guards following
 	pcs      []*Piece
+	picker   *picker
 	selector PieceSelector
 	endGame  bool
 	// caps the number of different pieces that are requested simultaneously.
 	//maxInFlightPieces int
 	//if false we shouldn't make any requests
 	downloadEnabled bool
+	//fast peers prefer whole pieces and slower ones share pieces
+	affinity bool
 }
 
 func newPieces(t *Torrent) *pieces {
@@ -35,13 +37,12 @@ func newPieces(t *Torrent) *pieces {
 	for i := 0; i < numPieces; i++ {
 		pcs[i] = newPiece(t, i)
 	}
-	sorted := make([]*Piece, numPieces)
-	copy(sorted, pcs)
 	p := &pieces{
-		t:   t,
-		pcs: pcs,
-		//prioritizedPcs: sorted,
+		t:        t,
+		pcs:      pcs,
+		picker:   newPicker(pcs),
 		selector: t.cl.config.SelectorF(),
+		affinity: t.cl.config.PieceAffinity,
 		//maxInFlightPieces: t.numPieces(),
 	}
 	p.selector.SetTorrent(t)
@@ -52,6 +53,14 @@ func (p *pieces) onHave(i int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.pcs[i].rarity++
+	p.update(p.pcs[i])
+}
+
+func (p *pieces) onDontHave(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pcs[i].rarity--
+	p.update(p.pcs[i])
 }
 
 func (p *pieces) onBitfield(bm bitmap.Bitmap) {
@@ -59,75 +68,81 @@ func (p *pieces) onBitfield(bm bitmap.Bitmap) {
 	defer p.mu.Unlock()
 	bm.IterTyped(func(piece int) bool {
 		p.pcs[piece].rarity++
+		p.update(p.pcs[piece])
 		return true
 	})
 }
 
+func (p *pieces) isVerified(i int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pcs[i].verified
+}
+
 func (p *pieces) setDownloadEnabled(v bool) {
 	p.mu.Lock()
 	p.downloadEnabled = v
 	p.mu.Unlock()
 }
 
-//fills the provided slice with requests. Returns how many were filled.
-func (p *pieces) fillRequests(peerPieces bitmap.Bitmap, requests []block) (n int) {
+func (p *pieces) isDownloadEnabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.downloadEnabled
+}
+
+//fills the provided slice with requests for conn c. Returns how many were
+//filled. If piece affinity is enabled, c prefers the pieces that match its
+//speed and falls back to the rest. c may be nil, then affinity is ignored.
+func (p *pieces) fillRequests(peerPieces bitmap.Bitmap, requests []block, c *conn) (n int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if !p.downloadEnabled {
 		return
 	}
-	/*if p.maxInFlightPieces <= 0 {
-		return
+	total := len(requests)
+	affinity := p.affinity && c != nil && !p.endGame
+	var speed speedClass
+	if affinity {
+		speed = c.speedClass()
 	}
-	pending := filterPieces(p.pcs, func(p *Piece) bool {
-		return p.PendingBlocks() > 0
-	})
-	if len(pending) > p.maxInFlightPieces {
-		panic("we shouldn't have that much pending pieces")
-	}*/
-	unrequested := filterPieces(p.pcs, func(p *Piece) bool {
-		return p.UnrequestedBlocks() > 0 && peerPieces.Get(p.index)
-	})
-	if len(unrequested) == 0 {
-		return
-	}
-	//reorder pieces based on selector Less func.
-	sort.Slice(unrequested, func(i, j int) bool {
-		p1 := unrequested[i]
-		p2 := unrequested[j]
-		return p.selector.Less(p1, p2)
-	})
-	//Ignore p.maxInFlightPieces for the time...
-	/*inFlightToAdd := p.maxInFlightPieces - len(pending)
-	unrequested = filterPieces(unrequested, func(p *Piece) bool {
-		if p.PendingBlocks() > 0 {
-			return true
-		}
-		inFlightToAdd--
-		//this piece has zero pending blocks and if we already have
-		//(or we are going to schedule) p.maxInFlightRecs requests in flight
-		//then don't request it
-		return inFlightToAdd >= 0
-	})*/
-	var unreq []block
-	total, _n := len(requests), 0
-	for _, piece := range unrequested {
-		unreq = piece.unrequestedBlocksSlc(len(requests))
+	take := func(piece *Piece) bool {
+		unreq := piece.unrequestedBlocksSlc(len(requests))
 		if !p.endGame {
+			if affinity {
+				piece.setAffinity(c, speed)
+			}
 			for _, b := range unreq {
 				piece.setBlockPending(b.off)
 			}
+			p.update(piece)
 		}
-		_n = copy(requests, unreq)
+		_n := copy(requests, unreq)
 		n += _n
 		if n > total {
 			panic("filled with more requests than conn wanted")
 		}
-		if n == total {
-			//got as many requests as asked for
-			return
-		}
 		requests = requests[_n:]
+		//stop when we got as many requests as asked for
+		return len(requests) > 0
+	}
+	if !affinity {
+		p.picker.pick(peerPieces, p.selector, take)
+		return
+	}
+	var skipped []*Piece
+	p.picker.pick(peerPieces, p.selector, func(piece *Piece) bool {
+		if !piece.canTake(c, speed) {
+			skipped = append(skipped, piece)
+			return true
+		}
+		return take(piece)
+	})
+	//better help others than stay idle
+	for _, piece := range skipped {
+		if len(requests) == 0 || !take(piece) {
+			break
+		}
 	}
 	return
 }
@@ -148,6 +163,7 @@ func (p *pieces) discardRequests(requests []block) {
 	defer p.mu.Unlock()
 	for _, req := range requests {
 		p.pcs[req.pc].setBlockUnrequsted(req.off)
+		p.update(p.pcs[req.pc])
 	}
 }
 
@@ -175,6 +191,7 @@ func (p *pieces) setBlockComplete(i int, off int, ci *connInfo) {
 		}
 	}()
 	piece.setBlockComplete(ci, off)
+	p.update(piece)
 	if p.maybeStartEndgame() {
 		transitionIntoEndGame = true
 	}
@@ -183,16 +200,29 @@ func (p *pieces) setBlockComplete(i int, off int, ci *connInfo) {
 func (p *pieces) pieceHashed(i int, correct bool) {
 	if correct {
 		p.ownedPieces.Set(i, true)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if correct {
 		p.pcs[i].verificationSuccess()
+		p.update(p.pcs[i])
 		p.selector.OnPieceDownload(i)
 	} else {
-		p.mu.Lock()
 		p.pcs[i].verificationFailed()
-		p.mu.Unlock()
+		p.update(p.pcs[i])
 	}
 	p.pcs[i].contributors = []*connInfo{}
 }
 
+//un-owns piece i and makes all of its blocks available for requesting again
+func (p *pieces) pieceLost(i int) {
+	p.ownedPieces.Set(i, false)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pcs[i].lost()
+	p.update(p.pcs[i])
+}
+
 func (p *pieces) maybeStartEndgame() bool {
 	if p.endGame || !p.allRequested() {
 		return false
@@ -201,6 +231,7 @@ func (p *pieces) maybeStartEndgame() bool {
 	notOwned := bitmap.Flip(p.ownedPieces, 0, p.t.numPieces())
 	notOwned.IterTyped(func(piece int) bool {
 		p.pcs[piece].setAllUnrequested()
+		p.update(p.pcs[piece])
 		return true
 	})
 	return true
@@ -233,23 +264,7 @@ func (p *pieces) haveAll() bool {
 
 //true if all the pieces have been requested (or completed).
 func (p *pieces) allRequested() bool {
-	for _, piece := range p.pcs {
-		if piece.hasUnrequestedBlocks() {
-			return false
-		}
-	}
-	return true
-}
-
-func filterPieces(pieces []*Piece, f func(*Piece) bool) []*Piece {
-	ret := []*Piece{}
-	for _, p := range pieces {
-		if f(p) {
-			ret = append(ret, p)
-		}
-	}
-	//TODO: maybe this escapes to heap and it is bad practice?
-	return ret
+	return p.picker.empty()
 }
 
 //Piece represents a single bitTorrent piece. A piece is divided in blocks.
@@ -272,6 +287,11 @@ type Piece struct {
 	//TODO: ban a conn with most maliciousness (see conn_stats.go)
 	//on verification failure.
 	contributors []*connInfo
+	//how many distinct peers contributed to the piece when it was verified
+	verifiedContributors int
+	//piece affinity, set while the piece has pending blocks
+	speed speedClass
+	owner *conn
 }
 
 //Index return the piece's index
@@ -316,6 +336,24 @@ func (p *Piece) CompletedBlocks() int {
 	return p.completeBlocks.Len()
 }
 
+//Contributors returns the number of distinct peers that sent us blocks of p.
+//For a verified piece, it returns the peers that completed it. Like the other
+//getters of Piece, it is meant for the snapshots that Torrent.Pieces returns.
+func (p *Piece) Contributors() int {
+	if p.verified {
+		return p.verifiedContributors
+	}
+	return numDistinct(p.contributors)
+}
+
+func numDistinct(conns []*connInfo) int {
+	distinct := make(map[*connInfo]struct{})
+	for _, c := range conns {
+		distinct[c] = struct{}{}
+	}
+	return len(distinct)
+}
+
 func newPiece(t *Torrent, i int) *Piece {
 	pieceLen := t.pieceLen(uint32(i))
 	lastBlockLen := t.blockRequestSize
@@ -446,11 +484,18 @@ func (p *Piece) verificationFailed() {
 	p.unrequestedBlocks, p.completeBlocks = p.completeBlocks, p.unrequestedBlocks
 }
 
+func (p *Piece) lost() {
+	p.verified = false
+	p.completeBlocks = bitmap.Bitmap{}
+	p.setAllUnrequested()
+}
+
 func (p *Piece) verificationSuccess() {
 	if p.verified {
 		panic("already verified")
 	}
 	p.verified = true
+	p.verifiedContributors = numDistinct(p.contributors)
 	for _, c := range p.contributors {
 		c.stats.goodPiecesContributions++
 	}
@@ -1,8 +1,9 @@
 package torrent
 
+import "github.com/lkslts64/charo-torrent/torrent/storage"
+
 type pieceHasher struct {
-	t           *Torrent
-	numVerified int
+	t *Torrent
 }
 
 func (p *pieceHasher) Run() {
@@ -14,11 +15,11 @@ func (p *pieceHasher) Run() {
 				pieceIndex: piece,
 				ok:         correct,
 			}
-			if correct {
-				p.numVerified++
-				if p.numVerified == p.t.numPieces() {
-					return
-				}
+		case piece := <-p.t.pieceReverifyC:
+			correct := p.t.storage.(storage.Reverifier).ReverifyPiece(piece, p.t.pieceLen(uint32(piece)))
+			p.t.pieceHashedC <- pieceHashed{
+				pieceIndex: piece,
+				ok:         correct,
 			}
 		case <-p.t.ClosedC:
 			return
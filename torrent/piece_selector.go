@@ -10,6 +10,8 @@ type PieceSelector interface {
 	// p1 and p2 have both unrequested blocks.
 	// Less will be executed every time the client wants to request pieces from a
 	// remote peer so it's important that its execution time is short.
+	// The DefaultPieceSelector is special cased and its pieces are picked from
+	// availability buckets, which is much faster for torrents with many pieces.
 	// Moreover, Less should not call any of the torrent's methods because it will
 	// cause deadlock - it is called with the torrent's internall lock acquired,
 	// another reason to keep its execution time short-.
@@ -24,8 +26,10 @@ type PieceSelector interface {
 }
 
 type DefaultPieceSelector struct {
-	next    nextF
-	pausedC chan bool
+	next nextF
+	//whether next is nextByRarity
+	byRarity bool
+	pausedC  chan bool
 }
 
 func NewDefaultPieceSelector() PieceSelector {
@@ -55,6 +59,7 @@ func completeness(p *Piece) int {
 
 func (dfs *DefaultPieceSelector) OnPieceDownload(_ int) {
 	dfs.next = nextByRarity
+	dfs.byRarity = true
 }
 
 func (dfs *DefaultPieceSelector) SetTorrent(_ *Torrent) {}
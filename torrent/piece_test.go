@@ -52,10 +52,10 @@ func TestPiecesState(t *testing.T) {
 	p.setDownloadEnabled(true)
 	var bm bitmap.Bitmap
 	bm.Add(1, 29, 30)
-	reqs := make([]block, maxOnFlight)
-	n := p.fillRequests(bm, reqs)
+	reqs := make([]block, initialPipeline)
+	n := p.fillRequests(bm, reqs, nil)
 	reqs = reqs[:n]
-	assert.EqualValues(t, maxOnFlight, n)
+	assert.EqualValues(t, initialPipeline, n)
 	for _, req := range reqs {
 		piece := p.pcs[req.pc]
 		assert.True(t, piece.pendingGet(req.off))
@@ -90,9 +90,11 @@ func TestPiecePrioritization(t *testing.T) {
 	for i, piece := range p.pcs {
 		piece.rarity = tr.numPieces() - i
 	}
+	//we changed the pieces behind the picker's back
+	p.picker.rebuild()
 	//take all blocks of the torrent
 	reqs := make([]block, tr.numPieces()*3)
-	n := p.fillRequests(bm, reqs)
+	n := p.fillRequests(bm, reqs, nil)
 	assert.Greater(t, n, tr.numPieces())
 	reqs = reqs[:n]
 	assert.Equal(t, 50, reqs[0].pc)
@@ -133,6 +135,7 @@ func TestEndGame(t *testing.T) {
 			p.pcs[i].setBlockPending(j)
 		}
 	}
+	p.picker.rebuild()
 	p.maybeStartEndgame()
 	assert.True(t, allBlocksUnrequested(p.pcs[0]) && allBlocksUnrequested(p.pcs[1]))
 	var bm bitmap.Bitmap
@@ -140,7 +143,7 @@ func TestEndGame(t *testing.T) {
 	//simulate 2 conns getting requests.The same blocks should be returned over and over again
 	for i := 0; i < 2; i++ {
 		reqs := make([]block, 10)
-		n := p.fillRequests(bm, reqs)
+		n := p.fillRequests(bm, reqs, nil)
 		reqs = reqs[:n]
 		for _, req := range reqs {
 			assert.True(t, req.pc == 0 || req.pc == 1)
@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	//how many requests we pipeline to a peer before we measure it
+	initialPipeline = 20
+	minPipeline     = 2
+	//we pipeline that many times the bandwidth-delay product so the peer
+	//always has requests to serve while ours are on the way
+	pipelineHeadroom = 2
+)
+
+//pipeline sizes how many requests we keep on flight to a peer. We want the
+//bandwidth-delay product of the link on flight, so fast peers on long links
+//stay saturated and slow peers don't hoard blocks that others could send.
+type pipeline struct {
+	depth int
+	//the upper bound of depth (Config.MaxOnFlightReqs)
+	max int
+	//the smallest request to block time we have seen. Requests wait behind
+	//others at the peer, so this is our estimate of the round trip time
+	//without queueing.
+	minRTT time.Duration
+	//smoothed download rate in bytes per second
+	rate float64
+	//bytes received since the last update
+	bytes      int
+	lastUpdate time.Time
+}
+
+func newPipeline(max int) pipeline {
+	if max < minPipeline {
+		max = minPipeline
+	}
+	depth := initialPipeline
+	if depth > max {
+		depth = max
+	}
+	return pipeline{
+		depth:      depth,
+		max:        max,
+		lastUpdate: time.Now(),
+	}
+}
+
+func (p *pipeline) onBlock(len int, rtt time.Duration) {
+	p.bytes += len
+	if p.minRTT == 0 || rtt < p.minRTT {
+		p.minRTT = rtt
+	}
+}
+
+//update measures the download rate and resizes the pipeline. idle is true if
+//we didn't have any requests on flight, in which case the rate tells
+//nothing about the peer. We keep the depth until the first block arrives.
+func (p *pipeline) update(now time.Time, idle bool, blockSize int) {
+	elapsed := now.Sub(p.lastUpdate)
+	p.lastUpdate = now
+	bytes := p.bytes
+	p.bytes = 0
+	if (idle && bytes == 0) || p.minRTT == 0 || elapsed <= 0 || blockSize <= 0 {
+		return
+	}
+	sample := float64(bytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = (p.rate + sample) / 2
+	}
+	bdp := p.rate * p.minRTT.Seconds() / float64(blockSize)
+	depth := int(math.Ceil(pipelineHeadroom * bdp))
+	switch {
+	case depth < minPipeline:
+		depth = minPipeline
+	case depth > p.max:
+		depth = p.max
+	}
+	p.depth = depth
+}
@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMaxPipeline = 250
+
+func TestPipeline(t *testing.T) {
+	const blockSize = 1 << 14
+	p := newPipeline(testMaxPipeline)
+	now := p.lastUpdate
+	//nothing measured yet
+	now = now.Add(time.Second)
+	p.update(now, false, blockSize)
+	assert.Equal(t, initialPipeline, p.depth)
+	//a fast peer on a long link: 100 blocks per second with 500ms RTT
+	for i := 0; i < 100; i++ {
+		p.onBlock(blockSize, 500*time.Millisecond)
+	}
+	now = now.Add(time.Second)
+	p.update(now, false, blockSize)
+	assert.Equal(t, pipelineHeadroom*50, p.depth)
+	//idle periods don't change anything
+	now = now.Add(time.Second)
+	p.update(now, true, blockSize)
+	assert.Equal(t, pipelineHeadroom*50, p.depth)
+	//the peer slows down
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		p.onBlock(blockSize, time.Second)
+		p.update(now, false, blockSize)
+	}
+	assert.Equal(t, minPipeline, p.depth)
+	//never more than the max
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		for j := 0; j < 10000; j++ {
+			p.onBlock(blockSize, time.Second)
+		}
+		p.update(now, false, blockSize)
+	}
+	assert.Equal(t, testMaxPipeline, p.depth)
+	//the initial depth respects a low max
+	p = newPipeline(10)
+	assert.Equal(t, 10, p.depth)
+	for i := 0; i < 100; i++ {
+		p.onBlock(blockSize, 500*time.Millisecond)
+	}
+	p.update(p.lastUpdate.Add(time.Second), false, blockSize)
+	assert.Equal(t, 10, p.depth)
+}
+
+func TestConnMaxOnFlightReqs(t *testing.T) {
+	c := &conn{pipeline: newPipeline(testMaxPipeline)}
+	assert.Equal(t, initialPipeline, c.maxOnFlightReqs())
+	//bounded by the peer's reqq
+	c.peerReqq = 5
+	assert.Equal(t, 5, c.maxOnFlightReqs())
+	c.peerReqq = 1000
+	assert.Equal(t, initialPipeline, c.maxOnFlightReqs())
+	c.pipeline.depth = testMaxPipeline
+	assert.Equal(t, testMaxPipeline, c.maxOnFlightReqs())
+}
@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+)
+
+//recordConn records every message exchanged through the underlying conn,
+//the handshake included. Until we know the torrent of the conn, the records
+//are kept in memory.
+type recordConn struct {
+	net.Conn
+	open       func(infoHash [20]byte, peer Peer) io.WriteCloser
+	peer       Peer
+	mu         sync.Mutex //guards following
+	started    bool
+	pending    []*peer_wire.Record
+	w          *peer_wire.RecordWriter
+	closer     io.Closer
+	recv, sent peer_wire.FrameSplitter
+}
+
+//recordConn wraps nc so its messages are recorded if Config.RecordWire is
+//set. It should be called before the handshake.
+func (cl *Client) recordConn(nc net.Conn, peer Peer) net.Conn {
+	if cl.config.RecordWire == nil {
+		return nc
+	}
+	return &recordConn{
+		Conn: nc,
+		open: cl.config.RecordWire,
+		peer: peer,
+		recv: peer_wire.FrameSplitter{Handshake: true},
+		sent: peer_wire.FrameSplitter{Handshake: true},
+	}
+}
+
+//startRecording saves the records of nc (if it is recorded) for the torrent
+//with infoHash
+func startRecording(nc net.Conn, infoHash [20]byte) {
+	if rc, ok := nc.(*recordConn); ok {
+		rc.start(infoHash)
+	}
+}
+
+func (rc *recordConn) start(infoHash [20]byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.started = true
+	if w := rc.open(infoHash, rc.peer); w != nil {
+		rc.w = peer_wire.NewRecordWriter(w)
+		rc.closer = w
+		for _, r := range rc.pending {
+			rc.w.WriteRecord(r)
+		}
+	}
+	rc.pending = nil
+}
+
+func (rc *recordConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	rc.recv.Write(b[:n], rc.record(peer_wire.RecordRecv))
+	return n, err
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	n, err := rc.Conn.Write(b)
+	rc.sent.Write(b[:n], rc.record(peer_wire.RecordSent))
+	return n, err
+}
+
+func (rc *recordConn) record(dir peer_wire.RecordDir) func(frame []byte) {
+	return func(frame []byte) {
+		r := &peer_wire.Record{
+			Time: time.Now(),
+			Dir:  dir,
+			Raw:  frame,
+		}
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if !rc.started {
+			r.Raw = append([]byte(nil), frame...)
+			rc.pending = append(rc.pending, r)
+			return
+		}
+		//recording is best effort
+		if rc.w != nil {
+			rc.w.WriteRecord(r)
+		}
+	}
+}
+
+func (rc *recordConn) Close() error {
+	rc.mu.Lock()
+	if rc.closer != nil {
+		rc.closer.Close()
+	}
+	rc.mu.Unlock()
+	return rc.Conn.Close()
+}
+
+//RecordWireToDir returns a function to be used as Config.RecordWire. The messages
+//of every recorded connection are written at a separate file inside dir. Only
+//the torrent with infohash `infoHash` and the peer with address `addr` are
+//recorded, unless they are zero.
+func RecordWireToDir(dir string, infoHash [20]byte, addr string) func(infoHash [20]byte, peer Peer) io.WriteCloser {
+	return func(ih [20]byte, peer Peer) io.WriteCloser {
+		if infoHash != [20]byte{} && infoHash != ih {
+			return nil
+		}
+		if addr != "" && addr != peer.P.String() {
+			return nil
+		}
+		name := hex.EncodeToString(ih[:]) + "-" + strings.NewReplacer(":", "_", "[", "", "]", "").Replace(peer.P.String()) +
+			"-" + time.Now().Format("20060102T150405.000") + ".wire"
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+}
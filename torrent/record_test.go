@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordWire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charo-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	seeder, seederTr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, nil)
+	defer seeder.Close()
+	require.NoError(t, seederTr.StartDataTransfer())
+	cfg := testingConfig()
+	cfg.BaseDir += "/leecher"
+	defer os.RemoveAll(cfg.BaseDir)
+	cfg.RecordWire = RecordWireToDir(dir, [20]byte{}, "")
+	leecher, leecherTr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	require.NoError(t, leecherTr.StartDataTransfer())
+	require.NoError(t, leecherTr.AddPeers(addrToPeer(seeder.addr(), SourceUser)))
+	<-leecherTr.DownloadedDataC
+	leecher.Close()
+	files, err := filepath.Glob(filepath.Join(dir, "*.wire"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+	var sentInterested, recvPiece bool
+	rr := peer_wire.NewRecordReader(f)
+	//the recording starts with the handshakes
+	for i := 0; i < 2; i++ {
+		r, err := rr.ReadRecord()
+		require.NoError(t, err)
+		hs, err := r.HandShake()
+		require.NoError(t, err)
+		assert.Equal(t, leecherTr.mi.Info.Hash, hs.InfoHash)
+		if r.Dir == peer_wire.RecordSent {
+			assert.Equal(t, leecher.ID(), hs.PeerID[:])
+		} else {
+			assert.Equal(t, seeder.ID(), hs.PeerID[:])
+		}
+	}
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		msg, err := r.Msg()
+		if err != nil {
+			//extended msgs we sent
+			continue
+		}
+		switch {
+		case r.Dir == peer_wire.RecordSent && msg.Kind == peer_wire.Interested:
+			sentInterested = true
+		case r.Dir == peer_wire.RecordRecv && msg.Kind == peer_wire.Piece:
+			recvPiece = true
+			assert.Equal(t, helloWorldContents, string(msg.Block))
+		}
+	}
+	assert.True(t, sentInterested)
+	assert.True(t, recvPiece)
+}
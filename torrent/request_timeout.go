@@ -0,0 +1,69 @@
+package torrent
+
+import "time"
+
+const (
+	//the timeout of requests until we have measured the peer
+	initialRequestTimeout = 20 * time.Second
+	minRequestTimeout     = 3 * time.Second
+	maxRequestTimeout     = time.Minute
+	//how long we wait for a request that timed out before we cancel it
+	lateRequestTimeout = 2 * maxRequestTimeout
+	//how often conns check for requests that timed out and resize their
+	//pipeline
+	requestsTickInterval = time.Second
+)
+
+//requestTimer estimates how long we should wait for a requested block before
+//we give it to other peers. It works like TCP's retransmission timer (RFC 6298)
+//with samples being the time from a request until its block arrives. Because
+//requests are pipelined, a sample includes both the latency of the peer and the
+//time it took to send the blocks that were queued before ours, so the timeout
+//adapts to the throughput of the peer as well.
+type requestTimer struct {
+	//smoothed request to block time
+	srtt time.Duration
+	//its variation
+	rttvar time.Duration
+}
+
+func (rt *requestTimer) sample(d time.Duration) {
+	if rt.srtt == 0 {
+		rt.srtt = d
+		rt.rttvar = d / 2
+		return
+	}
+	diff := rt.srtt - d
+	if diff < 0 {
+		diff = -diff
+	}
+	rt.rttvar = (3*rt.rttvar + diff) / 4
+	rt.srtt = (7*rt.srtt + d) / 8
+}
+
+func (rt *requestTimer) timeout() time.Duration {
+	if rt.srtt == 0 {
+		return initialRequestTimeout
+	}
+	to := rt.srtt + 4*rt.rttvar
+	switch {
+	case to < minRequestTimeout:
+		return minRequestTimeout
+	case to > maxRequestTimeout:
+		return maxRequestTimeout
+	}
+	return to
+}
+
+//timedOut backs off the timer when a request times out, the peer is slower
+//than we thought
+func (rt *requestTimer) timedOut() {
+	if rt.srtt == 0 {
+		rt.srtt = initialRequestTimeout
+		return
+	}
+	rt.srtt *= 2
+	if rt.srtt > maxRequestTimeout {
+		rt.srtt = maxRequestTimeout
+	}
+}
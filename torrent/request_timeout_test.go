@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/missinggo/bitmap"
+	"github.com/lkslts64/charo-torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestTimer(t *testing.T) {
+	var rt requestTimer
+	assert.Equal(t, initialRequestTimeout, rt.timeout())
+	for i := 0; i < 20; i++ {
+		rt.sample(100 * time.Millisecond)
+	}
+	assert.Equal(t, minRequestTimeout, rt.timeout())
+	for i := 0; i < 20; i++ {
+		rt.sample(10 * time.Second)
+	}
+	to := rt.timeout()
+	assert.True(t, to > 10*time.Second && to < maxRequestTimeout)
+	rt.timedOut()
+	assert.True(t, rt.timeout() > to)
+	for i := 0; i < 10; i++ {
+		rt.timedOut()
+	}
+	assert.Equal(t, maxRequestTimeout, rt.timeout())
+}
+
+func TestConnRequestTimeout(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	tr.blockRequestSize = tr.blockSize()
+	tr.pieces = newPieces(tr)
+	tr.pieces.setDownloadEnabled(true)
+	cn := newConn(tr, r, Peer{})
+	var all bitmap.Bitmap
+	all.AddRange(0, tr.numPieces())
+	reqs := make([]block, 2)
+	require.Equal(t, 2, tr.pieces.fillRequests(all, reqs, nil))
+	//the first one timed out, the other one is recent
+	cn.onFlightReqs[reqs[0]] = time.Now().Add(-time.Hour)
+	cn.onFlightReqs[reqs[1]] = time.Now()
+	require.NoError(t, cn.checkRequestTimeouts())
+	assert.Equal(t, requestsTimedOut(1), <-cn.sendC)
+	assert.Len(t, cn.onFlightReqs, 1)
+	assert.Contains(t, cn.timedOutReqs, reqs[0])
+	//timed out requests still count as on flight
+	assert.Equal(t, 2, cn.numOnFlight())
+	//other conns can request it now
+	assert.True(t, tr.pieces.pcs[reqs[0].pc].unrequestedBlocks.Get(reqs[0].off))
+	assert.False(t, tr.pieces.pcs[reqs[1].pc].unrequestedBlocks.Get(reqs[1].off))
+}
+
+func TestConnCancelLateRequests(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	tr.blockRequestSize = tr.blockSize()
+	tr.pieces = newPieces(tr)
+	tr.pieces.setDownloadEnabled(true)
+	cn := newConn(tr, r, Peer{})
+	cn.haveInfo = true
+	cn.state.amInterested = true
+	cn.state.isChoking = false
+	cn.peerBf.AddRange(0, tr.numPieces())
+	cn.maybeSendRequests()
+	require.Len(t, cn.onFlightReqs, cn.maxOnFlightReqs())
+	//the peer never answers
+	for req := range cn.onFlightReqs {
+		cn.onFlightReqs[req] = time.Now().Add(-time.Hour)
+	}
+	n := len(cn.onFlightReqs)
+	require.NoError(t, cn.onRequestsTick(time.Now()))
+	assert.Equal(t, requestsTimedOut(n), <-cn.sendC)
+	//the late requests were cancelled and new ones were sent
+	assert.Empty(t, cn.timedOutReqs)
+	assert.NotEmpty(t, cn.onFlightReqs)
+	for _, sent := range cn.onFlightReqs {
+		assert.WithinDuration(t, time.Now(), sent, time.Minute)
+	}
+}
+
+func TestConnRequestsSkipTimedOut(t *testing.T) {
+	w, r := net.Pipe()
+	go readForever(w)
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	tr := newTorrent(cl)
+	tr.mi, err = metainfo.LoadMetainfoFile("testdata/blockchain.torrent")
+	require.NoError(t, err)
+	tr.blockRequestSize = tr.blockSize()
+	tr.pieces = newPieces(tr)
+	tr.pieces.setDownloadEnabled(true)
+	cn := newConn(tr, r, Peer{})
+	cn.haveInfo = true
+	cn.state.amInterested = true
+	cn.state.isChoking = false
+	cn.peerBf.AddRange(0, tr.numPieces())
+	//the picker gives us a block that timed out at this peer: the other
+	//block of its piece is on flight, so the piece comes first
+	reqs := make([]block, 2)
+	require.Equal(t, 2, tr.pieces.fillRequests(cn.peerBf, reqs, nil))
+	require.Equal(t, reqs[0].pc, reqs[1].pc)
+	tr.pieces.discardRequests(reqs[1:])
+	cn.onFlightReqs[reqs[0]] = time.Now()
+	cn.timedOutReqs[reqs[1]] = time.Now()
+	cn.maybeSendRequests()
+	//the queue is full nevertheless
+	assert.Equal(t, cn.maxOnFlightReqs(), cn.numOnFlight())
+	assert.NotContains(t, cn.onFlightReqs, reqs[1])
+	assert.True(t, tr.pieces.pcs[reqs[1].pc].unrequestedBlocks.Get(reqs[1].off))
+}
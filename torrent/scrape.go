@@ -0,0 +1,231 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+var errTrackersDisabled = errors.New("trackers are disabled")
+
+//TrackerScrape is the swarm of a Torrent as reported by a tracker
+type TrackerScrape struct {
+	URL       string
+	Seeders   int
+	Leechers  int
+	Completed int
+	//when the tracker responded
+	Time time.Time
+	//not nil if the scrape failed, the other fields are zero then
+	Err error
+}
+
+//Scrape asks every tracker of the Torrent about its swarm. Results are
+//cached and the Stats of the Torrent report the largest swarm.
+func (t *Torrent) Scrape(ctx context.Context) ([]TrackerScrape, error) {
+	if t.cl.config.DisableTrackers {
+		return nil, errTrackersDisabled
+	}
+	urls, ih, err := t.scrapeTargets()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]TrackerScrape, len(urls))
+	var wg sync.WaitGroup
+	wg.Add(len(urls))
+	for i, url := range urls {
+		go func(i int, url string) {
+			defer wg.Done()
+			infos, err := t.cl.scrapeTracker(ctx, url, [][20]byte{ih})
+			if err != nil {
+				ret[i] = TrackerScrape{URL: url, Err: err}
+				return
+			}
+			ret[i] = newTrackerScrape(url, infos[ih])
+			t.scrapes.set(ret[i])
+		}(i, url)
+	}
+	wg.Wait()
+	return ret, nil
+}
+
+//Scrape asks the trackers about the swarms of all torrents. Torrents that
+//share a tracker are scraped with as few requests as possible (up to
+//tracker.MaxScrapeHashes per request). Results are cached and reported in the
+//Stats of every Torrent. If Config.ScrapeInterval is set, the client calls
+//Scrape periodically. Trackers that fail are logged, an error is returned
+//only if all of them failed.
+func (cl *Client) Scrape(ctx context.Context) error {
+	if cl.config.DisableTrackers {
+		return errTrackersDisabled
+	}
+	torrents := make(map[string]map[[20]byte]*Torrent)
+	for _, t := range cl.Torrents() {
+		urls, ih, err := t.scrapeTargets()
+		if err != nil {
+			continue
+		}
+		for _, url := range urls {
+			if torrents[url] == nil {
+				torrents[url] = make(map[[20]byte]*Torrent)
+			}
+			torrents[url][ih] = t
+		}
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures int
+		lastErr  error
+	)
+	wg.Add(len(torrents))
+	for url, ts := range torrents {
+		go func(url string, ts map[[20]byte]*Torrent) {
+			defer wg.Done()
+			ihashes := make([][20]byte, 0, len(ts))
+			for ih := range ts {
+				ihashes = append(ihashes, ih)
+			}
+			infos, err := cl.scrapeTracker(ctx, url, ihashes)
+			if err != nil {
+				cl.logger.Printf("scrape %s: %s\n", url, err)
+				mu.Lock()
+				failures++
+				lastErr = fmt.Errorf("scrape %s: %w", url, err)
+				mu.Unlock()
+			}
+			for ih, info := range infos {
+				ts[ih].scrapes.set(newTrackerScrape(url, info))
+			}
+		}(url, ts)
+	}
+	wg.Wait()
+	if failures > 0 && failures == len(torrents) {
+		return fmt.Errorf("all %d trackers failed, last error: %w", failures, lastErr)
+	}
+	return nil
+}
+
+func (cl *Client) scrapeForEver() {
+	ticker := time.NewTicker(cl.config.ScrapeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), trackerAnnounceTimeout)
+			cl.Scrape(ctx)
+			cancel()
+		case <-cl.close:
+			return
+		}
+	}
+}
+
+//scrapeTargets returns the trackers and the info hash of t
+func (t *Torrent) scrapeTargets() ([]string, [20]byte, error) {
+	l := t.newLocker()
+	l.lock()
+	if l.closed {
+		return nil, [20]byte{}, errTorrentClosed
+	}
+	defer l.unlock()
+	return t.trackerURLs(), t.mi.Info.Hash, nil
+}
+
+//scrapeTracker scrapes ihashes in batches of tracker.MaxScrapeHashes. The
+//torrents of the batches that succeeded are returned even if others failed.
+//Torrents the tracker doesn't know about have zero seeders and leechers.
+func (cl *Client) scrapeTracker(ctx context.Context, url string, ihashes [][20]byte) (map[[20]byte]tracker.TorrentInfo, error) {
+	tu, err := cl.trackerURL(url)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[[20]byte]tracker.TorrentInfo, len(ihashes))
+	for len(ihashes) > 0 {
+		batch := ihashes
+		if len(batch) > tracker.MaxScrapeHashes {
+			batch = batch[:tracker.MaxScrapeHashes]
+		}
+		ihashes = ihashes[len(batch):]
+		resp, err := tu.Scrape(ctx, batch...)
+		if err != nil {
+			return ret, err
+		}
+		for _, ih := range batch {
+			ret[ih] = resp.Torrents[string(ih[:])]
+		}
+	}
+	return ret, nil
+}
+
+//trackerURL returns the TrackerURL we announce to url with, so we reuse its
+//connection ID (UDP) and tracker id (HTTP). It creates a new one if we don't
+//announce to url.
+func (cl *Client) trackerURL(url string) (tracker.TrackerURL, error) {
+	if cl.trackerAnnouncer != nil {
+		if tu, ok := cl.trackerAnnouncer.trackerURL(url); ok {
+			return tu, nil
+		}
+	}
+	return cl.newTrackerURL(url)
+}
+
+func newTrackerScrape(url string, info tracker.TorrentInfo) TrackerScrape {
+	return TrackerScrape{
+		URL:       url,
+		Seeders:   int(info.Seeders),
+		Leechers:  int(info.Leechers),
+		Completed: int(info.Downloaded),
+		Time:      time.Now(),
+	}
+}
+
+//trackerScrapes caches the latest successful scrape of every tracker of a
+//Torrent. It is accessed by scraping goroutines so it has its own lock.
+type trackerScrapes struct {
+	mu sync.Mutex
+	m  map[string]TrackerScrape
+}
+
+func (ts *trackerScrapes) set(s TrackerScrape) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.m == nil {
+		ts.m = make(map[string]TrackerScrape)
+	}
+	ts.m[s.URL] = s
+}
+
+func (ts *trackerScrapes) get(url string) (TrackerScrape, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	s, ok := ts.m[url]
+	return s, ok
+}
+
+func (ts *trackerScrapes) remove(url string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.m, url)
+}
+
+//fill sets the swarm fields of stats to the largest swarm reported
+func (ts *trackerScrapes) fill(stats *Stats) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, s := range ts.m {
+		if s.Seeders+s.Leechers > stats.Seeders+stats.Leechers {
+			stats.Seeders, stats.Leechers = s.Seeders, s.Leechers
+		}
+		if s.Completed > stats.Completed {
+			stats.Completed = s.Completed
+		}
+		if s.Time.After(stats.LastScrape) {
+			stats.LastScrape = s.Time
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrape(t *testing.T) {
+	s := tracker.NewServer(nil)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeUDP(pc)
+	url := "udp://" + pc.LocalAddr().String()
+	cfg := testingConfig()
+	cfg.DisableTrackers = false
+	cl, hello := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	defer cl.Close()
+	blockchain, err := cl.AddFromFile(blockchainTorrentFile)
+	require.NoError(t, err)
+	for _, tr := range []*Torrent{hello, blockchain} {
+		require.NoError(t, tr.RemoveTracker(tr.mi.Announce))
+		require.NoError(t, tr.AddTrackers([][]string{{url}}))
+	}
+	tu, err := tracker.NewTrackerURL(url)
+	require.NoError(t, err)
+	//a seeder and two leechers
+	for i := 0; i < 3; i++ {
+		event := tracker.Started
+		if i == 0 {
+			event = tracker.Completed
+		}
+		_, err = tu.Announce(context.Background(), tracker.AnnounceReq{
+			InfoHash: hello.mi.Info.Hash,
+			PeerID:   [20]byte{byte(i)},
+			Left:     int64(i),
+			Event:    event,
+			Port:     int16(i + 1),
+		})
+		require.NoError(t, err)
+	}
+	assert.Zero(t, hello.Stats().LastScrape)
+	require.NoError(t, cl.Scrape(context.Background()))
+	stats := hello.Stats()
+	assert.Equal(t, 1, stats.Seeders)
+	assert.Equal(t, 2, stats.Leechers)
+	assert.Equal(t, 1, stats.Completed)
+	assert.NotZero(t, stats.LastScrape)
+	stats = blockchain.Stats()
+	assert.Equal(t, 0, stats.Seeders+stats.Leechers)
+	assert.NotZero(t, stats.LastScrape)
+
+	_, err = tu.Announce(context.Background(), tracker.AnnounceReq{
+		InfoHash: blockchain.mi.Info.Hash,
+		Port:     1,
+	})
+	require.NoError(t, err)
+	scrapes, err := blockchain.Scrape(context.Background())
+	require.NoError(t, err)
+	require.Len(t, scrapes, 1)
+	assert.NoError(t, scrapes[0].Err)
+	assert.Equal(t, url, scrapes[0].URL)
+	assert.Equal(t, 1, scrapes[0].Seeders)
+	assert.Equal(t, 1, blockchain.Stats().Seeders)
+
+	//scrapes reuse the TrackerURL we announce with
+	require.NoError(t, hello.StartDataTransfer())
+	var wtu tracker.TrackerURL
+	require.Eventually(t, func() bool {
+		var ok bool
+		wtu, ok = cl.trackerAnnouncer.trackerURL(url)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	tu2, err := cl.trackerURL(url)
+	require.NoError(t, err)
+	assert.True(t, wtu == tu2)
+
+	//every tracker fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	for _, tr := range []*Torrent{hello, blockchain} {
+		require.NoError(t, tr.RemoveTracker(url))
+		require.NoError(t, tr.AddTrackers([][]string{{"http://" + l.Addr().String() + "/announce"}}))
+	}
+	assert.Error(t, cl.Scrape(context.Background()))
+}
@@ -217,6 +217,19 @@ func (s *FileStorage) HashPiece(pieceIndex, len int) (correct bool) {
 	return s.hashPiece(pieceIndex, len)
 }
 
+//ReverifyPiece hashes again a verified piece. If it isn't correct, the piece
+//is no longer verified and its blocks can be written again. A piece that
+//wasn't verified isn't correct.
+func (s *FileStorage) ReverifyPiece(pieceIndex, len int) (correct bool) {
+	piece := s.pieces[pieceIndex]
+	if !piece.isVerified() {
+		s.logger.Printf("storage: reverify piece %d: piece is not verified\n", pieceIndex)
+		return false
+	}
+	piece.markNotComplete()
+	return s.hashPiece(pieceIndex, len)
+}
+
 func (s *FileStorage) hashPiece(pieceIndex, len int) (correct bool) {
 	defer func() {
 		piece := s.pieces[pieceIndex]
@@ -62,6 +62,15 @@ func TestStorage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, len(b), n)
 	assert.Equal(t, byte(0), b[0])
+	assert.True(t, fs.ReverifyPiece(piece, fs.mi.Info.PieceLen))
+	//corrupt the piece, it should fail re-verification and become writable
+	_, err = fs.WriteAt([]byte{1}, int64(piece*fs.mi.Info.PieceLen))
+	require.NoError(t, err)
+	assert.False(t, fs.ReverifyPiece(piece, fs.mi.Info.PieceLen))
+	//it isn't verified anymore
+	assert.False(t, fs.ReverifyPiece(piece, fs.mi.Info.PieceLen))
+	_, err = fs.WriteBlock(b, int64(piece*fs.mi.Info.PieceLen))
+	assert.NoError(t, err)
 }
 
 func testParallelWrites(t *testing.T, s *FileStorage, blockSize, piece int) {
@@ -15,3 +15,11 @@ type Storage interface {
 	WriteBlock(b []byte, off int64) (n int, err error)
 	HashPiece(pieceIndex int, len int) (correct bool)
 }
+
+//Reverifier is implemented by storages that can hash again a piece that was
+//verified, i.e to check if its data were deleted or corrupted. If the piece
+//isn't correct anymore, its blocks can be written again. Pieces that aren't
+//verified are reported as not correct.
+type Reverifier interface {
+	ReverifyPiece(pieceIndex int, len int) (correct bool)
+}
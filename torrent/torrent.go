@@ -53,26 +53,34 @@ type Torrent struct {
 	choker             *choker
 	//the number of outstanding request messages we support
 	//without dropping any. The default in in libtorrent is 250.
-	reqq                         int
-	blockRequestSize             int
-	trackerAnnouncerTimer        *time.Timer
-	canAnnounceTracker           bool
-	trackerAnnouncerResponseC    chan trackerAnnouncerResponse
-	trackerAnnouncerSubmitEventC chan trackerAnnouncerEvent
-	lastAnnounceResp             *tracker.AnnounceResp
-	numAnnounces                 int
-	numTrackerAnnouncesSend      int
+	reqq                      int
+	blockRequestSize          int
+	trackerAnnouncerTimer     *time.Timer
+	canAnnounceTracker        bool
+	trackerAnnouncerResponseC chan trackerAnnouncerResponse
+	lastAnnounceResp          *tracker.AnnounceResp
+	numAnnounces              int
+	numTrackerAnnouncesSend   int
+	//ordered by tier
+	trackers []*torrentTracker
 	//
 	dhtAnnounceResp  *dht.Announce
 	dhtAnnounceTimer *time.Timer
 	canAnnounceDht   bool
 	numDhtAnnounces  int
+	//
+	pex       pexState
+	pexTicker *time.Ticker
+	//conns that informed us about a peer via PEX and can introduce us to it
+	holepunchRelays map[string]*connInfo
 	//fires when an exported method wants to be invoked
 	userC chan chan interface{}
 	//these bools are set true when we should actively download/upload the torrent's data.
 	//the download of the info is not controled with this variable
 	uploadEnabled   bool
 	downloadEnabled bool
+	//whether conns know that we don't want any more pieces
+	isUploadOnly bool
 	//closes when the Torrent closes
 	ClosedC  chan struct{}
 	isClosed bool
@@ -84,6 +92,8 @@ type Torrent struct {
 	InfoC chan error
 	//channel to send requests to piece hasher goroutine
 	pieceQueuedHashingC chan int
+	//channel to send pieces we own to piece hasher to be verified again
+	pieceReverifyC chan int
 	//response channel of piece hasher
 	pieceHashedC          chan pieceHashed
 	queuedForVerification map[int]struct{}
@@ -104,6 +114,7 @@ type Torrent struct {
 	//length of data to be downloaded
 	length         int
 	stats          Stats
+	scrapes        trackerScrapes
 	connMsgsRecv   int
 	msgsSentToConn int
 }
@@ -116,6 +127,7 @@ func newTorrent(cl *Client) *Torrent {
 		recvC:                     make(chan msgWithConn, maxEstablishedConnsDefault*sendCSize),
 		newConnC:                  make(chan *connInfo, maxEstablishedConnsDefault),
 		halfOpen:                  make(map[string]Peer),
+		holepunchRelays:           make(map[string]*connInfo),
 		userC:                     make(chan chan interface{}),
 		maxEstablishedConnections: cl.config.MaxEstablishedConns,
 		maxHalfOpenConns:          55,
@@ -134,9 +146,6 @@ func newTorrent(cl *Client) *Torrent {
 		canAnnounceDht:            true,
 		canAnnounceTracker:        true,
 	}
-	if t.cl.trackerAnnouncer != nil {
-		t.trackerAnnouncerSubmitEventC = cl.trackerAnnouncer.trackerAnnouncerSubmitEventCh
-	}
 	t.choker = newChoker(t)
 	return t
 }
@@ -152,6 +161,7 @@ func (t *Torrent) close() {
 	}()
 	t.dropAllConns()
 	t.choker.ticker.Stop()
+	t.pexTicker.Stop()
 	t.trackerAnnouncerTimer.Stop()
 	t.dhtAnnounceTimer.Stop()
 	t.choker = nil
@@ -161,6 +171,7 @@ func (t *Torrent) close() {
 	t.pieces = nil
 	t.infoBytes = nil
 	t.peers = nil
+	t.holepunchRelays = nil
 	//t.logger = nil
 	//TODO: clear struct fields
 }
@@ -184,14 +195,16 @@ func (t *Torrent) mainLoop() {
 	}()
 	t.tryAnnounceAll()
 	t.choker.startTicker()
+	t.pexTicker = time.NewTicker(pexInterval)
 	for {
 		select {
 		case e := <-t.recvC:
 			t.onConnMsg(e)
 			t.connMsgsRecv++
 		case res := <-t.pieceHashedC:
+			wasOwned := t.pieces.ownedPieces.Get(res.pieceIndex)
 			t.pieceHashed(res.pieceIndex, res.ok)
-			if t.pieces.haveAll() {
+			if !wasOwned && t.pieces.haveAll() {
 				t.sendAnnounceToTracker(tracker.Completed)
 				t.downloadedAll()
 			}
@@ -199,6 +212,8 @@ func (t *Torrent) mainLoop() {
 			t.establishedConnection(ci)
 		case <-t.choker.ticker.C:
 			t.choker.reviewUnchokedPeers()
+		case <-t.pexTicker.C:
+			t.sendPexMsgs()
 		case tresp := <-t.trackerAnnouncerResponseC:
 			t.trackerAnnounced(tresp)
 		case <-t.trackerAnnouncerTimer.C:
@@ -241,6 +256,28 @@ func (t *Torrent) onConnMsg(e msgWithConn) {
 	case uploadedBlock:
 		t.blockUploaded(e.conn, block(v))
 	case metainfoSize:
+	case peer_wire.ExtHandshakeDict:
+		e.conn.exts, _ = v.Extensions()
+		if client, ok := v.ClientVersion(); ok {
+			e.conn.client = client
+		}
+		if port, ok := v.ListenPort(); ok && e.conn.peer.Source == SourceIncoming && e.conn.listenPort == 0 {
+			//now we know where to reach this peer
+			e.conn.listenPort = port
+			t.pexConnAdded(e.conn)
+		}
+		if peerUploadOnly, ok := v.UploadOnly(); ok && peerUploadOnly != e.conn.peerUploadOnly {
+			e.conn.peerUploadOnly = peerUploadOnly
+			t.choker.reviewUnchokedPeers()
+		}
+	case peer_wire.DontHaveMsg:
+		e.conn.reviewInterestsOnDontHave(int(v))
+	case pieceReadFailed:
+		t.reverifyPiece(int(v))
+	case pexPeers:
+		t.gotPexPeers(e.conn, v)
+	case peer_wire.HolepunchMsg:
+		t.onHolepunchMsg(e.conn, v)
 	case bitmap.Bitmap:
 		e.conn.peerBf = v
 		e.conn.reviewInterestsOnBitfield()
@@ -248,6 +285,12 @@ func (t *Torrent) onConnMsg(e msgWithConn) {
 		t.droppedConn(e.conn)
 	case discardedRequests:
 		t.broadcastToConns(requestsAvailable{})
+	case requestsTimedOut:
+		if !e.conn.stats.snubbed {
+			e.conn.stats.snubbed = true
+			t.cl.counters.Add("snubbed", 1)
+		}
+		t.broadcastToConns(requestsAvailable{})
 	}
 }
 
@@ -272,6 +315,27 @@ func (t *Torrent) seeding() bool {
 	return t.haveAll() && t.uploadEnabled
 }
 
+//uploadOnly returns true if we don't want any more pieces, i.e we are a seed
+//or a partial seed because downloading is disabled (BEP 21).
+func (t *Torrent) uploadOnly() bool {
+	if !t.haveInfo() || !t.uploadEnabled {
+		return false
+	}
+	return t.haveAll() || !t.pieces.isDownloadEnabled()
+}
+
+//informs conns if we stopped or started wanting pieces
+func (t *Torrent) reviewUploadOnly() {
+	v := t.uploadOnly()
+	if v == t.isUploadOnly {
+		return
+	}
+	t.isUploadOnly = v
+	for _, c := range t.conns {
+		c.sendUploadOnly(v)
+	}
+}
+
 func (t *Torrent) haveAll() bool {
 	if !t.haveInfo() {
 		return false
@@ -284,25 +348,50 @@ func (t *Torrent) dataTransferAllowed() bool {
 	return !t.haveInfo() || t.uploadEnabled || t.downloadEnabled
 }
 
+//sendAnnounceToTracker announces event to all trackers. Regular announces
+//go only to the trackers that are due.
 func (t *Torrent) sendAnnounceToTracker(event tracker.Event) {
-	if t.cl.config.DisableTrackers || t.cl.trackerAnnouncer == nil || t.mi.Announce == "" {
+	if t.cl.config.DisableTrackers || t.cl.trackerAnnouncer == nil {
 		return
 	}
-	t.trackerAnnouncerSubmitEventC <- trackerAnnouncerEvent{t, event, t.stats}
-	t.numTrackerAnnouncesSend++
+	now := time.Now()
+	for _, tr := range t.trackers {
+		if event == tracker.None && (tr.announcing || tr.next.After(now)) {
+			continue
+		}
+		t.submitAnnounce(tr, event)
+	}
 	t.canAnnounceTracker = false
+	t.scheduleTrackerAnnounce()
+}
+
+//trackerURLs returns the trackers of t
+func (t *Torrent) trackerURLs() []string {
+	urls := make([]string, len(t.trackers))
+	for i, tr := range t.trackers {
+		urls[i] = tr.url
+	}
+	return urls
 }
 
 func (t *Torrent) trackerAnnounced(tresp trackerAnnouncerResponse) {
 	t.numAnnounces++
 	if tresp.err != nil {
-		t.logger.Printf("tracker error: %s\n", tresp.err)
-		//announce after one minute if tracker send error
-		t.resetNextTrackerAnnounce(60)
+		t.logger.Printf("tracker %s: %s\n", tresp.url, tresp.err)
+	}
+	//the tracker may have been removed
+	if tr := t.tracker(tresp.url); tr != nil {
+		tr.announced(tresp, time.Now())
+	}
+	t.scheduleTrackerAnnounce()
+	//a warning may come along with a response
+	if tresp.resp == nil {
 		return
 	}
-	t.resetNextTrackerAnnounce(tresp.resp.Interval)
 	t.lastAnnounceResp = tresp.resp
+	if tresp.resp.ExternalIP != nil {
+		t.cl.externalIPs.vote("tracker "+tresp.url, tresp.resp.ExternalIP)
+	}
 	peers := make([]Peer, len(tresp.resp.Peers))
 	for i := 0; i < len(peers); i++ {
 		peers[i] = Peer{
@@ -321,8 +410,7 @@ func (t *Torrent) addFilteredPeers(peers []Peer, f func(peer Peer) bool) {
 	}
 }
 
-func (t *Torrent) resetNextTrackerAnnounce(interval int32) {
-	nextAnnounce := time.Duration(interval) * time.Second
+func (t *Torrent) resetNextTrackerAnnounce(nextAnnounce time.Duration) {
 	if !t.trackerAnnouncerTimer.Stop() {
 		select {
 		//rare case - only when we announced with event Complete or Started
@@ -417,6 +505,9 @@ func (t *Torrent) peerInActiveConns(peer Peer) bool {
 		if bytes.Equal(ci.peer.P.IP, peer.P.IP) && ci.peer.P.Port == peer.P.Port {
 			return true
 		}
+		if addr, ok := ci.listenAddr(); ok && bytes.Equal(addr.P.IP, peer.P.IP) && addr.P.Port == peer.P.Port {
+			return true
+		}
 	}
 	return false
 }
@@ -450,7 +541,7 @@ func (t *Torrent) writeStatus(b *strings.Builder) {
 		b.WriteString(fmt.Sprintf("Name: %s\n", t.mi.Info.Name))
 	}
 	b.WriteString(fmt.Sprintf("#DhtAnnounces: %d\n", t.numDhtAnnounces))
-	b.WriteString("Tracker: " + t.mi.Announce + "\tAnnounce: " + func() string {
+	b.WriteString("Trackers: " + strconv.Itoa(len(t.trackers)) + "\tAnnounce: " + func() string {
 		if t.lastAnnounceResp != nil {
 			return "OK"
 		}
@@ -464,9 +555,9 @@ func (t *Torrent) writeStatus(b *strings.Builder) {
 		humanize.Bytes(uint64(t.stats.BytesUploaded)), humanize.Bytes(uint64(t.stats.BytesLeft))))
 	b.WriteString(fmt.Sprintf("Connected to %d peers\n", len(t.conns)))
 	tabWriter := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(tabWriter, "Address\t%\tUp\tDown\t")
+	fmt.Fprintln(tabWriter, "Address\tClient\t%\tUp\tDown\t")
 	for _, ci := range t.conns {
-		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t\n", ci.peer.P.IP.String(),
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\t\n", ci.peer.P.IP.String(), ci.clientName(),
 			strconv.Itoa(int(float64(ci.peerBf.Len())/float64(t.numPieces())*100))+"%",
 			humanize.Bytes(uint64(ci.stats.uploadUsefulBytes)),
 			humanize.Bytes(uint64(ci.stats.downloadUsefulBytes)))
@@ -507,10 +598,16 @@ func (t *Torrent) blockUploaded(c *connInfo, b block) {
 }
 
 func (t *Torrent) downloadedAll() {
-	close(t.DownloadedDataC)
+	select {
+	case <-t.DownloadedDataC:
+		//we had downloaded all before but we lost some pieces
+	default:
+		close(t.DownloadedDataC)
+	}
 	for _, c := range t.conns {
 		c.notInterested()
 	}
+	t.reviewUploadOnly()
 }
 
 func (t *Torrent) queuePieceForHashing(i int) {
@@ -526,8 +623,31 @@ func (t *Torrent) queuePieceForHashing(i int) {
 	}
 }
 
+//queues a piece we own for hashing in order to check if we lost it
+func (t *Torrent) reverifyPiece(i int) {
+	if _, ok := t.storage.(storage.Reverifier); !ok {
+		return
+	}
+	if _, ok := t.queuedForVerification[i]; ok || !t.pieces.isVerified(i) {
+		return
+	}
+	t.queuedForVerification[i] = struct{}{}
+	select {
+	case t.pieceReverifyC <- i:
+	default:
+		panic("queue piece reverification: should not block")
+	}
+}
+
 func (t *Torrent) pieceHashed(i int, correct bool) {
 	delete(t.queuedForVerification, i)
+	if t.pieces.pcs[i].verified {
+		//a piece we own was re-verified
+		if !correct {
+			t.pieceLost(i)
+		}
+		return
+	}
 	t.pieces.pieceHashed(i, correct)
 	if correct {
 		t.onPieceDownload(i)
@@ -597,9 +717,10 @@ func (t *Torrent) establishedConnection(ci *connInfo) bool {
 		ci.sendMsgToConn(haveInfo{})
 	}
 	//TODO:minimize sends...
-	//
-	//TODO:send here extension msg
-	//
+	if ci.supportsExtended() {
+		ci.sendExtHandshake()
+	}
+	t.pexConnAdded(ci)
 	//if we have some pieces, we should sent a bitfield
 	if t.pieces.ownedPieces.Len() > 0 {
 		ci.sendBitfield()
@@ -607,10 +728,30 @@ func (t *Torrent) establishedConnection(ci *connInfo) bool {
 	if ci.reserved.SupportDHT() && t.cl.reserved.SupportDHT() && t.cl.dhtServer != nil {
 		ci.sendPort()
 	}
+	if t.isUploadOnly {
+		ci.sendMsgToConn(uploadOnly(true))
+	}
 	go t.aggregateEvents(ci)
 	return true
 }
 
+//pieceLost un-owns piece i, e.g because its data were deleted or they failed
+//re-verification. Peers are informed and the piece will be downloaded again.
+func (t *Torrent) pieceLost(i int) {
+	if !t.pieces.ownedPieces.Get(i) {
+		return
+	}
+	t.logger.Printf("lost piece %d\n", i)
+	t.pieces.pieceLost(i)
+	t.stats.onPieceLost(t.pieceLen(uint32(i)))
+	t.broadcastToConns(pieceLost(i))
+	t.reviewUploadOnly()
+	for _, c := range t.conns {
+		c.reviewInterests()
+	}
+	t.broadcastToConns(requestsAvailable{})
+}
+
 func (t *Torrent) banPeer() {
 	max := math.MinInt32
 	var toBan *connInfo
@@ -640,12 +781,14 @@ func (t *Torrent) droppedConn(ci *connInfo) bool {
 	defer t.choker.reviewUnchokedPeers()
 	defer t.dialConns()
 	t.removeConn(ci, i)
+	t.pexConnDropped(ci)
+	t.removeHolepunchRelay(ci)
 	//If there is a large time gap between the time we download the info and before the user
 	//requests to download the data we may lose some connections (seeders will close because
 	//we won't request any pieces). So, we may have to store the peers that droped us during
 	//that period in order to reconnect.
-	if t.infoWasDownloaded() && !t.dataTransferAllowed() {
-		t.peers = append(t.peers, ci.peer)
+	if p, ok := ci.listenAddr(); ok && t.infoWasDownloaded() && !t.dataTransferAllowed() {
+		t.peers = append(t.peers, p)
 	}
 	return true
 }
@@ -824,6 +967,7 @@ func (t *Torrent) gotInfo() {
 	t.blockRequestSize = t.blockSize()
 	t.pieces = newPieces(t)
 	t.pieceQueuedHashingC = make(chan int, t.numPieces())
+	t.pieceReverifyC = make(chan int, t.numPieces())
 	t.pieceHashedC = make(chan pieceHashed, t.numPieces())
 	var haveAll bool
 	t.storage, haveAll = t.openStorage(t.mi, t.cl.config.BaseDir, t.pieces.blocks(), t.logger)
@@ -836,10 +980,10 @@ func (t *Torrent) gotInfo() {
 			t.pieceHashed(i, true)
 		}
 		t.downloadedAll()
-	} else {
-		ph := pieceHasher{t: t}
-		go ph.Run()
 	}
+	//pieces we own may need re-verification so the hasher runs even if we have all
+	ph := pieceHasher{t: t}
+	go ph.Run()
 	//TODO:review interests
 }
 
@@ -862,14 +1006,6 @@ func (t *Torrent) blockSize() int {
 	return maxRequestBlockSz
 }
 
-/*
-func (t *Torrent) scrapeTracker() (*tracker.ScrapeResp, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	return t.trackerURL.Scrape(ctx, t.mi.Info.Hash)
-}
-*/
-
 func (t *Torrent) haveInfo() bool {
 	return t.mi.Info != nil
 }
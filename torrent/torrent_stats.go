@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"fmt"
+	"time"
 )
 
 //Stats contains statistics about a Torrent
@@ -16,6 +17,13 @@ type Stats struct {
 	BytesDownloaded int
 	//Number of bytes we have uploaded
 	BytesUploaded int
+	//The swarm as reported by the tracker with the most peers at the last
+	//scrape (see Torrent.Scrape and Client.Scrape). Zero if we haven't scraped.
+	Seeders   int
+	Leechers  int
+	Completed int
+	//When a tracker last responded to a scrape
+	LastScrape time.Time
 }
 
 func (s *Stats) blockDownloaded(bytes int) {
@@ -32,6 +40,10 @@ func (s *Stats) onPieceDownload(bytes int) {
 	s.BytesLeft -= bytes
 }
 
+func (s *Stats) onPieceLost(bytes int) {
+	s.BytesLeft += bytes
+}
+
 func (s *Stats) String() string {
 	return fmt.Sprintf(`blocks downloaded: %d,blocks uploaded: %d\n,
 	bytes left: %d,bytes downloaded %d,bytes uploaded: %d\n`, s.BlocksDownloaded,
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,6 +19,7 @@ import (
 	"github.com/lkslts64/charo-torrent/bencode"
 	"github.com/lkslts64/charo-torrent/metainfo"
 	"github.com/lkslts64/charo-torrent/peer_wire"
+	"github.com/lkslts64/charo-torrent/socks5"
 	"github.com/lkslts64/charo-torrent/torrent/storage"
 	"github.com/lkslts64/charo-torrent/tracker"
 	"github.com/stretchr/testify/assert"
@@ -50,6 +52,109 @@ func TestTorrentNewConnection(t *testing.T) {
 	assert.Equal(t, tr.maxEstablishedConnections, len(tr.conns))
 }
 
+func TestUploadOnly(t *testing.T) {
+	testUploadOnly := func(msg interface{}, expect bool) {
+		b := msg.(*peer_wire.Msg).Encode()
+		decoded, err := peer_wire.Decode(bytes.NewReader(b))
+		require.NoError(t, err)
+		uploadOnly, ok := decoded.ExtendedMsg.(peer_wire.ExtHandshakeDict).UploadOnly()
+		require.True(t, ok)
+		assert.Equal(t, expect, uploadOnly)
+	}
+	newConnInfo := func(tr *Torrent) *connInfo {
+		ci := &connInfo{
+			t:        tr,
+			recvC:    make(chan interface{}, sendCSize),
+			sendC:    make(chan interface{}, recvCSize),
+			droppedC: make(chan struct{}),
+		}
+		ci.reserved.SetExtended()
+		tr.newConnC <- ci
+		return ci
+	}
+	//a seed is upload only
+	_, tr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, nil)
+	require.NoError(t, tr.StartDataTransfer())
+	ci := newConnInfo(tr)
+	assert.Equal(t, haveInfo{}, <-ci.sendC)
+	testUploadOnly(<-ci.sendC, true)
+	assert.IsType(t, bitmap.Bitmap{}, <-ci.sendC)
+	assert.Equal(t, uploadOnly(true), <-ci.sendC)
+	//a leecher that disables downloading becomes a partial seed
+	cfg := testingConfig()
+	cfg.BaseDir += "/leecher"
+	defer os.RemoveAll(cfg.BaseDir)
+	_, tr = newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	require.NoError(t, tr.StartDataTransfer())
+	ci = newConnInfo(tr)
+	assert.Equal(t, haveInfo{}, <-ci.sendC)
+	testUploadOnly(<-ci.sendC, false)
+	require.NoError(t, tr.DisableDataDownload())
+	assert.Equal(t, uploadOnly(true), <-ci.sendC)
+	testUploadOnly(<-ci.sendC, true)
+	require.NoError(t, tr.EnableDataDownload())
+	assert.Equal(t, uploadOnly(false), <-ci.sendC)
+	testUploadOnly(<-ci.sendC, false)
+}
+
+func TestPieceLost(t *testing.T) {
+	_, tr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, nil)
+	require.NoError(t, tr.StartDataTransfer())
+	ci := &connInfo{
+		t:        tr,
+		recvC:    make(chan interface{}, sendCSize),
+		sendC:    make(chan interface{}, recvCSize),
+		droppedC: make(chan struct{}),
+	}
+	ci.reserved.SetExtended()
+	tr.newConnC <- ci
+	assert.Equal(t, haveInfo{}, <-ci.sendC)
+	<-ci.sendC //ext handshake
+	assert.IsType(t, bitmap.Bitmap{}, <-ci.sendC)
+	assert.Equal(t, uploadOnly(true), <-ci.sendC)
+	l := tr.newLocker()
+	l.lock()
+	bytesLeft := tr.stats.BytesLeft
+	tr.pieceLost(0)
+	assert.False(t, tr.pieces.ownedPieces.Get(0))
+	assert.False(t, tr.pieces.pcs[0].verified)
+	assert.Equal(t, bytesLeft+tr.pieceLen(0), tr.stats.BytesLeft)
+	assert.False(t, tr.haveAll())
+	l.unlock()
+	assert.Equal(t, pieceLost(0), <-ci.sendC)
+	assert.Equal(t, uploadOnly(false), <-ci.sendC)
+}
+
+func TestPeerConnsClient(t *testing.T) {
+	seeder, seederTr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, nil)
+	defer seeder.Close()
+	require.NoError(t, seederTr.StartDataTransfer())
+	cfg := testingConfig()
+	cfg.BaseDir += "/leecher"
+	defer os.RemoveAll(cfg.BaseDir)
+	leecher, leecherTr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	defer leecher.Close()
+	require.NoError(t, leecherTr.StartDataTransfer())
+	require.NoError(t, leecherTr.AddPeers(addrToPeer(seeder.addr(), SourceUser)))
+	<-leecherTr.DownloadedDataC
+	conns := seederTr.PeerConns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, "charo 0.0.0.1", conns[0].Client)
+	assert.Equal(t, leecher.ID(), conns[0].ID[:])
+	//refuse connections from charo peers
+	cfg.BaseDir += "2"
+	defer os.RemoveAll(cfg.BaseDir)
+	cfg.ClientBlacklist = []string{"CHARO"}
+	blacklisting, blacklistingTr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	defer blacklisting.Close()
+	require.NoError(t, blacklistingTr.StartDataTransfer())
+	require.NoError(t, blacklistingTr.AddPeers(addrToPeer(seeder.addr(), SourceUser)))
+	waitTorrent(t, blacklistingTr, func() bool {
+		return blacklisting.counters.Get("blacklisted clients") != nil
+	})
+	assert.Len(t, blacklistingTr.PeerConns(), 0)
+}
+
 func TestStatsUpdate(t *testing.T) {
 	tr := &Torrent{
 		mi: &metainfo.MetaInfo{},
@@ -130,18 +235,114 @@ func TestLoadCompleteTorrent(t *testing.T) {
 
 func TestSingleFileTorrentTransfer(t *testing.T) {
 	testDataTransfer(t, dataTransferOpts{
-		helloWorldTorrentFile,
-		1,
+		filename:    helloWorldTorrentFile,
+		numLeechers: 1,
 	})
 }
 
 func TestMultiFileTorrentTransfer(t *testing.T) {
 	testDataTransfer(t, dataTransferOpts{
-		blockchainTorrentFile,
-		5,
+		filename:    blockchainTorrentFile,
+		numLeechers: 5,
+	})
+}
+
+func TestEncryptedTorrentTransfer(t *testing.T) {
+	testDataTransfer(t, dataTransferOpts{
+		filename:    helloWorldTorrentFile,
+		numLeechers: 2,
+		encryption:  EncryptionRequire,
+	})
+}
+
+func TestIPv6TorrentTransfer(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	l.Close()
+	testDataTransfer(t, dataTransferOpts{
+		filename:    helloWorldTorrentFile,
+		numLeechers: 2,
+		ipv6:        true,
+	})
+}
+
+func TestTCPTorrentTransfer(t *testing.T) {
+	testDataTransfer(t, dataTransferOpts{
+		filename:    helloWorldTorrentFile,
+		numLeechers: 2,
+		disableUTP:  true,
+	})
+}
+
+func TestPieceAffinityTorrentTransfer(t *testing.T) {
+	testDataTransfer(t, dataTransferOpts{
+		filename:      helloWorldTorrentFile,
+		numLeechers:   3,
+		pieceAffinity: true,
 	})
 }
 
+func TestProxyTorrentTransfer(t *testing.T) {
+	cfg := testingConfig()
+	cfg.ProxyOnly = true
+	_, err := NewClient(cfg)
+	assert.Error(t, err)
+	seeder, seederTr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, func(tr *Torrent) {
+		require.NoError(t, tr.StartDataTransfer())
+	})
+	defer seeder.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var mu sync.Mutex
+	var reqs []string
+	go (&socks5.Server{
+		OnRequest: func(cmd, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			reqs = append(reqs, cmd+" "+addr)
+		},
+	}).Serve(l)
+	cfg.Socks5Proxy = l.Addr().String()
+	cfg.BaseDir += "/leecher"
+	defer os.RemoveAll(cfg.BaseDir)
+	leecher, leecherTr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	defer leecher.Close()
+	assert.True(t, leecher.config.RejectIncomingConnections)
+	//the caller's config is left alone
+	assert.False(t, cfg.RejectIncomingConnections)
+	assert.False(t, cfg.DisableUTP)
+	seederAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(seeder.ListenPort()))
+	require.NoError(t, leecherTr.AddPeers(addrToPeer(seederAddr, SourceUser)))
+	require.NoError(t, leecherTr.StartDataTransfer())
+	select {
+	case <-leecherTr.DownloadedDataC:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download through the proxy timed out")
+	}
+	dataSeeder := make([]byte, seederTr.length)
+	require.NoError(t, seederTr.readBlock(dataSeeder, 0, 0))
+	testContents(t, dataSeeder, leecherTr)
+	mu.Lock()
+	assert.Equal(t, []string{"CONNECT " + seederAddr}, reqs)
+	mu.Unlock()
+}
+
+func TestClientCloseUTP(t *testing.T) {
+	cfg := testingConfig()
+	cfg.RejectIncomingConnections = true
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	addr := cl.utpSocket.Addr().String()
+	cl.Close()
+	//the port is released
+	pc, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	pc.Close()
+}
+
 func addrsToPeers(addrs []string) []Peer {
 	peers := make([]Peer, len(addrs))
 	for i, addr := range addrs {
@@ -153,11 +354,26 @@ func addrsToPeers(addrs []string) []Peer {
 type dataTransferOpts struct {
 	filename    string
 	numLeechers int
+	encryption  EncryptionPolicy
+	disableUTP  bool
+	//connect to peers using the IPv6 loopback address
+	ipv6          bool
+	pieceAffinity bool
+}
+
+func (opts dataTransferOpts) addr(cl *Client) string {
+	if opts.ipv6 {
+		return net.JoinHostPort("::1", strconv.Itoa(cl.ListenPort()))
+	}
+	return cl.addr()
 }
 
 //create one seeder and multiple leechers and make them try to download the torrent cooperatively
 func testDataTransfer(t *testing.T, opts dataTransferOpts) {
-	seeder, seederTr := newClientWithTorrent(t, testingConfig(), helloWorldTorrentFile, func(tr *Torrent) {
+	cfg := testingConfig()
+	cfg.EncryptionPolicy = opts.encryption
+	cfg.DisableUTP = opts.disableUTP
+	seeder, seederTr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, func(tr *Torrent) {
 		assert.True(t, tr.haveAll())
 		require.NoError(t, tr.StartDataTransfer())
 	})
@@ -167,9 +383,12 @@ func testDataTransfer(t *testing.T, opts dataTransferOpts) {
 	leechAddrs := make([]string, len(leechers))
 	for i := range leechers {
 		tcfg := testingConfig()
+		tcfg.EncryptionPolicy = opts.encryption
+		tcfg.DisableUTP = opts.disableUTP
+		tcfg.PieceAffinity = opts.pieceAffinity
 		tcfg.BaseDir += "/leecher" + strconv.Itoa(i)
 		leechers[i], _ = newClientWithTorrent(t, tcfg, helloWorldTorrentFile, nil)
-		leechAddrs[i] = leechers[i].addr()
+		leechAddrs[i] = opts.addr(leechers[i])
 		defer leechers[i].Close()
 		defer os.RemoveAll(tcfg.BaseDir)
 	}
@@ -182,7 +401,7 @@ func testDataTransfer(t *testing.T, opts dataTransferOpts) {
 			require.NoError(t, leecherTr.StartDataTransfer())
 			<-leecherTr.DownloadedDataC
 		}()
-		leecherTr.AddPeers(addrsToPeers(append(leechAddrs[i+1:], seeder.addr()))...)
+		leecherTr.AddPeers(addrsToPeers(append(leechAddrs[i+1:], opts.addr(seeder)))...)
 	}
 	/*ticker := time.NewTicker(time.Second)
 	for {
@@ -234,6 +453,8 @@ func testThirdPartyDataTransfer(t *testing.T, torrentFile string) {
 	cfg.NoDHT = true
 	cfg.Seed = true
 	cfg.DisablePEX = true
+	//the third party client may not release its default port immediately
+	cfg.ListenPort = 0
 	seeder, err := torrent.NewClient(cfg)
 	require.NoError(t, err)
 	defer seeder.Close()
@@ -246,6 +467,7 @@ func testThirdPartyDataTransfer(t *testing.T, torrentFile string) {
 	tcfg.BaseDir += "/leecher"
 	leecher, leecherTr := newClientWithTorrent(t, tcfg, torrentFile, nil)
 	defer os.RemoveAll(leecher.config.BaseDir)
+	defer leecher.Close()
 	leecherTr.AddPeers(addrToPeer(seeder.ListenAddrs()[0].String(), SourceUser))
 	leecherTr.StartDataTransfer()
 	<-leecherTr.DownloadedDataC
@@ -299,6 +521,10 @@ type httpAnnounceResponse struct {
 func (dt *dummyTracker) announceHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	e, ok := q["event"]
+	if ok && len(e) == 1 && e[0] == "stopped" {
+		//sent when the client closes
+		return
+	}
 	if ok {
 		assert.Len(dt.t, e, 1)
 		assert.EqualValues(dt.t, "started", e[0])
@@ -345,7 +571,8 @@ func TestTrackerAnnouncer(t *testing.T) {
 	dt.serve()
 	tr, err := cl.AddFromFile(helloWorldTorrentFile)
 	require.NoError(t, err)
-	tr.mi.Announce = dt.addr()
+	require.NoError(t, tr.RemoveTracker(tr.mi.Announce))
+	require.NoError(t, tr.AddTrackers([][]string{{dt.addr()}}))
 	tr.StartDataTransfer()
 	//we want to announce multiple times so sleep for a bit
 	time.Sleep(4 * time.Second)
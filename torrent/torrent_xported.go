@@ -55,11 +55,13 @@ func (t *Torrent) StartDataTransfer() error {
 	if !t.infoWasDownloaded() && len(t.conns) > 0 {
 		panic("why have conns?")
 	}
+	//enable even if we have all, we may lose pieces
+	t.pieces.setDownloadEnabled(true)
 	if !t.haveAll() {
 		//notify conns to start downloading
-		t.pieces.setDownloadEnabled(true)
 		t.broadcastToConns(requestsAvailable{})
 	}
+	t.reviewUploadOnly()
 	t.tryAnnounceAll()
 	t.dialConns()
 	return nil
@@ -115,10 +117,30 @@ func (t *Torrent) Stats() Stats {
 	l := t.newLocker()
 	l.lock()
 	defer l.unlock()
-	return t.stats
+	stats := t.stats
+	t.scrapes.fill(&stats)
+	return stats
 }
 
-//Pieces returns all pieces of the torrent. If Info is not available or t is closed it returns nil.
+//PeerConns returns the established connections of the torrent.
+func (t *Torrent) PeerConns() []PeerConn {
+	l := t.newLocker()
+	l.lock()
+	defer l.unlock()
+	ret := make([]PeerConn, len(t.conns))
+	for i, ci := range t.conns {
+		ret[i] = PeerConn{
+			Peer:      ci.peer,
+			Client:    ci.client,
+			Encrypted: ci.encrypted,
+			UTP:       ci.utp,
+		}
+		copy(ret[i].ID[:], ci.peerID)
+	}
+	return ret
+}
+
+//Pieces returns a snapshot of all pieces of the torrent. If Info is not available or t is closed it returns nil.
 func (t *Torrent) Pieces() []Piece {
 	l := t.newLocker()
 	l.lock()
@@ -132,6 +154,8 @@ func (t *Torrent) Pieces() []Piece {
 	ret := make([]Piece, len(p.pcs))
 	for i, piece := range p.pcs {
 		ret[i] = *piece
+		//the Torrent keeps appending to the original
+		ret[i].contributors = append([]*connInfo(nil), piece.contributors...)
 	}
 	return ret
 }
@@ -192,14 +216,12 @@ func (t *Torrent) setDataDownloadEnable(v bool) error {
 	if t.pieces == nil {
 		return errors.New("info required or torrent is closed")
 	}
-	p := t.pieces
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.setDownloadEnabled(v)
-	if p.downloadEnabled == v {
+	if t.pieces.isDownloadEnabled() == v {
 		return nil
 	}
-	p.downloadEnabled = v
+	t.pieces.setDownloadEnabled(v)
+	//while we don't want pieces we are a partial seed
+	t.reviewUploadOnly()
 	for _, c := range t.conns {
 		if v {
 			c.interested()
@@ -224,21 +246,29 @@ func (t *Torrent) Closed() bool {
 }
 
 //Close removes the torrent from the Client and closes all connections with peers.
-//Close is safe to be called multiple times on the same torrent.
+//Trackers are notified that we stopped, which may take up to
+//Config.TrackerStopTimeout. Close is safe to be called multiple times on the
+//same torrent.
 func (t *Torrent) Close() {
-	if err := t.closeWithLock(); err != nil {
+	stats, err := t.closeWithLock()
+	if err != nil {
 		return
 	}
 	t.cl.dropTorrent(t.mi.Info.Hash)
+	if t.cl.trackerAnnouncer != nil {
+		t.cl.trackerAnnouncer.stop(t, t.mi.Info.Hash, stats)
+	}
 }
 
-func (t *Torrent) closeWithLock() error {
+//closeWithLock closes t and returns its final stats
+func (t *Torrent) closeWithLock() (Stats, error) {
 	l := t.newLocker()
 	l.lock()
 	if l.closed {
-		return errTorrentClosed
+		return Stats{}, errTorrentClosed
 	}
 	defer l.unlock()
+	stats := t.stats
 	t.close()
-	return nil
+	return stats, nil
 }
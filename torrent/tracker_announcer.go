@@ -2,83 +2,442 @@ package torrent
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/lkslts64/charo-torrent/tracker"
 )
 
+const (
+	trackerAnnounceTimeout = 30 * time.Second
+	//used if Config.TrackerStopTimeout is zero
+	defaultTrackerStopTimeout = 5 * time.Second
+	//unreachable trackers are retried after trackerUnreachableRetry, doubled
+	//on every consecutive failure up to trackerMaxRetry
+	trackerUnreachableRetry = time.Minute
+	trackerMaxRetry         = time.Hour
+	//a tracker that refused our announce won't change its mind soon
+	trackerFailureRetry = 30 * time.Minute
+	//used if the tracker doesn't specify an interval
+	defaultTrackerInterval = 30 * time.Minute
+)
+
+//TrackerStatus is the status of a tracker that a Client announces to
+type TrackerStatus struct {
+	URL string
+	//when we last got a response or an error from the tracker
+	LastAnnounce time.Time
+	//when we will announce next, zero if nothing is scheduled
+	NextAnnounce time.Time
+	//the error of the last announce, nil if it succeeded
+	LastError error
+	//the number of peers the tracker returned in its last response
+	Peers int
+	//consecutive times we couldn't reach the tracker
+	Failures int
+	//The following are reported only by Torrent.Trackers
+	Tier     int
+	Seeders  int
+	Leechers int
+}
+
+//Trackers returns the status of every tracker the Client has announced to,
+//sorted by URL.
+func (cl *Client) Trackers() []TrackerStatus {
+	if cl.trackerAnnouncer == nil {
+		return nil
+	}
+	return cl.trackerAnnouncer.statuses()
+}
+
+//newTrackerURL returns the TrackerURL of url configured by the Client
+func (cl *Client) newTrackerURL(url string) (tracker.TrackerURL, error) {
+	httpClient := cl.config.TrackerHTTPClient
+	if httpClient == nil {
+		httpClient = cl.proxyHTTPClient
+	}
+	opts := []tracker.Option{tracker.WithHTTPClient(httpClient)}
+	if cl.proxy != nil {
+		opts = append(opts, tracker.WithDialer(cl.proxy))
+	}
+	if cl.config.TrackerUserAgent != "" {
+		opts = append(opts, tracker.WithUserAgent(cl.config.TrackerUserAgent))
+	}
+	return tracker.NewTrackerURL(url, opts...)
+}
+
+//trackerAnnouncer announces the Torrents of a Client to their trackers. Every
+//tracker has its own worker so a slow or dead tracker doesn't delay the
+//announces to the others.
 type trackerAnnouncer struct {
-	//Every trackerAnnouncer is associated with a Client - maybe not mandatory
-	cl *Client
-	//All Torrents send events to tracker via this chan
-	trackerAnnouncerSubmitEventCh chan trackerAnnouncerEvent
-	//the trackerURLs that we maintain
-	trackers map[string]*trackerURL
-	close    chan chan struct{}
-}
-
-//wrapper for tracker.TrackerURL
-type trackerURL struct {
-	tu           tracker.TrackerURL
+	cl      *Client
+	mu      sync.Mutex
+	workers map[string]*trackerWorker
+}
+
+func newTrackerAnnouncer(cl *Client) *trackerAnnouncer {
+	return &trackerAnnouncer{
+		cl:      cl,
+		workers: make(map[string]*trackerWorker),
+	}
+}
+
+//submit queues te for the tracker at url. It never blocks.
+func (ta *trackerAnnouncer) submit(url string, te trackerAnnouncerEvent) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	w, ok := ta.workers[url]
+	if !ok {
+		w = newTrackerWorker(ta, url)
+		ta.workers[url] = w
+		go w.run()
+	}
+	//under ta.mu so w isn't removed before it knows about te.t
+	w.submit(te)
+}
+
+//stop forgets the state of t at all trackers and announces Stopped with
+//the final stats to those that know about t. The announces are sent in
+//parallel and stop returns when all of them are done or after
+//Config.TrackerStopTimeout.
+func (ta *trackerAnnouncer) stop(t *Torrent, infoHash [20]byte, stats Stats) {
+	ta.mu.Lock()
+	var workers []*trackerWorker
+	for _, w := range ta.workers {
+		if w.remove(t) {
+			workers = append(workers, w)
+		}
+		ta.removeIfIdle(w)
+	}
+	ta.mu.Unlock()
+	ta.sendStopped(workers, infoHash, stats)
+}
+
+//stopTracker is like stop but only for the tracker at url
+func (ta *trackerAnnouncer) stopTracker(url string, t *Torrent, infoHash [20]byte, stats Stats) {
+	ta.mu.Lock()
+	var workers []*trackerWorker
+	if w, ok := ta.workers[url]; ok {
+		if w.remove(t) {
+			workers = append(workers, w)
+		}
+		ta.removeIfIdle(w)
+	}
+	ta.mu.Unlock()
+	ta.sendStopped(workers, infoHash, stats)
+}
+
+//removeIfIdle stops and removes w if it doesn't announce any Torrent.
+//ta.mu must be held.
+func (ta *trackerAnnouncer) removeIfIdle(w *trackerWorker) {
+	if !w.idle() {
+		return
+	}
+	delete(ta.workers, w.url)
+	close(w.quit)
+}
+
+func (ta *trackerAnnouncer) sendStopped(workers []*trackerWorker, infoHash [20]byte, stats Stats) {
+	if len(workers) == 0 {
+		return
+	}
+	timeout := ta.cl.config.TrackerStopTimeout
+	if timeout <= 0 {
+		timeout = defaultTrackerStopTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
+	for _, w := range workers {
+		go func(w *trackerWorker) {
+			defer wg.Done()
+			w.tu.Announce(ctx, w.announceReq(infoHash, tracker.Stopped, stats))
+		}(w)
+	}
+	wg.Wait()
+}
+
+//trackerURL returns the TrackerURL of the worker of url, if there is one
+func (ta *trackerAnnouncer) trackerURL(url string) (tracker.TrackerURL, bool) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	w, ok := ta.workers[url]
+	if !ok || w.urlErr != nil {
+		return nil, false
+	}
+	return w.tu, true
+}
+
+func (ta *trackerAnnouncer) statuses() []TrackerStatus {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ret := make([]TrackerStatus, 0, len(ta.workers))
+	for _, w := range ta.workers {
+		ret = append(ret, w.status())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].URL < ret[j].URL
+	})
+	return ret
+}
+
+//trackerWorker announces the Torrents of a tracker one at a time
+type trackerWorker struct {
+	ta  *trackerAnnouncer
+	url string
+	tu  tracker.TrackerURL
+	//not nil if url is invalid
+	urlErr error
+	wake   chan struct{}
+	//closed when the worker is removed
+	quit chan struct{}
+	mu   sync.Mutex
+	//the Torrents that announce to this tracker
+	torrents map[*Torrent]*trackerTorrent
+	failures int
+	//we don't contact the tracker until then because it was unreachable
+	retryAt      time.Time
+	lastAnnounce time.Time
+	lastErr      error
+	lastPeers    int
+}
+
+//the state of a Torrent at a tracker
+type trackerTorrent struct {
 	numAnnounces int
+	lastAnnounce time.Time
+	minInterval  time.Duration
+	//when we announce next
+	next time.Time
+	//the announce we have to send, nil if none
+	pending *trackerAnnouncerEvent
 }
 
-func newTrackerURL(url string) (*trackerURL, error) {
-	tu, err := tracker.NewTrackerURL(url)
-	if err != nil {
-		return nil, err
+func newTrackerWorker(ta *trackerAnnouncer, url string) *trackerWorker {
+	w := &trackerWorker{
+		ta:       ta,
+		url:      url,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		torrents: make(map[*Torrent]*trackerTorrent),
 	}
-	return &trackerURL{
-		tu: tu,
-	}, nil
+	w.tu, w.urlErr = ta.cl.newTrackerURL(url)
+	return w
 }
 
-func (tu *trackerURL) Announce(ctx context.Context, req tracker.AnnounceReq) (*tracker.AnnounceResp, error) {
-	if req.Event == tracker.None && tu.numAnnounces == 0 {
-		req.Event = tracker.Started
+func (w *trackerWorker) submit(te trackerAnnouncerEvent) {
+	w.mu.Lock()
+	tt, ok := w.torrents[te.t]
+	if !ok {
+		tt = new(trackerTorrent)
+		w.torrents[te.t] = tt
+	}
+	due := time.Now()
+	if te.event == tracker.None {
+		//regular announces honor the min interval of the tracker
+		if earliest := tt.lastAnnounce.Add(tt.minInterval); earliest.After(due) {
+			due = earliest
+		}
+		//don't lose an event we haven't sent yet
+		if tt.pending != nil {
+			te.event = tt.pending.event
+		}
+	}
+	tt.pending = &te
+	tt.next = due
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
 	}
-	tu.numAnnounces++
-	return tu.tu.Announce(ctx, req)
 }
 
-//The logic is simple but if we start supporting AnnounceList extension then it 'll be more
-//interesting.
-func (t *trackerAnnouncer) run() {
+//remove forgets the state of t and reports whether the tracker has ever
+//responded to an announce of t
+func (w *trackerWorker) remove(t *Torrent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	tt, ok := w.torrents[t]
+	if !ok {
+		return false
+	}
+	delete(w.torrents, t)
+	return w.urlErr == nil && tt.numAnnounces > 0
+}
+
+func (w *trackerWorker) idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.torrents) == 0
+}
+
+func (w *trackerWorker) run() {
+	timer := newExpiredTimer()
+	defer timer.Stop()
 	for {
-		select {
-		case te := <-t.trackerAnnouncerSubmitEventCh:
-			resp, err := t.announce(te)
-			te.t.trackerAnnouncerResponseC <- trackerAnnouncerResponse{
-				resp: resp,
-				err:  err,
+		te, wait := w.nextEvent(time.Now())
+		if te != nil {
+			w.announce(*te)
+			continue
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
-		case <-t.cl.close:
-			//TODO:send stopped msgs to trackers?
+		}
+		if wait >= 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-w.wake:
+		case <-timer.C:
+		case <-w.quit:
+			return
+		case <-w.ta.cl.close:
 			return
 		}
 	}
 }
 
-func (t *trackerAnnouncer) announce(te trackerAnnouncerEvent) (*tracker.AnnounceResp, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+//nextEvent returns the event we should announce now. Otherwise, it returns
+//how long we should wait for the next one, -1 if there isn't any.
+func (w *trackerWorker) nextEvent(now time.Time) (*trackerAnnouncerEvent, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var next *trackerTorrent
+	for _, tt := range w.torrents {
+		if tt.pending != nil && (next == nil || tt.next.Before(next.next)) {
+			next = tt
+		}
+	}
+	if next == nil {
+		return nil, -1
+	}
+	due := next.next
+	if w.retryAt.After(due) {
+		due = w.retryAt
+	}
+	if due.After(now) {
+		return nil, due.Sub(now)
+	}
+	te := next.pending
+	next.pending = nil
+	if te.event == tracker.None && next.numAnnounces == 0 {
+		te.event = tracker.Started
+	}
+	return te, 0
+}
+
+func (w *trackerWorker) announce(te trackerAnnouncerEvent) {
+	var resp *tracker.AnnounceResp
+	err := w.urlErr
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), trackerAnnounceTimeout)
+		resp, err = w.tu.Announce(ctx, w.announceReq(te.infoHash, te.event, te.stats))
+		cancel()
+	}
+	next := w.announced(te.t, resp, err, time.Now())
+	select {
+	case te.respC <- trackerAnnouncerResponse{
+		url:  w.url,
+		resp: resp,
+		err:  err,
+		next: next,
+	}:
+	case <-te.closed:
+	case <-w.ta.cl.close:
+	}
+}
+
+func (w *trackerWorker) announceReq(infoHash [20]byte, event tracker.Event, stats Stats) tracker.AnnounceReq {
 	req := tracker.AnnounceReq{
-		InfoHash:   te.t.mi.Info.Hash,
-		PeerID:     t.cl.peerID,
-		Downloaded: int64(te.stats.BytesDownloaded),
-		Left:       int64(te.stats.BytesLeft),
-		Uploaded:   int64(te.stats.BytesUploaded),
-		Event:      te.event,
+		InfoHash:   infoHash,
+		PeerID:     w.ta.cl.peerID,
+		Downloaded: int64(stats.BytesDownloaded),
+		Left:       int64(stats.BytesLeft),
+		Uploaded:   int64(stats.BytesUploaded),
+		Event:      event,
+		Key:        w.ta.cl.trackerKey,
 		Numwant:    200,
-		Port:       int16(t.cl.port),
+		Port:       int16(w.ta.cl.port),
+	}
+	//trackers use the source address otherwise, which may be wrong if we
+	//reach them through a proxy
+	if ipv4, _ := w.ta.cl.ExternalIPs(); ipv4 != nil {
+		req.IP = int32(binary.BigEndian.Uint32(ipv4.To4()))
+	}
+	if event == tracker.Stopped {
+		//we don't want any peers
+		req.Numwant = 0
 	}
-	url := te.t.mi.Announce
-	if _, ok := t.trackers[url]; !ok {
-		trackerURL, err := newTrackerURL(url)
-		if err != nil {
-			return nil, err
+	return req
+}
+
+//announced updates the state of the tracker and t with the result of an
+//announce and returns when t should announce again
+func (w *trackerWorker) announced(t *Torrent, resp *tracker.AnnounceResp, err error, now time.Time) (next time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	tt, ok := w.torrents[t]
+	if !ok {
+		//t was closed while we were announcing
+		tt = new(trackerTorrent)
+	}
+	w.lastAnnounce = now
+	w.lastErr = err
+	var failure *tracker.FailureError
+	switch {
+	//resp may come with a warning
+	case resp != nil:
+		w.failures = 0
+		w.retryAt = time.Time{}
+		w.lastPeers = len(resp.Peers)
+		tt.numAnnounces++
+		tt.lastAnnounce = now
+		tt.minInterval = time.Duration(resp.MinInterval) * time.Second
+		next = time.Duration(resp.Interval) * time.Second
+		if next <= 0 {
+			next = defaultTrackerInterval
+		}
+	case errors.As(err, &failure):
+		//the tracker is reachable, it just doesn't like this announce
+		w.failures = 0
+		w.retryAt = time.Time{}
+		next = trackerFailureRetry
+	default:
+		w.failures++
+		next = trackerUnreachableRetry << uint(w.failures-1)
+		if next > trackerMaxRetry || next <= 0 {
+			next = trackerMaxRetry
+		}
+		w.retryAt = now.Add(next)
+	}
+	tt.next = now.Add(next)
+	return
+}
+
+func (w *trackerWorker) status() TrackerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := TrackerStatus{
+		URL:          w.url,
+		LastAnnounce: w.lastAnnounce,
+		LastError:    w.lastErr,
+		Peers:        w.lastPeers,
+		Failures:     w.failures,
+	}
+	for _, tt := range w.torrents {
+		if !tt.next.IsZero() && (st.NextAnnounce.IsZero() || tt.next.Before(st.NextAnnounce)) {
+			st.NextAnnounce = tt.next
 		}
-		t.trackers[url] = trackerURL
 	}
-	return t.trackers[url].Announce(ctx, req)
+	if !st.NextAnnounce.IsZero() && w.retryAt.After(st.NextAnnounce) {
+		st.NextAnnounce = w.retryAt
+	}
+	return st
 }
@@ -0,0 +1,201 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTrackerEvent(ih byte, event tracker.Event) trackerAnnouncerEvent {
+	return trackerAnnouncerEvent{
+		t:        &Torrent{},
+		infoHash: [20]byte{ih},
+		event:    event,
+		respC:    make(chan trackerAnnouncerResponse, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func serveTestTracker(t *testing.T, cfg *tracker.ServerConfig) (*tracker.Server, string) {
+	s := tracker.NewServer(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	return s, "http://" + l.Addr().String() + "/announce"
+}
+
+func TestTrackerAnnouncerConcurrent(t *testing.T) {
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ta := newTrackerAnnouncer(cl)
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+	s, fast := serveTestTracker(t, nil)
+	defer s.Close()
+	ta.submit(slow.URL+"/announce", testTrackerEvent(1, tracker.None))
+	te := testTrackerEvent(2, tracker.None)
+	ta.submit(fast, te)
+	select {
+	case resp := <-te.respC:
+		require.NoError(t, resp.err)
+		assert.Equal(t, fast, resp.url)
+		assert.Equal(t, 30*time.Minute, resp.next)
+		assert.EqualValues(t, 1, resp.resp.Seeders)
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow tracker delayed the announce to the fast one")
+	}
+	statuses := cl.Trackers()
+	assert.Empty(t, statuses)
+	cl.trackerAnnouncer = ta
+	statuses = cl.Trackers()
+	require.Len(t, statuses, 2)
+	st := statuses[0]
+	if st.URL != fast {
+		st = statuses[1]
+	}
+	assert.NoError(t, st.LastError)
+	assert.Equal(t, 0, st.Failures)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), st.NextAnnounce, time.Minute)
+}
+
+func TestTrackerAnnouncerBackoff(t *testing.T) {
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ta := newTrackerAnnouncer(cl)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	url := "http://" + l.Addr().String() + "/announce"
+	te := testTrackerEvent(1, tracker.None)
+	ta.submit(url, te)
+	resp := <-te.respC
+	assert.True(t, errors.Is(resp.err, tracker.ErrConnRefused))
+	assert.Equal(t, trackerUnreachableRetry, resp.next)
+	w := ta.workers[url]
+	st := w.status()
+	assert.Equal(t, 1, st.Failures)
+	//other torrents wait for the tracker too
+	other := testTrackerEvent(2, tracker.Completed)
+	w.submit(other)
+	now := time.Now()
+	ev, wait := w.nextEvent(now)
+	assert.Nil(t, ev)
+	assert.InDelta(t, float64(trackerUnreachableRetry), float64(wait), float64(time.Second))
+	assert.Equal(t, 2*trackerUnreachableRetry, w.announced(te.t, nil, resp.err, now))
+	for i := 0; i < 10; i++ {
+		w.announced(te.t, nil, resp.err, now)
+	}
+	assert.Equal(t, trackerMaxRetry, w.announced(te.t, nil, resp.err, now))
+	//failures don't make us back off from the whole tracker
+	assert.Equal(t, trackerFailureRetry, w.announced(te.t, nil, &tracker.FailureError{Reason: "unregistered torrent"}, now))
+	assert.Equal(t, 0, w.status().Failures)
+	ev, _ = w.nextEvent(now)
+	require.NotNil(t, ev)
+	assert.Equal(t, tracker.Completed, ev.event)
+}
+
+func TestTrackerAnnouncerMinInterval(t *testing.T) {
+	cl, err := NewClient(testingConfig())
+	require.NoError(t, err)
+	defer cl.Close()
+	ta := newTrackerAnnouncer(cl)
+	url := "http://tracker.invalid/announce"
+	w := newTrackerWorker(ta, url)
+	te := testTrackerEvent(1, tracker.None)
+	w.submit(te)
+	now := time.Now()
+	ev, _ := w.nextEvent(now)
+	require.NotNil(t, ev)
+	//first announce
+	assert.Equal(t, tracker.Started, ev.event)
+	assert.Equal(t, 10*time.Minute, w.announced(te.t, &tracker.AnnounceResp{
+		Interval:    600,
+		MinInterval: 300,
+		Peers:       make([]tracker.Peer, 3),
+	}, nil, now))
+	assert.Equal(t, 3, w.status().Peers)
+	w.submit(te)
+	ev, wait := w.nextEvent(time.Now())
+	assert.Nil(t, ev)
+	assert.InDelta(t, float64(5*time.Minute), float64(wait), float64(time.Second))
+	//events aren't delayed and they aren't lost by later regular announces
+	te.event = tracker.Completed
+	w.submit(te)
+	te.event = tracker.None
+	w.submit(te)
+	ev, _ = w.nextEvent(time.Now().Add(5 * time.Minute))
+	require.NotNil(t, ev)
+	assert.Equal(t, tracker.Completed, ev.event)
+}
+
+func TestTrackerAnnouncerStop(t *testing.T) {
+	cfg := testingConfig()
+	cfg.TrackerStopTimeout = 100 * time.Millisecond
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	ta := newTrackerAnnouncer(cl)
+	s, url := serveTestTracker(t, nil)
+	defer s.Close()
+	te := testTrackerEvent(1, tracker.None)
+	ta.submit(url, te)
+	resp := <-te.respC
+	require.NoError(t, resp.err)
+	require.Equal(t, int32(1), s.Torrents()[te.infoHash].Seeders)
+	ta.stop(te.t, te.infoHash, Stats{})
+	assert.EqualValues(t, 0, s.Torrents()[te.infoHash].Seeders)
+	//the tracker has no torrents left
+	assert.NotContains(t, ta.workers, url)
+	//torrents that never announced don't send Stopped
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+	te = testTrackerEvent(2, tracker.None)
+	w := newTrackerWorker(ta, slow.URL+"/announce")
+	ta.workers[w.url] = w
+	w.submit(te)
+	assert.False(t, w.remove(te.t))
+	//an unresponsive tracker doesn't delay the close for long
+	w.submit(te)
+	w.announced(te.t, &tracker.AnnounceResp{}, nil, time.Now())
+	start := time.Now()
+	ta.stop(te.t, te.infoHash, Stats{})
+	assert.WithinDuration(t, start.Add(cfg.TrackerStopTimeout), time.Now(), 500*time.Millisecond)
+}
+
+func TestTrackerHTTPClient(t *testing.T) {
+	uaC := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uaC <- r.Header.Get("User-Agent")
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer srv.Close()
+	cfg := testingConfig()
+	cfg.TrackerHTTPClient = srv.Client()
+	cfg.TrackerUserAgent = "test/1.0"
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	ta := newTrackerAnnouncer(cl)
+	te := testTrackerEvent(1, tracker.None)
+	ta.submit(srv.URL+"/announce", te)
+	resp := <-te.respC
+	require.NoError(t, resp.err)
+	assert.Equal(t, "test/1.0", <-uaC)
+}
@@ -0,0 +1,222 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/metainfo"
+	"github.com/lkslts64/charo-torrent/tracker"
+)
+
+//torrentTracker is the state of a Torrent at one of its trackers
+type torrentTracker struct {
+	url  string
+	tier int
+	//whether we wait for the response of an announce
+	announcing   bool
+	lastAnnounce time.Time
+	//when we should announce next, zero if we never announced
+	next     time.Time
+	lastErr  error
+	peers    int
+	failures int
+	seeders  int
+	leechers int
+}
+
+func (tr *torrentTracker) announced(tresp trackerAnnouncerResponse, now time.Time) {
+	tr.announcing = false
+	tr.lastAnnounce = now
+	tr.lastErr = tresp.err
+	tr.next = now.Add(tresp.next)
+	var failure *tracker.FailureError
+	switch {
+	case tresp.resp != nil:
+		tr.failures = 0
+		tr.peers = len(tresp.resp.Peers)
+		tr.seeders = int(tresp.resp.Seeders)
+		tr.leechers = int(tresp.resp.Leechers)
+	case errors.As(tresp.err, &failure):
+		tr.failures = 0
+	default:
+		tr.failures++
+	}
+}
+
+//metainfoTrackers returns the tiers of trackers of mi. The announce-list
+//takes precedence over announce (BEP 12).
+func metainfoTrackers(mi *metainfo.MetaInfo) [][]string {
+	if len(mi.AnnounceList) > 0 {
+		return mi.AnnounceList
+	}
+	if mi.Announce != "" {
+		return [][]string{{mi.Announce}}
+	}
+	return nil
+}
+
+//addTrackers adds the trackers of the i-th tier of announceList to the i-th
+//tier of t. Trackers that t already has are ignored.
+func (t *Torrent) addTrackers(announceList [][]string) {
+	for tier, urls := range announceList {
+		for _, url := range urls {
+			if url == "" || t.tracker(url) != nil {
+				continue
+			}
+			t.trackers = append(t.trackers, &torrentTracker{
+				url:  url,
+				tier: tier,
+			})
+		}
+	}
+	sort.SliceStable(t.trackers, func(i, j int) bool {
+		return t.trackers[i].tier < t.trackers[j].tier
+	})
+}
+
+func (t *Torrent) tracker(url string) *torrentTracker {
+	for _, tr := range t.trackers {
+		if tr.url == url {
+			return tr
+		}
+	}
+	return nil
+}
+
+func (t *Torrent) submitAnnounce(tr *torrentTracker, event tracker.Event) {
+	t.cl.trackerAnnouncer.submit(tr.url, trackerAnnouncerEvent{
+		t:        t,
+		infoHash: t.mi.Info.Hash,
+		event:    event,
+		stats:    t.stats,
+		respC:    t.trackerAnnouncerResponseC,
+		closed:   t.ClosedC,
+	})
+	tr.announcing = true
+	t.numTrackerAnnouncesSend++
+}
+
+//scheduleTrackerAnnounce sets the tracker timer to fire when the first
+//tracker we don't wait for is due
+func (t *Torrent) scheduleTrackerAnnounce() {
+	var next *torrentTracker
+	for _, tr := range t.trackers {
+		if !tr.announcing && (next == nil || tr.next.Before(next.next)) {
+			next = tr
+		}
+	}
+	if next == nil {
+		t.trackerAnnouncerTimer.Stop()
+		return
+	}
+	wait := time.Until(next.next)
+	if wait < 0 {
+		wait = 0
+	}
+	t.resetNextTrackerAnnounce(wait)
+}
+
+//AddTrackers adds the trackers of the i-th tier of announceList to the i-th
+//tier of the Torrent. The Torrent announces to all of its trackers, tiers
+//only order them. Trackers that the Torrent already has are ignored.
+func (t *Torrent) AddTrackers(announceList [][]string) error {
+	for _, urls := range announceList {
+		for _, url := range urls {
+			if _, err := tracker.NewTrackerURL(url); err != nil {
+				return fmt.Errorf("tracker %s: %w", url, err)
+			}
+		}
+	}
+	l := t.newLocker()
+	if l.lock(); l.closed {
+		return errTorrentClosed
+	}
+	defer l.unlock()
+	t.addTrackers(announceList)
+	//announce to the new trackers
+	t.scheduleTrackerAnnounce()
+	return nil
+}
+
+//RemoveTracker removes the tracker with url from the Torrent. If the tracker
+//knows about the Torrent, it is notified that we stopped, which may take up
+//to Config.TrackerStopTimeout.
+func (t *Torrent) RemoveTracker(url string) error {
+	stats, err := t.removeTrackerWithLock(url)
+	if err != nil {
+		return err
+	}
+	t.scrapes.remove(url)
+	if t.cl.trackerAnnouncer != nil {
+		t.cl.trackerAnnouncer.stopTracker(url, t, t.mi.Info.Hash, stats)
+	}
+	return nil
+}
+
+func (t *Torrent) removeTrackerWithLock(url string) (Stats, error) {
+	l := t.newLocker()
+	if l.lock(); l.closed {
+		return Stats{}, errTorrentClosed
+	}
+	defer l.unlock()
+	for i, tr := range t.trackers {
+		if tr.url == url {
+			t.trackers = append(t.trackers[:i], t.trackers[i+1:]...)
+			t.scheduleTrackerAnnounce()
+			return t.stats, nil
+		}
+	}
+	return Stats{}, errors.New("unknown tracker")
+}
+
+//Trackers returns the status of every tracker of the Torrent, ordered by
+//tier. The swarm is the one reported by the latest announce or scrape.
+func (t *Torrent) Trackers() []TrackerStatus {
+	l := t.newLocker()
+	if l.lock(); l.closed {
+		return nil
+	}
+	defer l.unlock()
+	ret := make([]TrackerStatus, len(t.trackers))
+	for i, tr := range t.trackers {
+		ret[i] = TrackerStatus{
+			URL:          tr.url,
+			Tier:         tr.tier,
+			LastAnnounce: tr.lastAnnounce,
+			LastError:    tr.lastErr,
+			Peers:        tr.peers,
+			Failures:     tr.failures,
+			Seeders:      tr.seeders,
+			Leechers:     tr.leechers,
+		}
+		if !tr.announcing {
+			ret[i].NextAnnounce = tr.next
+		}
+		if s, ok := t.scrapes.get(tr.url); ok && s.Time.After(tr.lastAnnounce) {
+			ret[i].Seeders, ret[i].Leechers = s.Seeders, s.Leechers
+		}
+	}
+	return ret
+}
+
+//ForceReannounce announces the Torrent to all of its trackers now, without
+//waiting for their interval. Trackers that asked for a minimum interval
+//between announces are contacted when it elapses.
+func (t *Torrent) ForceReannounce() error {
+	if t.cl.config.DisableTrackers || t.cl.trackerAnnouncer == nil {
+		return errTrackersDisabled
+	}
+	l := t.newLocker()
+	if l.lock(); l.closed {
+		return errTorrentClosed
+	}
+	defer l.unlock()
+	for _, tr := range t.trackers {
+		t.submitAnnounce(tr, tracker.None)
+	}
+	t.canAnnounceTracker = false
+	t.scheduleTrackerAnnounce()
+	return nil
+}
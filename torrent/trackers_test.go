@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/metainfo"
+	"github.com/lkslts64/charo-torrent/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetainfoTrackers(t *testing.T) {
+	mi := &metainfo.MetaInfo{Announce: "udp://a"}
+	assert.Equal(t, [][]string{{"udp://a"}}, metainfoTrackers(mi))
+	mi.AnnounceList = [][]string{{"udp://b", "udp://c"}, {"udp://a"}}
+	assert.Equal(t, mi.AnnounceList, metainfoTrackers(mi))
+	assert.Nil(t, metainfoTrackers(&metainfo.MetaInfo{}))
+}
+
+func TestTorrentTrackers(t *testing.T) {
+	var mu sync.Mutex
+	var announces int
+	scfg := tracker.DefaultServerConfig()
+	scfg.Allow = func(r *tracker.ServerRequest) error {
+		if !r.Scrape {
+			mu.Lock()
+			defer mu.Unlock()
+			announces++
+		}
+		return nil
+	}
+	s := tracker.NewServer(scfg)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeUDP(pc)
+	good := "udp://" + pc.LocalAddr().String()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	bad := "http://" + l.Addr().String() + "/announce"
+	numAnnounces := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return announces
+	}
+
+	cfg := testingConfig()
+	cfg.DisableTrackers = false
+	cl, tr := newClientWithTorrent(t, cfg, helloWorldTorrentFile, nil)
+	defer cl.Close()
+	trackers := tr.Trackers()
+	require.Len(t, trackers, 1)
+	assert.Equal(t, tr.mi.Announce, trackers[0].URL)
+	require.NoError(t, tr.RemoveTracker(tr.mi.Announce))
+	assert.Error(t, tr.RemoveTracker(tr.mi.Announce))
+	assert.Error(t, tr.AddTrackers([][]string{{"ftp://tracker"}}))
+	assert.Empty(t, tr.Trackers())
+	//tiers are kept in order and duplicates are ignored
+	require.NoError(t, tr.AddTrackers([][]string{{good}, {bad, good}}))
+	require.NoError(t, tr.StartDataTransfer())
+	require.Eventually(t, func() bool {
+		trackers = tr.Trackers()
+		return !trackers[0].LastAnnounce.IsZero() && !trackers[1].LastAnnounce.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, trackers, 2)
+	st := trackers[0]
+	assert.Equal(t, good, st.URL)
+	assert.Equal(t, 0, st.Tier)
+	assert.NoError(t, st.LastError)
+	assert.Equal(t, 1, st.Seeders)
+	assert.Equal(t, 0, st.Leechers)
+	assert.WithinDuration(t, time.Now().Add(scfg.Interval), st.NextAnnounce, time.Minute)
+	st = trackers[1]
+	assert.Equal(t, bad, st.URL)
+	assert.Equal(t, 1, st.Tier)
+	assert.Error(t, st.LastError)
+	assert.Equal(t, 1, st.Failures)
+	assert.WithinDuration(t, time.Now().Add(trackerUnreachableRetry), st.NextAnnounce, time.Minute)
+	assert.Equal(t, 1, numAnnounces())
+
+	require.NoError(t, tr.ForceReannounce())
+	require.Eventually(t, func() bool {
+		return numAnnounces() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//the tracker is told that we stopped
+	require.NoError(t, tr.RemoveTracker(good))
+	assert.Equal(t, 3, numAnnounces())
+	assert.Equal(t, tracker.TorrentInfo{}, s.Torrents()[tr.mi.Info.Hash])
+	trackers = tr.Trackers()
+	require.Len(t, trackers, 1)
+	assert.Equal(t, bad, trackers[0].URL)
+}
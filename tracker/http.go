@@ -1,9 +1,12 @@
 package tracker
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -16,30 +19,29 @@ import (
 type httpAnnounceResponse struct {
 	Fail        string     `bencode:"failure reason" empty:"omit"`
 	Warning     string     `bencode:"warning message" empty:"omit"`
-	Interval    int32      `bencode:"interval"`
+	Interval    int32      `bencode:"interval" empty:"omit"`
 	MinInterval int32      `bencode:"min interval" empty:"omit"`
 	TrackerID   []byte     `bencode:"tracker id" empty:"omit"`
 	Complete    int32      `bencode:"complete" empty:"omit"`
 	Incomplete  int32      `bencode:"incomplete" empty:"omit"`
 	Peers       []Peer     `bencode:"peers" empty:"omit"`
 	CheapPeers  cheapPeers `bencode:"peers" empty:"omit"`
+	//BEP 7
+	CheapPeers6 cheapPeers6 `bencode:"peers6" empty:"omit"`
+	//BEP 24
+	ExternalIP []byte `bencode:"external ip" empty:"omit"`
 }
 
 //Parse checks if the tracker's response contained
 //any errors or if it's valid. If CheapPeers is set,
 //then Peers struct is filled with the data from
 //CheapPeers.So, at the end, Peers field shall not be
-//empty.
+//empty. A *WarningError is returned if the response
+//is valid but has a warning.
 func (r *httpAnnounceResponse) parse() error {
 	var err error
 	if r.Fail != "" {
-		return fmt.Errorf("tracker response fail: %w", errors.New(r.Fail))
-	}
-	if r.Warning != "" {
-		return fmt.Errorf("tracker response warning: %w", errors.New(r.Warning))
-		//err = fmt.Errorf("tracker warning: %w", errors.New(r.Warning))
-		//TODO: Create a warning message - caller should be able to determine if err is warining.
-		//or Println the warning.
+		return &FailureError{r.Fail}
 	}
 	if r.Peers != nil {
 		var ip net.IP
@@ -57,20 +59,37 @@ func (r *httpAnnounceResponse) parse() error {
 				r.Peers[i].IP = ip
 			}
 		}
-	} else if r.CheapPeers != nil {
+	} else if r.CheapPeers != nil || r.CheapPeers6 != nil {
 		r.Peers, err = r.CheapPeers.peers()
 		if err != nil {
 			return err
 		}
+		peers6, err := r.CheapPeers6.peers()
+		if err != nil {
+			return err
+		}
+		r.Peers = append(r.Peers, peers6...)
 	} else {
-		return errors.New("Both Peers and CheapPeers fields are empty")
+		return errors.New("Peers, CheapPeers and CheapPeers6 fields are all empty")
 	}
-	//err may only be nil or warning
-	return err
+	if r.Warning != "" {
+		return &WarningError{r.Warning}
+	}
+	return nil
 }
 
 func (r *httpAnnounceResponse) announceResp() *AnnounceResp {
-	return &AnnounceResp{r.Interval, r.Incomplete, r.Complete, r.Peers, r.MinInterval}
+	resp := &AnnounceResp{
+		Interval:    r.Interval,
+		Leechers:    r.Incomplete,
+		Seeders:     r.Complete,
+		Peers:       r.Peers,
+		MinInterval: r.MinInterval,
+	}
+	if len(r.ExternalIP) == net.IPv4len || len(r.ExternalIP) == net.IPv6len {
+		resp.ExternalIP = net.IP(r.ExternalIP)
+	}
+	return resp
 }
 
 var events = map[Event]string{
@@ -81,20 +100,20 @@ var events = map[Event]string{
 
 func (t *HTTPTrackerURL) Announce(ctx context.Context, r AnnounceReq) (*AnnounceResp, error) {
 	HTTPresp, err := t.announce(ctx, r)
-	if err != nil {
-		return nil, fmt.Errorf("http announce: %w", err)
+	if HTTPresp == nil {
+		return nil, fmt.Errorf("http announce: %w", netErr(err))
 	}
-	//assign trackerID if its the first time we get it - it was nil before,
-	//OR if we already have it and we got a different one from HTTPresponse.
-	if id := HTTPresp.TrackerID; id != nil && (t.id == nil || t.id != nil && string(id) != string(t.id)) {
+	//keep the latest tracker id the tracker gave us
+	if id := HTTPresp.TrackerID; id != nil {
+		t.mu.Lock()
 		t.id = id
+		t.mu.Unlock()
 	}
-	return HTTPresp.announceResp(), nil
+	//err may only be nil or a warning
+	return HTTPresp.announceResp(), err
 }
 
 func (t *HTTPTrackerURL) announce(ctx context.Context, r AnnounceReq) (*httpAnnounceResponse, error) {
-	//maybe I can make a simple http.Get but leave this here for now.
-	//--------------------------------
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -102,32 +121,53 @@ func (t *HTTPTrackerURL) announce(ctx context.Context, r AnnounceReq) (*httpAnno
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	t.mu.Lock()
+	if t.id != nil {
+		u.RawQuery += "&trackerid=" + url.QueryEscape(string(t.id))
+	}
+	t.mu.Unlock()
+	benData, err := t.get(ctx, u)
 	if err != nil {
 		return nil, err
 	}
-	client := http.Client{}
-	resp, err := client.Do(req)
+	var res httpAnnounceResponse
+	err = bencode.Decode(benData, &res)
 	if err != nil {
 		return nil, err
 	}
-	//--------------------------------
-	benData, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
+	var warning *WarningError
+	err = res.parse()
+	if err != nil && !errors.As(err, &warning) {
 		return nil, err
 	}
-	var res httpAnnounceResponse
-	err = bencode.Decode(benData, &res)
+	//HTTP tracker should fil TrackerID field afther return of this func.
+	return &res, err
+}
+
+//get returns the body of the response to a GET request at u. We ask for
+//gzip ourselves so responses are decompressed whatever the RoundTripper is.
+func (t *HTTPTrackerURL) get(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	err = res.parse()
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := t.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	//HTTP tracker should fil TrackerID field afther return of this func.
-	return &res, nil
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+	return ioutil.ReadAll(body)
 }
 
 func (r AnnounceReq) buildURL(turl trackerURL) (*url.URL, error) {
@@ -143,7 +183,7 @@ func (r AnnounceReq) queryValues() string {
 	v := url.Values{}
 	v.Set("info_hash", string(r.InfoHash[:]))
 	v.Set("peer_id", string(r.PeerID[:]))
-	v.Set("port", strconv.Itoa(int(r.Port)))
+	v.Set("port", strconv.Itoa(int(uint16(r.Port))))
 	v.Set("uploaded", strconv.Itoa(int(r.Uploaded)))
 	v.Set("downloaded", strconv.Itoa(int(r.Downloaded)))
 	v.Set("left", strconv.Itoa(int(r.Left)))
@@ -158,20 +198,25 @@ func (r AnnounceReq) queryValues() string {
 	if r.Key != 0 {
 		v.Set("key", strconv.Itoa(int(r.Key)))
 	}
+	if r.IP != 0 {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(r.IP))
+		v.Set("ip", ip.String())
+	}
 	return v.Encode()
 }
 
 //Same as ScrapeResp but with the addition of Fail.
 type httpScrapeResp struct {
 	//TODO:string -> [20]byte (must support byte arrays in bencode)
-	Files map[string]TorrentInfo `bencode:"files"`
-	Fail  string                 `bencode:"failure_reason" empty:"omit"`
+	Files map[string]TorrentInfo `bencode:"files" empty:"omit"`
+	Fail  string                 `bencode:"failure reason" empty:"omit"`
 }
 
 func (t *HTTPTrackerURL) Scrape(ctx context.Context, infos ...[20]byte) (*ScrapeResp, error) {
 	HTTPresp, err := t.scrape(ctx, infos...)
 	if err != nil {
-		return nil, fmt.Errorf("http scrape: %w", err)
+		return nil, fmt.Errorf("http scrape: %w", netErr(err))
 	}
 	return HTTPresp.scrapeResponse(), nil
 }
@@ -179,7 +224,7 @@ func (t *HTTPTrackerURL) Scrape(ctx context.Context, infos ...[20]byte) (*Scrape
 func (t *HTTPTrackerURL) scrape(ctx context.Context, infoHashes ...[20]byte) (*httpScrapeResp, error) {
 	var s string
 	if s = t.url.ScrapeURL(); s == "" {
-		//return
+		return nil, ErrScrapeUnsupported
 	}
 	u, err := url.Parse(string(s))
 	if err != nil {
@@ -187,23 +232,13 @@ func (t *HTTPTrackerURL) scrape(ctx context.Context, infoHashes ...[20]byte) (*h
 	}
 	v := url.Values{}
 	for _, info := range infoHashes {
-		v.Set("info_hash", string(info[:]))
+		v.Add("info_hash", string(info[:]))
 	}
 	u.RawQuery = v.Encode()
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	benData, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	benData, err := t.get(ctx, u)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +255,7 @@ func (t *HTTPTrackerURL) scrape(ctx context.Context, infoHashes ...[20]byte) (*h
 
 func (sr *httpScrapeResp) parse() error {
 	if sr.Fail != "" {
-		return errors.New("tracker responsed with failure reason: " + sr.Fail)
+		return &FailureError{sr.Fail}
 	}
 	for ihash := range sr.Files {
 		if len(ihash) != 20 {
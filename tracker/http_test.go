@@ -1,13 +1,18 @@
 package tracker
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	_ "fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/lkslts64/charo-torrent/bencode"
 	"github.com/stretchr/testify/assert"
@@ -38,6 +43,11 @@ func TestHTTPURL(t *testing.T) {
 	u, err = reqs[1].buildURL(tracker.url)
 	require.NoError(t, err)
 	assert.EqualValues(t, "http://lol.omg.tracker/announce?compact=1&downloaded=6894&info_hash=%2F%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&left=43242&no_peer_id=1&peer_id=%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&port=6981&uploaded=8908090", u.String())
+	req := reqs[1]
+	req.IP = 0x01020304
+	u, err = req.buildURL(tracker.url)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", u.Query().Get("ip"))
 }
 
 func TestDecodeHTTPResponsePeerDicts(t *testing.T) {
@@ -76,6 +86,29 @@ func TestDecodeHttpResponseCheapPeers(t *testing.T) {
 	assert.EqualValues(t, net.IPv4(1, 2, 3, 4).To16(), resp.Peers[0].IP)
 }
 
+func TestDecodeHttpResponseExternalIP(t *testing.T) {
+	var resp httpAnnounceResponse
+	require.NoError(t, bencode.Decode(
+		[]byte("d11:external ip4:\x01\x02\x03\x048:intervali765e5:peers6:\x01\x02\x03\x0422e"),
+		&resp,
+	))
+	require.NoError(t, resp.parse())
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(resp.announceResp().ExternalIP))
+}
+
+func TestDecodeHttpResponseCheapPeers6(t *testing.T) {
+	var resp httpAnnounceResponse
+	require.NoError(t, bencode.Decode(
+		[]byte("d8:intervali765e5:peers6:\x01\x02\x03\x04\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e"),
+		&resp,
+	))
+	require.NoError(t, resp.parse())
+	require.Len(t, resp.Peers, 2)
+	assert.EqualValues(t, net.ParseIP("1.2.3.4"), resp.Peers[0].IP)
+	assert.EqualValues(t, net.ParseIP("2001:db8::1"), resp.Peers[1].IP)
+	assert.EqualValues(t, 6881, resp.Peers[1].Port)
+}
+
 func TestDecodeHttpResponseEmptyPeers(t *testing.T) {
 	var resp httpAnnounceResponse
 	require.NoError(t, bencode.Decode(
@@ -137,3 +170,130 @@ func TestThirdPartyRequest(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func httpTestTracker(t *testing.T, resp string, delay time.Duration) (TrackerURL, *httptest.Server) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte(resp))
+	}))
+	tr, err := NewTrackerURL(srv.URL + "/announce")
+	require.NoError(t, err)
+	return tr, srv
+}
+
+func TestHTTPAnnounceErrors(t *testing.T) {
+	tr, srv := httpTestTracker(t, "d15:warning message4:slow8:intervali765e5:peers6:\x01\x02\x03\x0422e", 0)
+	defer srv.Close()
+	resp, err := tr.Announce(context.Background(), reqs[1])
+	var warning *WarningError
+	require.True(t, errors.As(err, &warning))
+	assert.Equal(t, "slow", warning.Message)
+	require.NotNil(t, resp)
+	assert.Len(t, resp.Peers, 1)
+	assert.EqualValues(t, 765, resp.Interval)
+
+	tr, srv = httpTestTracker(t, "d14:failure reason12:unregisterede", 0)
+	defer srv.Close()
+	resp, err = tr.Announce(context.Background(), reqs[1])
+	assert.Nil(t, resp)
+	var failure *FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unregistered", failure.Reason)
+	_, err = tr.Scrape(context.Background(), [20]byte{})
+	require.True(t, errors.As(err, &failure))
+
+	tr, srv = httpTestTracker(t, "", time.Second)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = tr.Announce(ctx, reqs[1])
+	assert.True(t, errors.Is(err, ErrTimeout))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	tr, err = NewTrackerURL("http://" + l.Addr().String() + "/announce")
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), reqs[1])
+	assert.True(t, errors.Is(err, ErrConnRefused))
+
+	tr, err = NewTrackerURL("http://" + l.Addr().String())
+	require.NoError(t, err)
+	_, err = tr.Scrape(context.Background(), [20]byte{})
+	assert.True(t, errors.Is(err, ErrScrapeUnsupported))
+}
+
+type countingTransport struct {
+	http.RoundTripper
+	n int
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ct.n++
+	return ct.RoundTripper.RoundTrip(r)
+}
+
+func TestHTTPClientOptions(t *testing.T) {
+	var userAgent string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("d8:intervali900e5:peers6:\x01\x02\x03\x0422e"))
+		zw.Close()
+	}))
+	defer srv.Close()
+	//the certificate of the tracker isn't trusted
+	tr, err := NewTrackerURL(srv.URL + "/announce")
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), reqs[1])
+	require.Error(t, err)
+	tr, err = NewTrackerURL(srv.URL+"/announce", WithHTTPClient(srv.Client()))
+	require.NoError(t, err)
+	resp, err := tr.Announce(context.Background(), reqs[1])
+	require.NoError(t, err)
+	assert.EqualValues(t, 900, resp.Interval)
+	assert.Len(t, resp.Peers, 1)
+	assert.Equal(t, DefaultUserAgent, userAgent)
+	//custom RoundTripper
+	ct := &countingTransport{RoundTripper: srv.Client().Transport}
+	tr, err = NewTrackerURL(srv.URL+"/announce", WithHTTPClient(&http.Client{Transport: ct}), WithUserAgent("test/1.0"))
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), reqs[1])
+	require.NoError(t, err)
+	assert.Equal(t, 1, ct.n)
+	assert.Equal(t, "test/1.0", userAgent)
+}
+
+func TestHTTPTrackerID(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.URL.Query().Get("trackerid"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali900e5:peers0:10:tracker id3:abce"))
+	}))
+	defer srv.Close()
+	tr, err := NewTrackerURL(srv.URL + "/announce")
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), reqs[1])
+	require.NoError(t, err)
+	//announces of different torrents may run concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := tr.Announce(context.Background(), reqs[1])
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Len(t, ids, 6)
+	assert.Equal(t, "", ids[0])
+	for _, id := range ids[1:] {
+		assert.Equal(t, "abc", id)
+	}
+}
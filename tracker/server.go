@@ -1,154 +1,373 @@
 package tracker
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-	"math/rand"
+	"crypto/rand"
+	"errors"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
-type portIP struct {
-	IP   int32
-	port int16
+//ErrServerClosed is returned by the Serve methods of Server after Close.
+var ErrServerClosed = errors.New("tracker: server closed")
+
+//ServerConfig configures a tracker Server
+type ServerConfig struct {
+	//how often peers should announce
+	Interval time.Duration
+	//peers shouldn't announce more often than that (HTTP only)
+	MinInterval time.Duration
+	//peers that haven't announced for that long are dropped from the swarm.
+	//It should be larger than Interval.
+	PeerTimeout time.Duration
+	//the number of peers we return if the announcing peer doesn't ask for a
+	//specific number
+	DefaultNumwant int
+	//the maximum number of peers we return in an announce response
+	MaxNumwant int
+	//Allow is called before every announce and scrape if it's set. If it
+	//returns an error, the request is rejected and the error is sent to the
+	//peer.
+	Allow func(*ServerRequest) error
 }
 
-type torrent struct {
-	stats udpScrapeInfo
-	Peers []portIP
+//ServerRequest describes an announce or a scrape request to a Server
+type ServerRequest struct {
+	IP net.IP
+	//the path of the HTTP request or the path of the URL data of an UDP
+	//announce (BEP 41). Empty for UDP requests without URL data.
+	Path       string
+	Scrape     bool
+	InfoHashes [][20]byte
 }
 
-type server struct {
-	pc    net.PacketConn
-	conns map[int64]struct{}
-	t     map[[20]byte]torrent
+//DefaultServerConfig returns the default configuration for a tracker server
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Interval:       30 * time.Minute,
+		MinInterval:    5 * time.Minute,
+		PeerTimeout:    45 * time.Minute,
+		DefaultNumwant: 50,
+		MaxNumwant:     200,
+	}
 }
 
-func marshal(parts ...interface{}) (ret []byte, err error) {
-	var buf bytes.Buffer
-	for _, p := range parts {
-		err = binary.Write(&buf, binary.BigEndian, p)
-		if err != nil {
-			return
-		}
+//Server is a BitTorrent tracker that serves announces and scrapes over UDP
+//(BEP 15) and HTTP (BEP 3, 7, 23, 24, 48). It registers the peers that
+//announce for every info hash, drops them when they stop announcing and
+//hands out random subsets of them to the others.
+//
+//Server implements http.Handler, announce requests are served at paths whose
+//last element starts with "announce" and scrape requests at paths whose last
+//element starts with "scrape".
+type Server struct {
+	cfg *ServerConfig
+	//we don't keep state for UDP connection IDs, we derive them from the
+	//address of the client and this secret
+	secret []byte
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+	closed bool
+	pcs    map[net.PacketConn]struct{}
+	hss    map[*http.Server]struct{}
+	close  chan struct{}
+	wg     sync.WaitGroup
+}
+
+//NewServer creates a tracker server. If cfg is nil, the DefaultServerConfig
+//is used. The server doesn't listen anywhere until one of its Serve methods
+//is called.
+func NewServer(cfg *ServerConfig) *Server {
+	if cfg == nil {
+		cfg = DefaultServerConfig()
+	}
+	s := &Server{
+		cfg:    cfg,
+		secret: make([]byte, 16),
+		swarms: make(map[[20]byte]*swarm),
+		pcs:    make(map[net.PacketConn]struct{}),
+		hss:    make(map[*http.Server]struct{}),
+		close:  make(chan struct{}),
 	}
-	ret = buf.Bytes()
-	return
+	if _, err := rand.Read(s.secret); err != nil {
+		mathrand.Read(s.secret)
+	}
+	s.wg.Add(1)
+	go s.expireLoop()
+	return s
 }
 
-func (s *server) respond(addr net.Addr, rh respHeader, parts ...interface{}) (err error) {
-	b, err := marshal(append([]interface{}{rh}, parts...)...)
-	if err != nil {
+//Close stops all the Serve methods and drops all the peers.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
 		return
 	}
-	_, err = s.pc.WriteTo(b, addr)
-	return
+	s.closed = true
+	close(s.close)
+	for pc := range s.pcs {
+		pc.Close()
+	}
+	for hs := range s.hss {
+		hs.Close()
+	}
+	s.swarms = make(map[[20]byte]*swarm)
+	s.mu.Unlock()
+	s.wg.Wait()
 }
 
-func (s *server) newConn() (ret int64) {
-	ret = rand.Int63()
-	if s.conns == nil {
-		s.conns = make(map[int64]struct{})
+func (s *Server) allow(r *ServerRequest) error {
+	if s.cfg.Allow == nil {
+		return nil
 	}
-	s.conns[ret] = struct{}{}
-	return
+	return s.cfg.Allow(r)
 }
 
-func (s *server) serveOne() error {
-	b := make([]byte, 0x10000)
-	n, addr, err := s.pc.ReadFrom(b)
-	if err != nil {
-		return err
-	}
-	r := bytes.NewReader(b[:n])
-	var h reqHeader
-	err = readFromBinary(r, &h)
-	if err != nil {
-		return err
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) expireLoop() {
+	defer s.wg.Done()
+	interval := s.cfg.PeerTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
 	}
-	switch h.Action {
-	case actionConnect:
-		if h.ConnID != protoID {
-			return err
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.expire(now)
+		case <-s.close:
+			return
 		}
-		connID := s.newConn()
-		err = s.respond(addr, respHeader{
-			actionConnect,
-			h.TxID,
-		}, connID)
-		return err
-	case actionAnnounce:
-		if err = s.checkConnectionID(h, addr); err != nil {
-			return err
+	}
+}
+
+//expire drops the peers that haven't announced for PeerTimeout
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ih, sw := range s.swarms {
+		for _, p := range sw.peers {
+			if now.Sub(p.lastSeen) > s.cfg.PeerTimeout {
+				sw.remove(p)
+			}
 		}
-		var ar AnnounceReq
-		err = readFromBinary(r, &ar)
-		if err != nil {
-			return err
+		if len(sw.peers) == 0 {
+			delete(s.swarms, ih)
 		}
+	}
+}
 
-		var t torrent
-		var ok bool
-		if t, ok = s.t[ar.InfoHash]; ok != true {
-			return fmt.Errorf("announce: ihash %v doesnt exist in tracker db", ar.InfoHash)
+//announce registers the peer at ip that made req and returns the stats of
+//the swarm and the peers the announcing peer should connect to. If family
+//is net.IPv4len or net.IPv6len only peers of that address family are
+//returned.
+func (s *Server) announce(req AnnounceReq, ip net.IP, family int) *AnnounceResp {
+	resp := &AnnounceResp{
+		Interval:    int32(s.cfg.Interval / time.Second),
+		MinInterval: int32(s.cfg.MinInterval / time.Second),
+		ExternalIP:  ip,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[req.InfoHash]
+	if !ok {
+		if req.Event == Stopped {
+			return resp
 		}
-		err = s.respond(addr, respHeader{
-			actionAnnounce,
-			h.TxID,
-		}, announceFixed{
-			900,
-			t.stats.Leechers,
-			t.stats.Seeders,
-		}, t.Peers)
-		return err
-	case actionScrape:
-		if err = s.checkConnectionID(h, addr); err != nil {
-			return err
+		sw = newSwarm()
+		s.swarms[req.InfoHash] = sw
+	}
+	self := sw.announce(Peer{
+		ID:   append([]byte{}, req.PeerID[:]...),
+		IP:   ip,
+		Port: uint16(req.Port),
+	}, req.Left, req.Event, time.Now())
+	resp.Seeders, resp.Leechers = sw.seeders, sw.leechers
+	if len(sw.peers) == 0 {
+		delete(s.swarms, req.InfoHash)
+	}
+	if self == nil {
+		return resp
+	}
+	resp.Peers = sw.randomPeers(self, s.numwant(req.Numwant), family)
+	return resp
+}
+
+func (s *Server) numwant(n int32) int {
+	if n < 0 {
+		return s.cfg.DefaultNumwant
+	}
+	if int(n) > s.cfg.MaxNumwant {
+		return s.cfg.MaxNumwant
+	}
+	return int(n)
+}
+
+func (s *Server) scrape(infoHash [20]byte) udpScrapeInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return udpScrapeInfo{}
+	}
+	return udpScrapeInfo{
+		Seeders:   sw.seeders,
+		Completed: sw.completed,
+		Leechers:  sw.leechers,
+	}
+}
+
+//Torrents returns the stats of all the swarms the server tracks
+func (s *Server) Torrents() map[[20]byte]TorrentInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[[20]byte]TorrentInfo, len(s.swarms))
+	for ih, sw := range s.swarms {
+		ret[ih] = TorrentInfo{
+			Seeders:    sw.seeders,
+			Downloaded: sw.completed,
+			Leechers:   sw.leechers,
 		}
-		ihashSz := 20
-		if r.Len()%ihashSz != 0 {
-			return fmt.Errorf("scrape: remaining scrape request is not divided exactly with %d", ihashSz)
+	}
+	return ret
+}
+
+//swarm holds the peers of an info hash
+type swarm struct {
+	//peers by address
+	peers map[string]*swarmPeer
+	//same peers as above, for picking random ones
+	list      []*swarmPeer
+	seeders   int32
+	leechers  int32
+	completed int32
+}
+
+type swarmPeer struct {
+	Peer
+	seeder   bool
+	lastSeen time.Time
+	//index at swarm.list
+	i int
+}
+
+func newSwarm() *swarm {
+	return &swarm{
+		peers: make(map[string]*swarmPeer),
+	}
+}
+
+//announce updates the swarm with the announce of p and returns its entry,
+//nil if the peer stopped
+func (sw *swarm) announce(p Peer, left int64, event Event, now time.Time) *swarmPeer {
+	key := p.String()
+	sp, ok := sw.peers[key]
+	if event == Stopped {
+		if ok {
+			sw.remove(sp)
 		}
-		numScrapeReq := r.Len() / ihashSz
-		//BEP specifies a limit
-		if numScrapeReq > 74 {
-			return fmt.Errorf("scrape: cannot process more than %d scrape requests", numScrapeReq)
+		return nil
+	}
+	seeder := left == 0
+	if !ok {
+		sp = &swarmPeer{Peer: p}
+		sw.add(sp, seeder)
+		if event == Completed {
+			sw.completed++
 		}
-		scrapeReq := make([][20]byte, numScrapeReq)
-		err = readFromBinary(r, &scrapeReq)
-		if err != nil {
-			return err
+	} else {
+		if event == Completed && !sp.seeder {
+			sw.completed++
 		}
-		scrapeResp := make([]udpScrapeInfo, numScrapeReq)
-		var t torrent
-		var ok bool
-		for i, ihash := range scrapeReq {
-			if t, ok = s.t[ihash]; ok != true {
-				return fmt.Errorf("scrape: ihash %v doesnt exist in tracker db", ihash)
-			}
-			scrapeResp[i] = t.stats
+		sp.ID = p.ID
+		sw.setSeeder(sp, seeder)
+	}
+	sp.lastSeen = now
+	return sp
+}
+
+func (sw *swarm) add(sp *swarmPeer, seeder bool) {
+	sp.i = len(sw.list)
+	sw.list = append(sw.list, sp)
+	sw.peers[sp.String()] = sp
+	sp.seeder = seeder
+	if seeder {
+		sw.seeders++
+	} else {
+		sw.leechers++
+	}
+}
+
+func (sw *swarm) remove(sp *swarmPeer) {
+	last := sw.list[len(sw.list)-1]
+	sw.list[sp.i] = last
+	last.i = sp.i
+	sw.list = sw.list[:len(sw.list)-1]
+	delete(sw.peers, sp.String())
+	if sp.seeder {
+		sw.seeders--
+	} else {
+		sw.leechers--
+	}
+}
+
+func (sw *swarm) setSeeder(sp *swarmPeer, seeder bool) {
+	if sp.seeder == seeder {
+		return
+	}
+	sp.seeder = seeder
+	if seeder {
+		sw.seeders++
+		sw.leechers--
+	} else {
+		sw.seeders--
+		sw.leechers++
+	}
+}
+
+func (sw *swarm) swap(i, j int) {
+	sw.list[i], sw.list[j] = sw.list[j], sw.list[i]
+	sw.list[i].i = i
+	sw.list[j].i = j
+}
+
+//randomPeers returns up to n random peers for self. Seeders only get
+//leechers because they have nothing to exchange with each other.
+func (sw *swarm) randomPeers(self *swarmPeer, n, family int) []Peer {
+	var ret []Peer
+	//partial Fisher-Yates shuffle, the order of the list doesn't matter
+	for i := 0; i < len(sw.list) && len(ret) < n; i++ {
+		sw.swap(i, i+mathrand.Intn(len(sw.list)-i))
+		p := sw.list[i]
+		if p == self || (self.seeder && p.seeder) || (family != 0 && ipLen(p.IP) != family) {
+			continue
 		}
-		err = s.respond(addr, respHeader{
-			actionScrape,
-			h.TxID,
-		}, scrapeResp)
-		return err
-	default:
-		s.respond(addr, respHeader{
-			h.TxID,
-			actionError,
-		}, []byte("unhandled action"))
-		return fmt.Errorf("unhandled action: %d", h.Action)
-	}
-}
-
-func (s *server) checkConnectionID(h reqHeader, addr net.Addr) error {
-	if _, ok := s.conns[h.ConnID]; !ok {
-		s.respond(addr, respHeader{
-			TxID:   h.TxID,
-			Action: actionError,
-		}, []byte("not connected"))
-		return fmt.Errorf("client %s requested without being connected", addr.String())
-	}
-	return nil
+		ret = append(ret, p.Peer)
+	}
+	return ret
+}
+
+func ipLen(ip net.IP) int {
+	if ip.To4() != nil {
+		return net.IPv4len
+	}
+	return net.IPv6len
+}
+
+//normalizeIP returns 4 byte IPv4 addresses so they can be written in compact
+//form
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
 }
@@ -0,0 +1,237 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lkslts64/charo-torrent/bencode"
+)
+
+//httpAnnounceServerResp is what the server sends, unlike httpAnnounceResponse
+//peers are always present even if there are none
+type httpAnnounceServerResp struct {
+	Interval    int32 `bencode:"interval"`
+	MinInterval int32 `bencode:"min interval" empty:"omit"`
+	Complete    int32 `bencode:"complete"`
+	Incomplete  int32 `bencode:"incomplete"`
+	//cheapPeers or []httpPeer
+	Peers       interface{} `bencode:"peers"`
+	CheapPeers6 cheapPeers6 `bencode:"peers6" empty:"omit"`
+	ExternalIP  []byte      `bencode:"external ip" empty:"omit"`
+}
+
+//a peer in dictionary model
+type httpPeer struct {
+	ID   []byte `bencode:"peer id" empty:"omit"`
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+type httpFailure struct {
+	Fail string `bencode:"failure reason"`
+}
+
+type httpScrapeServerResp struct {
+	Files map[string]TorrentInfo `bencode:"files"`
+}
+
+//Serve serves HTTP tracker requests that arrive at l until the server is
+//closed, in which case it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	hs := &http.Server{Handler: s}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.hss[hs] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.hss, hs)
+		s.mu.Unlock()
+	}()
+	err := hs.Serve(l)
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := path.Base(r.URL.Path)
+	switch {
+	case strings.HasPrefix(base, "announce"):
+		s.serveHTTPAnnounce(w, r)
+	case strings.HasPrefix(base, "scrape"):
+		s.serveHTTPScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveHTTPAnnounce(w http.ResponseWriter, r *http.Request) {
+	ip, err := remoteIP(r)
+	if err != nil {
+		writeBencode(w, httpFailure{err.Error()})
+		return
+	}
+	q := r.URL.Query()
+	req, err := parseHTTPAnnounce(q)
+	if err == nil {
+		err = s.allow(&ServerRequest{
+			IP:         ip,
+			Path:       r.URL.Path,
+			InfoHashes: [][20]byte{req.InfoHash},
+		})
+	}
+	if err != nil {
+		writeBencode(w, httpFailure{err.Error()})
+		return
+	}
+	resp := s.announce(req, ip, 0)
+	sresp := httpAnnounceServerResp{
+		Interval:    resp.Interval,
+		MinInterval: resp.MinInterval,
+		Complete:    resp.Seeders,
+		Incomplete:  resp.Leechers,
+		ExternalIP:  ip,
+	}
+	if q.Get("compact") == "1" {
+		sresp.Peers = cheapPeers(compactPeers(resp.Peers, net.IPv4len))
+		//BEP 7
+		if peers6 := compactPeers(resp.Peers, net.IPv6len); len(peers6) > 0 {
+			sresp.CheapPeers6 = peers6
+		}
+	} else {
+		noPeerID := q.Get("no_peer_id") == "1"
+		peers := make([]httpPeer, len(resp.Peers))
+		for i, p := range resp.Peers {
+			peers[i] = httpPeer{IP: p.IP.String(), Port: p.Port}
+			if !noPeerID {
+				peers[i].ID = p.ID
+			}
+		}
+		sresp.Peers = peers
+	}
+	writeBencode(w, sresp)
+}
+
+func parseHTTPAnnounce(q url.Values) (req AnnounceReq, err error) {
+	ih, id := q.Get("info_hash"), q.Get("peer_id")
+	if len(ih) != 20 {
+		return req, errors.New("invalid info_hash")
+	}
+	if len(id) != 20 {
+		return req, errors.New("invalid peer_id")
+	}
+	copy(req.InfoHash[:], ih)
+	copy(req.PeerID[:], id)
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, errors.New("invalid port")
+	}
+	req.Port = int16(port)
+	for _, f := range []struct {
+		key string
+		v   *int64
+	}{{"uploaded", &req.Uploaded}, {"downloaded", &req.Downloaded}, {"left", &req.Left}} {
+		if *f.v, err = strconv.ParseInt(q.Get(f.key), 10, 64); err != nil {
+			return req, errors.New("invalid " + f.key)
+		}
+	}
+	switch q.Get("event") {
+	case "":
+	case "started":
+		req.Event = Started
+	case "completed":
+		req.Event = Completed
+	case "stopped":
+		req.Event = Stopped
+	default:
+		return req, errors.New("invalid event")
+	}
+	req.Numwant = -1
+	if v := q.Get("numwant"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return req, errors.New("invalid numwant")
+		}
+		req.Numwant = int32(n)
+	}
+	return req, nil
+}
+
+func (s *Server) serveHTTPScrape(w http.ResponseWriter, r *http.Request) {
+	ihashes := r.URL.Query()["info_hash"]
+	resp := httpScrapeServerResp{
+		Files: make(map[string]TorrentInfo),
+	}
+	sreq := &ServerRequest{
+		Path:       r.URL.Path,
+		Scrape:     true,
+		InfoHashes: make([][20]byte, len(ihashes)),
+	}
+	for i, ih := range ihashes {
+		if len(ih) != 20 {
+			writeBencode(w, httpFailure{"invalid info_hash"})
+			return
+		}
+		copy(sreq.InfoHashes[i][:], ih)
+	}
+	var err error
+	if sreq.IP, err = remoteIP(r); err == nil {
+		err = s.allow(sreq)
+	}
+	if err != nil {
+		writeBencode(w, httpFailure{err.Error()})
+		return
+	}
+	//full scrape if no info hash is specified
+	if len(ihashes) == 0 {
+		for ih, info := range s.Torrents() {
+			resp.Files[string(ih[:])] = info
+		}
+		writeBencode(w, resp)
+		return
+	}
+	for _, ih := range sreq.InfoHashes {
+		resp.Files[string(ih[:])] = scrapeTorrentInfo(s.scrape(ih))
+	}
+	writeBencode(w, resp)
+}
+
+func scrapeTorrentInfo(info udpScrapeInfo) TorrentInfo {
+	return TorrentInfo{
+		Seeders:    info.Seeders,
+		Downloaded: info.Completed,
+		Leechers:   info.Leechers,
+	}
+}
+
+func remoteIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid remote address")
+	}
+	return normalizeIP(ip), nil
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	b, err := bencode.Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
@@ -0,0 +1,108 @@
+package tracker
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/bencode"
+)
+
+type snapshot struct {
+	Swarms []snapshotSwarm `bencode:"swarms"`
+}
+
+type snapshotSwarm struct {
+	InfoHash  []byte         `bencode:"info hash"`
+	Completed int32          `bencode:"completed"`
+	Peers     []snapshotPeer `bencode:"peers"`
+}
+
+type snapshotPeer struct {
+	ID     []byte `bencode:"peer id"`
+	IP     []byte `bencode:"ip"`
+	Port   uint16 `bencode:"port"`
+	Seeder bool   `bencode:"seeder"`
+	//unix time of the last announce
+	LastSeen int64 `bencode:"last seen"`
+}
+
+//WriteSnapshot writes the state of all swarms to w so it can be restored
+//with ReadSnapshot after a restart.
+func (s *Server) WriteSnapshot(w io.Writer) error {
+	var snap snapshot
+	s.mu.Lock()
+	for ih, sw := range s.swarms {
+		ssw := snapshotSwarm{
+			InfoHash:  append([]byte{}, ih[:]...),
+			Completed: sw.completed,
+			Peers:     make([]snapshotPeer, len(sw.list)),
+		}
+		for i, p := range sw.list {
+			ssw.Peers[i] = snapshotPeer{
+				ID:       p.ID,
+				IP:       p.IP,
+				Port:     p.Port,
+				Seeder:   p.seeder,
+				LastSeen: p.lastSeen.Unix(),
+			}
+		}
+		snap.Swarms = append(snap.Swarms, ssw)
+	}
+	s.mu.Unlock()
+	b, err := bencode.Encode(snap)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+//ReadSnapshot restores the swarms written by WriteSnapshot. Peers that have
+//announced since are kept and peers that have timed out while the server was
+//down are dropped on the next expiration.
+func (s *Server) ReadSnapshot(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err = bencode.Decode(b, &snap); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ssw := range snap.Swarms {
+		if len(ssw.InfoHash) != 20 {
+			return errors.New("snapshot: info hash isn't 20 bytes")
+		}
+		var ih [20]byte
+		copy(ih[:], ssw.InfoHash)
+		sw, ok := s.swarms[ih]
+		if !ok {
+			sw = newSwarm()
+			s.swarms[ih] = sw
+		}
+		sw.completed += ssw.Completed
+		for _, sp := range ssw.Peers {
+			if len(sp.IP) != net.IPv4len && len(sp.IP) != net.IPv6len {
+				return errors.New("snapshot: invalid peer IP")
+			}
+			p := &swarmPeer{
+				Peer: Peer{
+					ID:   sp.ID,
+					IP:   net.IP(sp.IP),
+					Port: sp.Port,
+				},
+				lastSeen: time.Unix(sp.LastSeen, 0),
+			}
+			if _, ok := sw.peers[p.String()]; ok {
+				continue
+			}
+			sw.add(p, sp.Seeder)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lkslts64/charo-torrent/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serverAnnounceReq(ih [20]byte, id byte, port int16, left int64, event Event) AnnounceReq {
+	req := AnnounceReq{
+		InfoHash: ih,
+		Left:     left,
+		Event:    event,
+		Numwant:  -1,
+		Port:     port,
+	}
+	req.PeerID[0] = id
+	return req
+}
+
+func peerPorts(peers []Peer) []int {
+	ret := []int{}
+	for _, p := range peers {
+		ret = append(ret, int(p.Port))
+	}
+	return ret
+}
+
+func testServerSwarm(t *testing.T, tr TrackerURL) {
+	ih := [20]byte{1}
+	resp, err := tr.Announce(context.Background(), serverAnnounceReq(ih, 1, 1001, 10, Started))
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, resp.Seeders)
+	assert.EqualValues(t, 1, resp.Leechers)
+	assert.Empty(t, resp.Peers)
+	resp, err = tr.Announce(context.Background(), serverAnnounceReq(ih, 2, 1002, 0, Started))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, resp.Seeders)
+	assert.EqualValues(t, 1, resp.Leechers)
+	assert.Equal(t, []int{1001}, peerPorts(resp.Peers))
+	assert.True(t, resp.Peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)))
+	resp, err = tr.Announce(context.Background(), serverAnnounceReq(ih, 3, 1003, 5, Started))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1001, 1002}, peerPorts(resp.Peers))
+	//seeders only get leechers
+	resp, err = tr.Announce(context.Background(), serverAnnounceReq(ih, 2, 1002, 0, None))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1001, 1003}, peerPorts(resp.Peers))
+	resp, err = tr.Announce(context.Background(), serverAnnounceReq(ih, 1, 1001, 0, Completed))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, resp.Seeders)
+	assert.EqualValues(t, 1, resp.Leechers)
+	_, err = tr.Announce(context.Background(), serverAnnounceReq(ih, 3, 1003, 5, Stopped))
+	require.NoError(t, err)
+	other := [20]byte{2}
+	sresp, err := tr.Scrape(context.Background(), ih, other)
+	require.NoError(t, err)
+	assert.Len(t, sresp.Torrents, 2)
+	assert.Equal(t, TorrentInfo{Seeders: 2, Downloaded: 1}, sresp.Torrents[string(ih[:])])
+	assert.Equal(t, TorrentInfo{}, sresp.Torrents[string(other[:])])
+}
+
+func TestServerUDP(t *testing.T) {
+	s := NewServer(nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		done <- s.ServeUDP(pc)
+	}()
+	tr, err := NewTrackerURL(fmt.Sprintf("udp://%s/announce", pc.LocalAddr()))
+	require.NoError(t, err)
+	testServerSwarm(t, tr)
+	s.Close()
+	assert.Equal(t, ErrServerClosed, <-done)
+	assert.Equal(t, ErrServerClosed, s.ServeUDP(pc))
+}
+
+func TestServerHTTP(t *testing.T) {
+	s := NewServer(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	tr, err := NewTrackerURL(fmt.Sprintf("http://%s/announce", l.Addr()))
+	require.NoError(t, err)
+	testServerSwarm(t, tr)
+	resp, err := tr.Announce(context.Background(), serverAnnounceReq([20]byte{1}, 4, 1004, 5, Started))
+	require.NoError(t, err)
+	assert.True(t, resp.ExternalIP.Equal(net.IPv4(127, 0, 0, 1)))
+	assert.EqualValues(t, 30*60, resp.Interval)
+	//dictionary model
+	req := serverAnnounceReq([20]byte{1}, 5, 1005, 5, Started)
+	q, err := url.ParseQuery(req.queryValues())
+	require.NoError(t, err)
+	q.Del("compact")
+	q.Del("no_peer_id")
+	hresp, err := http.Get(fmt.Sprintf("http://%s/announce?%s", l.Addr(), q.Encode()))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(hresp.Body)
+	hresp.Body.Close()
+	require.NoError(t, err)
+	var ar httpAnnounceResponse
+	require.NoError(t, bencode.Decode(b, &ar))
+	require.NoError(t, ar.parse())
+	assert.ElementsMatch(t, []int{1001, 1002, 1004}, peerPorts(ar.Peers))
+	for _, p := range ar.Peers {
+		assert.Len(t, p.ID, 20)
+	}
+	//bad request
+	hresp, err = http.Get(fmt.Sprintf("http://%s/announce?info_hash=abc", l.Addr()))
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(hresp.Body)
+	hresp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "d14:failure reason17:invalid info_hashe", string(b))
+	s.Close()
+	assert.Equal(t, ErrServerClosed, <-done)
+}
+
+func TestServerNumwant(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	ih := [20]byte{1}
+	for i := 0; i < 20; i++ {
+		s.announce(serverAnnounceReq(ih, byte(i), int16(1000+i), 1, Started), net.IPv4(1, 2, 3, 4).To4(), 0)
+	}
+	s.announce(serverAnnounceReq(ih, 100, 1000, 1, Started), net.ParseIP("2001:db8::1"), 0)
+	req := serverAnnounceReq(ih, 0, 1000, 1, None)
+	req.Numwant = 5
+	resp := s.announce(req, net.IPv4(1, 2, 3, 4).To4(), 0)
+	assert.Len(t, resp.Peers, 5)
+	seen := make(map[string]bool)
+	for _, p := range resp.Peers {
+		assert.NotEqual(t, "1.2.3.4:1000", p.String())
+		assert.False(t, seen[p.String()])
+		seen[p.String()] = true
+	}
+	req.Numwant = 1000
+	resp = s.announce(req, net.IPv4(1, 2, 3, 4).To4(), 0)
+	assert.Len(t, resp.Peers, 20)
+	resp = s.announce(req, net.IPv4(1, 2, 3, 4).To4(), net.IPv4len)
+	assert.Len(t, resp.Peers, 19)
+	resp = s.announce(req, net.IPv4(1, 2, 3, 4).To4(), net.IPv6len)
+	assert.Len(t, resp.Peers, 1)
+}
+
+func TestServerExpire(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	ih := [20]byte{1}
+	s.announce(serverAnnounceReq(ih, 1, 1001, 0, Started), net.IPv4(1, 2, 3, 4).To4(), 0)
+	s.expire(time.Now())
+	assert.Equal(t, udpScrapeInfo{Seeders: 1}, s.scrape(ih))
+	s.expire(time.Now().Add(s.cfg.PeerTimeout + time.Second))
+	assert.Equal(t, udpScrapeInfo{}, s.scrape(ih))
+	assert.Empty(t, s.swarms)
+}
+
+func TestServerUDPConnID(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	var buf bytes.Buffer
+	require.NoError(t, writeBinary(&buf, reqHeader{1, actionScrape, 7}, [20]byte{}))
+	b, err := s.serveUDPPacket(buf.Bytes(), addr)
+	require.NoError(t, err)
+	assert.Error(t, checkRespHeader(bytes.NewBuffer(b), respHeader{actionScrape, 7}))
+	var rh respHeader
+	require.NoError(t, readFromBinary(bytes.NewReader(b), &rh))
+	assert.Equal(t, respHeader{actionError, 7}, rh)
+	assert.True(t, s.validConnID(s.connID(addr, time.Now().Add(-connIDEpoch)), addr))
+	assert.False(t, s.validConnID(s.connID(addr, time.Now().Add(-2*connIDEpoch)), addr))
+	assert.False(t, s.validConnID(s.connID(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1235}, time.Now()), addr))
+}
+
+func TestServerSnapshot(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	ih := [20]byte{1}
+	s.announce(serverAnnounceReq(ih, 1, 1001, 0, Completed), net.IPv4(1, 2, 3, 4).To4(), 0)
+	s.announce(serverAnnounceReq(ih, 2, 1002, 1, Started), net.ParseIP("2001:db8::1"), 0)
+	s.announce(serverAnnounceReq([20]byte{2}, 1, 1001, 1, Started), net.IPv4(1, 2, 3, 4).To4(), 0)
+	var buf bytes.Buffer
+	require.NoError(t, s.WriteSnapshot(&buf))
+	s2 := NewServer(nil)
+	defer s2.Close()
+	require.NoError(t, s2.ReadSnapshot(&buf))
+	assert.Equal(t, s.Torrents(), s2.Torrents())
+	assert.Equal(t, TorrentInfo{Seeders: 1, Leechers: 1, Downloaded: 1}, s2.Torrents()[ih])
+	resp := s2.announce(serverAnnounceReq(ih, 3, 1003, 1, Started), net.IPv4(5, 6, 7, 8).To4(), 0)
+	assert.ElementsMatch(t, []int{1001, 1002}, peerPorts(resp.Peers))
+	s2.expire(time.Now().Add(s.cfg.PeerTimeout + time.Second))
+	assert.Empty(t, s2.Torrents())
+}
+
+func TestServerAllow(t *testing.T) {
+	var reqs []ServerRequest
+	cfg := DefaultServerConfig()
+	cfg.Allow = func(r *ServerRequest) error {
+		reqs = append(reqs, *r)
+		if r.Path != "/secret/announce" {
+			return errors.New("unknown passkey")
+		}
+		return nil
+	}
+	s := NewServer(cfg)
+	defer s.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	req := serverAnnounceReq([20]byte{1}, 1, 1001, 1, Started)
+	tr, err := NewTrackerURL(fmt.Sprintf("http://%s/secret/announce", l.Addr()))
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), req)
+	require.NoError(t, err)
+	tr, err = NewTrackerURL(fmt.Sprintf("http://%s/other/announce", l.Addr()))
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown passkey")
+	require.Len(t, reqs, 2)
+	assert.Equal(t, ServerRequest{
+		IP:         net.IPv4(127, 0, 0, 1).To4(),
+		Path:       "/secret/announce",
+		InfoHashes: [][20]byte{{1}},
+	}, reqs[0])
+	//UDP with URL data
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	var buf bytes.Buffer
+	require.NoError(t, writeBinary(&buf, reqHeader{s.connID(addr, time.Now()), actionAnnounce, 7}, req))
+	buf.Write([]byte{optionURLData, 7, '/', 's', 'e', 'c', 'r', 'e', 't', optionNOP, optionURLData, 14})
+	buf.WriteString("/announce?a=b")
+	buf.WriteByte(optionEndOfOptions)
+	b, err := s.serveUDPPacket(buf.Bytes(), addr)
+	require.NoError(t, err)
+	assert.NoError(t, checkRespHeader(bytes.NewBuffer(b), respHeader{actionAnnounce, 7}))
+	assert.Equal(t, "/secret/announce", reqs[2].Path)
+}
+
+func TestURLDataPath(t *testing.T) {
+	assert.Equal(t, "", urlDataPath(nil))
+	assert.Equal(t, "/ab", urlDataPath([]byte{optionURLData, 2, '/', 'a', optionNOP, optionURLData, 1, 'b'}))
+	assert.Equal(t, "/a", urlDataPath([]byte{optionURLData, 2, '/', 'a', optionEndOfOptions, optionURLData, 1, 'b'}))
+	//truncated
+	assert.Equal(t, "", urlDataPath([]byte{optionURLData, 5, '/', 'a'}))
+}
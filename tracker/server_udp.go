@@ -0,0 +1,208 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	//connection IDs are valid for one epoch after the one they were
+	//created in, so 1-2 minutes. BEP 15 says at least one.
+	connIDEpoch = time.Minute
+	//BEP 15 limit
+	maxScrapeInfoHashes = 74
+	//header plus AnnounceReq
+	udpAnnounceReqLen = 98
+)
+
+//ServeUDP serves UDP tracker requests (BEP 15) that arrive at pc until the
+//server is closed, in which case it returns ErrServerClosed.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.pcs[pc] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pcs, pc)
+		s.mu.Unlock()
+	}()
+	b := make([]byte, 2048)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		//malformed requests are dropped
+		if resp, err := s.serveUDPPacket(b[:n], udpAddr); err == nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+//serveUDPPacket returns the response to the request at b
+func (s *Server) serveUDPPacket(b []byte, addr *net.UDPAddr) ([]byte, error) {
+	r := bytes.NewReader(b)
+	var h reqHeader
+	if err := readFromBinary(r, &h); err != nil {
+		return nil, err
+	}
+	if h.Action == actionConnect {
+		if h.ConnID != protoID {
+			return nil, errors.New("bad protocol ID")
+		}
+		return marshal(respHeader{actionConnect, h.TxID}, s.connID(addr, time.Now()))
+	}
+	if !s.validConnID(h.ConnID, addr) {
+		return udpError(h.TxID, "connection ID expired")
+	}
+	switch h.Action {
+	case actionAnnounce:
+		if len(b) < udpAnnounceReqLen {
+			return udpError(h.TxID, "announce request too small")
+		}
+		var req AnnounceReq
+		if err := readFromBinary(r, &req); err != nil {
+			return nil, err
+		}
+		if req.Port == 0 {
+			return udpError(h.TxID, "invalid port")
+		}
+		//the IP field is ignored, peers can't register others
+		ip := normalizeIP(addr.IP)
+		err := s.allow(&ServerRequest{
+			IP:         ip,
+			Path:       urlDataPath(b[udpAnnounceReqLen:]),
+			InfoHashes: [][20]byte{req.InfoHash},
+		})
+		if err != nil {
+			return udpError(h.TxID, err.Error())
+		}
+		resp := s.announce(req, ip, len(ip))
+		return marshal(respHeader{actionAnnounce, h.TxID}, announceFixed{
+			Interval: resp.Interval,
+			Leechers: resp.Leechers,
+			Seeders:  resp.Seeders,
+		}, compactPeers(resp.Peers, len(ip)))
+	case actionScrape:
+		n := r.Len() / 20
+		if n > maxScrapeInfoHashes {
+			n = maxScrapeInfoHashes
+		}
+		ihashes := make([][20]byte, n)
+		if err := readFromBinary(r, ihashes); err != nil {
+			return nil, err
+		}
+		err := s.allow(&ServerRequest{
+			IP:         normalizeIP(addr.IP),
+			Scrape:     true,
+			InfoHashes: ihashes,
+		})
+		if err != nil {
+			return udpError(h.TxID, err.Error())
+		}
+		infos := make([]udpScrapeInfo, n)
+		for i, ih := range ihashes {
+			infos[i] = s.scrape(ih)
+		}
+		return marshal(respHeader{actionScrape, h.TxID}, infos)
+	default:
+		return udpError(h.TxID, "unknown action")
+	}
+}
+
+//BEP 41 options
+const (
+	optionEndOfOptions byte = iota
+	optionNOP
+	optionURLData
+)
+
+//urlDataPath returns the path of the URL data options (BEP 41) that follow an
+//announce request
+func urlDataPath(opts []byte) string {
+	var data []byte
+loop:
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optionEndOfOptions:
+			break loop
+		case optionNOP:
+			opts = opts[1:]
+		case optionURLData:
+			if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+				break loop
+			}
+			data = append(data, opts[2:2+opts[1]]...)
+			opts = opts[2+opts[1]:]
+		default:
+			break loop
+		}
+	}
+	if i := bytes.IndexByte(data, '?'); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+func udpError(txID int32, msg string) ([]byte, error) {
+	return marshal(respHeader{actionError, txID}, []byte(msg))
+}
+
+func (s *Server) connID(addr *net.UDPAddr, now time.Time) int64 {
+	h := sha1.New()
+	h.Write(s.secret)
+	h.Write(addr.IP)
+	binary.Write(h, binary.BigEndian, uint16(addr.Port))
+	binary.Write(h, binary.BigEndian, now.Unix()/int64(connIDEpoch/time.Second))
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)))
+}
+
+func (s *Server) validConnID(id int64, addr *net.UDPAddr) bool {
+	now := time.Now()
+	return id == s.connID(addr, now) || id == s.connID(addr, now.Add(-connIDEpoch))
+}
+
+//compactPeers writes the peers with IPs of length ipLen in compact form
+func compactPeers(peers []Peer, ipLen int) []byte {
+	ret := make([]byte, 0, len(peers)*(ipLen+2))
+	for _, p := range peers {
+		var ip net.IP
+		if ipLen == net.IPv4len {
+			ip = p.IP.To4()
+		} else if p.IP.To4() == nil {
+			ip = p.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		ret = append(ret, ip...)
+		ret = append(ret, byte(p.Port>>8), byte(p.Port))
+	}
+	return ret
+}
+
+func marshal(parts ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, parts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,13 +4,68 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var (
+	//ErrTimeout is returned when the tracker didn't respond in time
+	ErrTimeout = errors.New("tracker didn't respond in time")
+	//ErrConnRefused is returned when the host of the tracker refused the
+	//connection
+	ErrConnRefused = errors.New("tracker refused the connection")
+	//ErrScrapeUnsupported is returned when scraping an HTTP tracker whose
+	//announce URL doesn't allow deriving a scrape URL
+	ErrScrapeUnsupported = errors.New("tracker doesn't support scrape")
+)
+
+//MaxScrapeHashes is the maximum number of info hashes a UDP scrape may carry
+//(BEP 15)
+const MaxScrapeHashes = 74
+
+//FailureError is returned when the tracker refuses a request (failure reason
+//for HTTP trackers or an error action for UDP ones). Unlike unreachable
+//trackers, retrying soon won't help.
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+//WarningError is returned along with a valid response when the tracker
+//responds with a warning message.
+type WarningError struct {
+	Message string
+}
+
+func (e *WarningError) Error() string {
+	return "tracker warning: " + e.Message
+}
+
+//netErr wraps transport errors with ErrTimeout or ErrConnRefused so callers
+//can tell apart unreachable trackers
+func netErr(err error) error {
+	var te interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %v", ErrConnRefused, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &te) && te.Timeout():
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
 type Event int32
 
 const (
@@ -27,10 +82,12 @@ type AnnounceReq struct {
 	Left       int64
 	Uploaded   int64
 	Event      Event
-	IP         int32
-	Key        int32
-	Numwant    int32
-	Port       int16
+	//our IPv4 address, zero to let the tracker use the source address
+	IP int32
+	//a random value that identifies us across IP changes
+	Key     int32
+	Numwant int32
+	Port    int16
 }
 
 type AnnounceResp struct {
@@ -40,6 +97,8 @@ type AnnounceResp struct {
 	Peers    []Peer
 	//if udp tracker then always zero.
 	MinInterval int32
+	//our IP address as the tracker sees it (BEP 24). Only HTTP trackers may report it.
+	ExternalIP net.IP
 }
 
 type ScrapeResp struct {
@@ -61,31 +120,36 @@ type Peer struct {
 }
 
 func (p *Peer) String() string {
-	return p.IP.String() + ":" + strconv.FormatUint(uint64(p.Port), 10)
+	return net.JoinHostPort(p.IP.String(), strconv.FormatUint(uint64(p.Port), 10))
 }
 
+//IPv4 peers in compact format (6 bytes each)
 type cheapPeers []byte
 
 func (cheap cheapPeers) peers() ([]Peer, error) {
-	var ip net.IP
-	remainder := len(cheap) % 6
+	return parseCheapPeers(cheap, net.IPv4len)
+}
+
+//IPv6 peers in compact format (18 bytes each)
+type cheapPeers6 []byte
+
+func (cheap cheapPeers6) peers() ([]Peer, error) {
+	return parseCheapPeers(cheap, net.IPv6len)
+}
+
+func parseCheapPeers(cheap []byte, ipLen int) ([]Peer, error) {
+	sz := ipLen + 2
+	//there are extensions so the length may not be divided exactly
+	remainder := len(cheap) % sz
 	cheap = cheap[:len(cheap)-remainder]
-	if len(cheap)%6 != 0 {
-		panic("cheap not divided exactly by 6")
-	}
-	//there are extensions so this assertions shouldn't hold
-	/*if numPeers = len(cheap); numPeers%6 != 0 {
-		return nil, fmt.Errorf("cheapPeers length is not divided exactly by 6.Instead it has length %d", numPeers)
-	}*/
-	peers := make([]Peer, len(cheap)/6)
-	j := 0
-	for i := 0; i < len(cheap); i += 6 {
-		j = i / 6
-		if ip = net.IP([]byte(cheap[i : i+4])).To4(); ip == nil {
-			return nil, errors.New("cheapPeers ip parse")
-		}
-		peers[j].Port = binary.BigEndian.Uint16(cheap[i+4 : i+6])
-		peers[j].IP = ip
+	peers := make([]Peer, len(cheap)/sz)
+	for i := range peers {
+		b := cheap[i*sz : (i+1)*sz]
+		ip := make(net.IP, ipLen)
+		copy(ip, b[:ipLen])
+		//same representation as net.ParseIP
+		peers[i].IP = ip.To16()
+		peers[i].Port = binary.BigEndian.Uint16(b[ipLen:])
 	}
 	return peers, nil
 }
@@ -107,45 +171,116 @@ func (u trackerURL) ScrapeURL() string {
 	return string(u[:i+1]) + "scrape" + string(u[i+len(s)+1:])
 }
 
+//TrackerURL announces to and scrapes a tracker. Announce may return a
+//*WarningError along with a valid response. Errors of trackers that refused
+//a request are *FailureError and errors of unreachable trackers wrap
+//ErrTimeout or ErrConnRefused.
 type TrackerURL interface {
 	Announce(context.Context, AnnounceReq) (*AnnounceResp, error)
 	Scrape(context.Context, ...[20]byte) (*ScrapeResp, error)
 }
 
-func NewTrackerURL(tURL string) (TrackerURL, error) {
+//DefaultUserAgent is the User-Agent of the requests to HTTP trackers unless
+//WithUserAgent is used
+const DefaultUserAgent = "charo-torrent"
+
+//the client of HTTP trackers unless WithHTTPClient is used. It is shared so
+//connections are kept alive.
+var defaultHTTPClient = &http.Client{}
+
+//Option configures a TrackerURL
+type Option func(*options)
+
+type options struct {
+	httpClient *http.Client
+	userAgent  string
+	dialer     Dialer
+}
+
+//Dialer dials the sockets of UDP trackers, e.g through a proxy. ctx is the
+//context of the request that needs the socket.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+//WithDialer makes UDP trackers dial their sockets with d
+func WithDialer(d Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+//WithHTTPClient makes HTTP trackers use c for requests, e.g to configure
+//proxies, TLS roots or timeouts. Use &http.Client{Transport: rt} for a custom
+//RoundTripper. It has no effect on UDP trackers.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+//WithUserAgent sets the User-Agent of the requests to HTTP trackers
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
+}
+
+func NewTrackerURL(tURL string, opts ...Option) (TrackerURL, error) {
 	u, err := url.Parse(tURL)
 	if err != nil {
 		return nil, err
 	}
+	o := options{
+		httpClient: defaultHTTPClient,
+		userAgent:  DefaultUserAgent,
+		dialer:     &net.Dialer{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.httpClient == nil {
+		o.httpClient = defaultHTTPClient
+	}
 	switch u.Scheme {
 	case "http", "https":
-		return &HTTPTrackerURL{url: trackerURL(tURL)}, nil
+		return &HTTPTrackerURL{url: trackerURL(tURL), client: o.httpClient, userAgent: o.userAgent}, nil
 	case "udp":
-		return &UDPTrackerURL{url: trackerURL(tURL), host: addPortMaybe(u.Host)}, nil
+		return &UDPTrackerURL{url: trackerURL(tURL), host: addPortMaybe(u.Host), dialer: o.dialer}, nil
 	default:
 		return nil, errors.New("err bad scheme")
 	}
 }
 
 type HTTPTrackerURL struct {
-	url trackerURL
-	id  []byte
+	url       trackerURL
+	client    *http.Client
+	userAgent string
+	//guards id, announces may run concurrently
+	mu sync.Mutex
+	//the tracker id we got from the tracker, sent back at later announces
+	id []byte
 }
 
 type UDPTrackerURL struct {
-	url          trackerURL
-	host         string
-	conn         net.Conn
-	connID       int64
-	lastConncted time.Time
-	//ctx                 context.Context
-	//interval            time.Duration
-	consecutiveTimeouts int
+	url    trackerURL
+	host   string
+	dialer Dialer
+	mu     sync.Mutex
+	conn   net.Conn
+	//whether we talk to the tracker over IPv6
+	ipv6 bool
+	//the connection ID and when we got it
+	connID     int64
+	connIDTime time.Time
+	//requests waiting for a response by transaction ID
+	pending map[int32]chan udpResponse
 }
 
 func addPortMaybe(host string) string {
-	if !strings.Contains(host, ":") {
-		host += ":80"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		//maybe an IPv6 literal in brackets
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
 	}
 	return host
 
@@ -1,6 +1,7 @@
 package tracker
 
 import (
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,3 +15,17 @@ func TestScrapeURL(t *testing.T) {
 	s2 := u2.ScrapeURL()
 	assert.EqualValues(t, s2, "omg://fdsfsd/487234/1312321/scrape.php")
 }
+
+func TestPeerString(t *testing.T) {
+	p := Peer{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+	assert.Equal(t, "1.2.3.4:6881", p.String())
+	p = Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	assert.Equal(t, "[2001:db8::1]:6881", p.String())
+}
+
+func TestAddPortMaybe(t *testing.T) {
+	assert.Equal(t, "tracker.org:80", addPortMaybe("tracker.org"))
+	assert.Equal(t, "tracker.org:1337", addPortMaybe("tracker.org:1337"))
+	assert.Equal(t, "[2001:db8::1]:80", addPortMaybe("[2001:db8::1]"))
+	assert.Equal(t, "[2001:db8::1]:1337", addPortMaybe("[2001:db8::1]:1337"))
+}
@@ -7,16 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"math/rand"
 	"net"
+	"net/url"
 	"time"
 )
 
-//TODO: support IPv6
-//var connectionIdExpiredErr = errors.New("connectionID expired")
-var requestTimeoutErr = errors.New("request timeout out")
-
 const (
 	actionConnect int32 = iota
 	actionAnnounce
@@ -24,8 +20,30 @@ const (
 	actionError
 
 	protoID int64 = 0x41727101980
+
+	//a connection ID may be used for one minute after we receive it (BEP 15)
+	connIDLifetime = time.Minute
+	//requests are retransmitted up to that many times, the last time waiting
+	//15*2^8 seconds for a response (BEP 15)
+	maxRetransmissions = 8
+	//the socket is closed when no response is pending for that long
+	udpIdleTimeout = 2 * time.Minute
+	//large enough for an announce response with 200 IPv6 peers
+	maxUDPResponseSize = 4096
+	//URL data options carry up to 255 bytes each (BEP 41)
+	maxURLDataLen = 255
 )
 
+//how long we wait for the first response to a request. It is a variable so
+//tests don't have to wait 15 seconds.
+var retransmitBase = 15 * time.Second
+
+//retransmitTimeout is how long we wait for a response after the n-th
+//retransmission of a request
+func retransmitTimeout(n int) time.Duration {
+	return retransmitBase << uint(n)
+}
+
 type respHeader struct {
 	Action int32
 	TxID   int32
@@ -58,60 +76,26 @@ type errResp struct {
 func (t *UDPTrackerURL) Announce(ctx context.Context, r AnnounceReq) (*AnnounceResp, error) {
 	resp, err := t.announce(ctx, r)
 	if err != nil {
-		return nil, fmt.Errorf("udp announce: %w", err)
+		return nil, fmt.Errorf("udp announce: %w", netErr(err))
 	}
 	return resp, nil
 }
 
+//Scrape scrapes up to MaxScrapeHashes torrents. Unlike HTTP trackers, the
+//URL doesn't need to end with announce.
 func (t *UDPTrackerURL) Scrape(ctx context.Context, ihashes ...[20]byte) (*ScrapeResp, error) {
-	var scrapeURL string
-	if scrapeURL = t.url.ScrapeURL(); scrapeURL == "" {
-		return nil, errors.New("tracker doesn't support scrape")
+	if len(ihashes) > MaxScrapeHashes {
+		return nil, fmt.Errorf("udp scrape: more than %d info hashes", MaxScrapeHashes)
 	}
 	resp, err := t.scrape(ctx, ihashes...)
 	if err != nil {
-		return nil, fmt.Errorf("udp scrape: %w", err)
+		return nil, fmt.Errorf("udp scrape: %w", netErr(err))
 	}
 	return resp, nil
 }
 
-func (t *UDPTrackerURL) connect(ctx context.Context) error {
-	var err error
-	if t.isConnected() {
-		return nil
-	}
-	t.conn, err = net.Dial("udp", t.host)
-	if err != nil {
-		return errors.New("fail to dial connection with tracker")
-	}
-	txID := rand.Int31()
-	buf, err := t.request(ctx, respHeader{actionConnect, txID}, reqHeader{protoID, actionConnect, txID})
-	if err != nil {
-		return err
-	}
-	var connID int64
-	err = readFromBinary(buf, &connID)
-	if err != nil {
-		return err
-	}
-	t.connID = connID
-	t.lastConncted = time.Now()
-	return nil
-}
-
 func (t *UDPTrackerURL) announce(ctx context.Context, req AnnounceReq) (*AnnounceResp, error) {
-	err := t.connect(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("connect: %w", err)
-	}
-	txID := rand.Int31()
-	buf, err := t.request(ctx, respHeader{actionAnnounce, txID}, struct {
-		req  reqHeader
-		data AnnounceReq
-	}{
-		reqHeader{t.connID, actionAnnounce, txID},
-		req,
-	})
+	buf, err := t.request(ctx, actionAnnounce, req, t.urlData())
 	if err != nil {
 		return nil, err
 	}
@@ -120,29 +104,33 @@ func (t *UDPTrackerURL) announce(ctx context.Context, req AnnounceReq) (*Announc
 	if err != nil {
 		return nil, err
 	}
-	var cheap cheapPeers = buf.Bytes()
-	peers, err := cheap.peers()
+	//trackers reached over IPv6 respond with IPv6 peers (BEP 15)
+	var peers []Peer
+	if t.isIPv6() {
+		peers, err = cheapPeers6(buf.Bytes()).peers()
+	} else {
+		peers, err = cheapPeers(buf.Bytes()).peers()
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &AnnounceResp{fixed.Interval, fixed.Leechers, fixed.Seeders, peers, 0}, nil
+	return &AnnounceResp{
+		Interval: fixed.Interval,
+		Leechers: fixed.Leechers,
+		Seeders:  fixed.Seeders,
+		Peers:    peers,
+	}, nil
 }
 
 func (t *UDPTrackerURL) scrape(ctx context.Context, ihashes ...[20]byte) (*ScrapeResp, error) {
-	err := t.connect(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("connect: %w", err)
-	}
-	txID := rand.Int31()
-	buf, err := t.request(ctx, respHeader{actionScrape, txID}, reqHeader{t.connID, actionScrape, txID}, ihashes)
+	buf, err := t.request(ctx, actionScrape, ihashes)
 	if err != nil {
 		return nil, err
 	}
-	//var scrapeInfos []udpScrapeInfo
 	scrapeInfos := make([]udpScrapeInfo, len(ihashes))
 	err = readFromBinary(buf, &scrapeInfos)
 	if err != nil {
-		if errors.Is(err, io.ErrUnexpectedEOF) && errors.Is(err, io.EOF) {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
 			return nil, fmt.Errorf("probably not all infohashes are available: %w", err)
 		}
 		return nil, err
@@ -154,142 +142,285 @@ func (t *UDPTrackerURL) scrape(ctx context.Context, ihashes ...[20]byte) (*Scrap
 	return &ScrapeResp{torrents}, nil
 }
 
-func (t *UDPTrackerURL) request(ctx context.Context, respHead respHeader, req ...interface{}) (buf *bytes.Buffer, err error) {
-	b := make([]byte, 0x100) //4KB
-	for {
-		//ensure we are conncted in case of a timeout
-		if respHead.Action != actionConnect {
-			err = t.connect(ctx)
-			if err != nil {
-				return
-			}
-		}
-		err = t.writeRequest(req...)
-		if err != nil {
-			return
-		}
-		buf, err = t.readResponse(ctx, respHead, b)
-		if err != nil && errors.Is(err, requestTimeoutErr) {
-			continue
+//urlData returns the path and query of the URL as URL data options (BEP 41).
+//Private trackers need them to find passkeys.
+func (t *UDPTrackerURL) urlData() []byte {
+	u, err := url.Parse(string(t.url))
+	if err != nil {
+		return nil
+	}
+	data := u.EscapedPath()
+	if u.RawQuery != "" {
+		data += "?" + u.RawQuery
+	}
+	if data == "" || data == "/" {
+		return nil
+	}
+	var opts []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxURLDataLen {
+			n = maxURLDataLen
 		}
-		return
+		opts = append(opts, optionURLData, byte(n))
+		opts = append(opts, data[:n]...)
+		data = data[n:]
 	}
+	return opts
 }
 
-func (t *UDPTrackerURL) readResponse(ctx context.Context, header respHeader, buf []byte) (*bytes.Buffer, error) {
-	var readErr, err error
-	var n int
-	dur := t.timeoutTime()
-	if dur < 0 {
-		return nil, errors.New("waited tracker to much time for response (3840 secs)")
-	}
-	err = t.conn.SetReadDeadline(time.Now().Add(dur))
+type udpResponse struct {
+	b   []byte
+	err error
+}
+
+//request sends a request with the fields of payload and returns the response
+//after its header. Requests are retransmitted with the timeouts of BEP 15
+//and a connection ID is obtained first if we don't have a valid one.
+func (t *UDPTrackerURL) request(ctx context.Context, action int32, payload ...interface{}) (*bytes.Buffer, error) {
+	var body bytes.Buffer
+	if err := writeBinary(&body, payload...); err != nil {
+		return nil, err
+	}
+	txID, respC, err := t.register()
 	if err != nil {
-		return nil, fmt.Errorf("set read deadline: %w", err)
-	}
-	ch := make(chan struct{})
-	go func() {
-		defer close(ch)
-		//read a whole packet. all data should fit in
-		//acording to BEP 15
-		//maybe conn.Read reads a whole packet too.
-		udpConn := t.conn.(*net.UDPConn)
-		n, _, readErr = udpConn.ReadFrom(buf)
-	}()
+		return nil, err
+	}
+	defer t.unregister(txID)
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-ch:
-		switch tp := readErr.(type) {
-		case *net.OpError:
-			if readErr.(*net.OpError).Timeout() {
-				t.consecutiveTimeouts++
-				return nil, requestTimeoutErr
+	reconnected := false
+	for n := 0; n <= maxRetransmissions; n++ {
+		connID := protoID
+		if action != actionConnect {
+			if connID, err = t.connectionID(ctx); err != nil {
+				return nil, fmt.Errorf("connect: %w", err)
 			}
-			return nil, fmt.Errorf("udp tracker read conn net.OpError with no timeout: %w", readErr)
-		case nil:
-		default:
-			return nil, fmt.Errorf("udp tracker read conn err of type %T : %w", tp, readErr)
 		}
-		b := bytes.NewBuffer(buf[:n])
-		err = checkRespHeader(b, header)
-		if err != nil {
+		var b bytes.Buffer
+		if err = writeBinary(&b, reqHeader{connID, action, txID}); err != nil {
+			return nil, err
+		}
+		b.Write(body.Bytes())
+		if err = t.write(ctx, b.Bytes()); err != nil {
 			return nil, err
 		}
-		return b, nil
+		timer := time.NewTimer(retransmitTimeout(n))
+		select {
+		case resp := <-respC:
+			timer.Stop()
+			if resp.err != nil {
+				return nil, resp.err
+			}
+			buf := bytes.NewBuffer(resp.b)
+			err = checkRespHeader(buf, respHeader{action, txID})
+			var failure *FailureError
+			if errors.As(err, &failure) && action != actionConnect && !reconnected {
+				//the tracker may have forgotten our connection ID, try once
+				//more with a new one
+				t.forgetConnectionID()
+				reconnected = true
+				n = -1
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return buf, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
 	}
+	return nil, fmt.Errorf("%w (retransmitted %d times)", ErrTimeout, maxRetransmissions)
 }
 
-func (t *UDPTrackerURL) writeRequest(data ...interface{}) error {
-	//serialize
-	var b bytes.Buffer
-	var err error
-	for _, d := range data {
-		err = writeBinary(&b, d)
-		if err != nil {
-			return err
-		}
+//connectionID returns the cached connection ID or gets a new one if it has
+//expired
+func (t *UDPTrackerURL) connectionID(ctx context.Context) (int64, error) {
+	t.mu.Lock()
+	if !t.connIDTime.IsZero() && time.Since(t.connIDTime) < connIDLifetime {
+		defer t.mu.Unlock()
+		return t.connID, nil
+	}
+	t.mu.Unlock()
+	buf, err := t.request(ctx, actionConnect)
+	if err != nil {
+		return 0, err
+	}
+	var connID int64
+	if err = readFromBinary(buf, &connID); err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connID = connID
+	t.connIDTime = time.Now()
+	return connID, nil
+}
+
+func (t *UDPTrackerURL) forgetConnectionID() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connIDTime = time.Time{}
+}
+
+//register reserves a transaction ID for a request. The response with that ID
+//is sent at the returned channel.
+func (t *UDPTrackerURL) register() (int32, chan udpResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[int32]chan udpResponse)
+	}
+	txID := rand.Int31()
+	for _, ok := t.pending[txID]; ok; _, ok = t.pending[txID] {
+		txID = rand.Int31()
 	}
-	len := b.Len()
-	n, err := t.conn.Write(b.Bytes())
+	respC := make(chan udpResponse, 1)
+	t.pending[txID] = respC
+	return txID, respC, nil
+}
+
+func (t *UDPTrackerURL) unregister(txID int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, txID)
+}
+
+//dial opens the socket if it isn't open. t.mu isn't held while dialing
+//because it may take long through a proxy.
+func (t *UDPTrackerURL) dial(ctx context.Context) error {
+	t.mu.Lock()
+	open := t.conn != nil
+	t.mu.Unlock()
+	if open {
+		return nil
+	}
+	conn, err := t.dialer.DialContext(ctx, "udp", t.host)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		//another request dialed meanwhile
+		conn.Close()
+		return nil
+	}
+	t.conn = conn
+	addr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	t.ipv6 = ok && addr.IP.To4() == nil
+	go t.readLoop(t.conn)
+	return nil
+}
+
+func (t *UDPTrackerURL) write(ctx context.Context, b []byte) error {
+	if err := t.dial(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return errors.New("socket closed")
+	}
+	n, err := t.conn.Write(b)
 	if err != nil {
 		return fmt.Errorf("conn write: %w", err)
 	}
-	if len != n {
+	if n != len(b) {
 		return errors.New("didnt wrote all bytes to socket")
-
 	}
 	return nil
 }
 
-func (t *UDPTrackerURL) isConnected() bool {
-	return !t.lastConncted.IsZero() && time.Now().Sub(t.lastConncted) < time.Minute
+//readLoop passes the responses to the requests they belong to. Several
+//requests may be outstanding on the socket so they are matched by
+//transaction ID. The socket is closed when it has been idle for a while or
+//on errors.
+func (t *UDPTrackerURL) readLoop(conn net.Conn) {
+	b := make([]byte, maxUDPResponseSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := conn.Read(b)
+		t.mu.Lock()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && len(t.pending) > 0 {
+				t.mu.Unlock()
+				continue
+			}
+			//fail the outstanding requests, the next request opens a new socket
+			for _, respC := range t.pending {
+				select {
+				case respC <- udpResponse{err: err}:
+				default:
+				}
+			}
+			if t.conn == conn {
+				t.conn = nil
+			}
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if n >= 8 {
+			txID := int32(binary.BigEndian.Uint32(b[4:]))
+			if respC, ok := t.pending[txID]; ok {
+				select {
+				//ignore responses to retransmissions
+				case respC <- udpResponse{b: append([]byte{}, b[:n]...)}:
+				default:
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *UDPTrackerURL) isIPv6() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ipv6
 }
 
 //do some check as BEP specifies
 func checkRespHeader(buf *bytes.Buffer, expectedHeader respHeader) error {
 	var header respHeader
-	err := errors.New("response is too small")
-	switch expectedHeader.Action {
-	case actionAnnounce:
-		if buf.Len() < 20 {
-			return err
-		}
-	case actionConnect:
-		if buf.Len() < 16 {
-			return err
-		}
-	case actionScrape, actionError:
-		if buf.Len() < 8 {
-			return err
-		}
-	default:
-		return errors.New("unknown action number")
+	tooSmall := errors.New("response is too small")
+	if buf.Len() < 8 {
+		return tooSmall
 	}
-	err = readFromBinary(buf, &header)
+	err := readFromBinary(buf, &header)
 	if err != nil {
 		return err
 	}
 	if header.TxID != expectedHeader.TxID {
 		return errors.New("transactionID is not the same")
 	}
+	//error responses may be shorter than the expected action's
 	if header.Action == actionError {
-		return errors.New("tracker responded with err message: " + string(buf.Bytes()))
+		return &FailureError{buf.String()}
 	}
 	if header.Action != expectedHeader.Action {
 		return errors.New("Actions don't match")
 	}
-	return nil
-}
-
-func (t *UDPTrackerURL) timeoutTime() time.Duration {
-	if t.consecutiveTimeouts >= 8 {
-		return -1
+	switch expectedHeader.Action {
+	case actionAnnounce:
+		if buf.Len() < 12 {
+			return tooSmall
+		}
+	case actionConnect:
+		if buf.Len() < 8 {
+			return tooSmall
+		}
+	case actionScrape:
+	default:
+		return errors.New("unknown action number")
 	}
-	return time.Duration(int(math.Pow(2.0, float64(t.consecutiveTimeouts)))) * 15 * time.Second
+	return nil
 }
 
 func readFromBinary(r io.Reader, data ...interface{}) error {
@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"math"
 	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/lkslts64/charo-torrent/socks5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -59,86 +61,10 @@ func TestReadBinary(t *testing.T) {
 	assert.EqualValues(t, slcFixedData, []udpScrapeInfo{{0x1, 0x020003, 0x040005}, {0x1, 0x020003, 0x040005}})
 }
 
-func TestTimeoutTime(t *testing.T) {
-	tr, err := NewTrackerURL("udp://lol.omg")
-	require.NoError(t, err)
-	udpTr := tr.(*UDPTrackerURL)
-	assert.EqualValues(t, udpTr.timeoutTime(), 15*time.Second)
-	udpTr.consecutiveTimeouts = 5
-	assert.EqualValues(t, udpTr.timeoutTime(), time.Duration(math.Pow(2, 5))*15*time.Second)
-	udpTr.consecutiveTimeouts = 10
-	assert.EqualValues(t, udpTr.timeoutTime(), -1)
-}
-
-func TestAnnounceLocalhost(t *testing.T) {
-	t.Parallel()
-	srv := server{
-		t: map[[20]byte]torrent{
-			{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1}: {
-				stats: udpScrapeInfo{
-					10, 20, 5,
-				},
-				Peers: []portIP{
-					{1, 2},
-					{3, 4},
-					{5, 6},
-				},
-			},
-			{0xf3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1}: {
-				stats: udpScrapeInfo{
-					3429, 9482, 555,
-				},
-				Peers: []portIP{
-					{423423, 4329},
-					{8, 9994},
-					{9, 9982},
-				},
-			},
-		},
-	}
-	var err error
-	srv.pc, err = net.ListenPacket("udp", ":0")
-	require.NoError(t, err)
-	defer srv.pc.Close()
-	go func() {
-		require.NoError(t, srv.serveOne())
-	}()
-	req := AnnounceReq{
-		Numwant: -1,
-		Event:   Started,
-	}
-	rand.Read(req.PeerID[:])
-	copy(req.InfoHash[:], []byte{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1})
-	go func() {
-		require.NoError(t, srv.serveOne())
-	}()
-	tr, err := NewTrackerURL(fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String()))
-	require.NoError(t, err)
-	aresp, err := tr.Announce(context.Background(), req)
-	require.NoError(t, err)
-	assert.EqualValues(t, 5, aresp.Leechers)
-	assert.EqualValues(t, 10, aresp.Seeders)
-	assert.EqualValues(t, 3, len(aresp.Peers))
-	go func() {
-		require.NoError(t, srv.serveOne())
-	}()
-	ihashes := [][20]byte{
-		{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1},
-		{0xf3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1},
-	}
-	sresp, err := tr.Scrape(context.Background(), ihashes...)
-	require.NoError(t, err)
-	assert.EqualValues(t, 2, len(sresp.Torrents))
-	if _, ok := sresp.Torrents[string(ihashes[0][:])]; ok != true {
-		t.Fail()
-	}
-	info, ok := sresp.Torrents[string(ihashes[1][:])]
-	if ok != true {
-		t.Fail()
-	}
-	assert.EqualValues(t, 3429, info.Seeders)
-	assert.EqualValues(t, 555, info.Leechers)
-	assert.EqualValues(t, 9482, info.Downloaded)
+func TestRetransmitTimeout(t *testing.T) {
+	assert.EqualValues(t, 15*time.Second, retransmitTimeout(0))
+	assert.EqualValues(t, time.Duration(math.Pow(2, 5))*15*time.Second, retransmitTimeout(5))
+	assert.EqualValues(t, 3840*time.Second, retransmitTimeout(maxRetransmissions))
 }
 
 func TestAnnounceRandomInfoHashThirdParty(t *testing.T) {
@@ -176,3 +102,255 @@ func TestAnnounceRandomInfoHashThirdParty(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestUDPAnnounceErrors(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.Allow = func(r *ServerRequest) error {
+		return errors.New("unregistered")
+	}
+	s := NewServer(cfg)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeUDP(pc)
+	tr, err := NewTrackerURL("udp://" + pc.LocalAddr().String() + "/announce")
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), AnnounceReq{Port: 1})
+	var failure *FailureError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unregistered", failure.Reason)
+
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pc.Close()
+	tr, err = NewTrackerURL("udp://" + pc.LocalAddr().String() + "/announce")
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), AnnounceReq{Port: 1})
+	assert.True(t, errors.Is(err, ErrConnRefused))
+}
+
+func TestCheckRespHeader(t *testing.T) {
+	resp := func(action int32, payload string) *bytes.Buffer {
+		var buf bytes.Buffer
+		require.NoError(t, writeBinary(&buf, respHeader{action, 7}))
+		buf.WriteString(payload)
+		return &buf
+	}
+	//error messages shorter than the expected response
+	for _, reason := range []string{"", "no"} {
+		err := checkRespHeader(resp(actionError, reason), respHeader{actionAnnounce, 7})
+		var failure *FailureError
+		require.True(t, errors.As(err, &failure))
+		assert.Equal(t, reason, failure.Reason)
+	}
+	err := checkRespHeader(resp(actionAnnounce, "short"), respHeader{actionAnnounce, 7})
+	require.Error(t, err)
+	var failure *FailureError
+	assert.False(t, errors.As(err, &failure))
+	assert.Error(t, checkRespHeader(resp(actionConnect, ""), respHeader{actionConnect, 7}))
+	assert.NoError(t, checkRespHeader(resp(actionConnect, "12345678"), respHeader{actionConnect, 7}))
+	assert.Error(t, checkRespHeader(resp(actionConnect, "12345678"), respHeader{actionConnect, 8}))
+	assert.NoError(t, checkRespHeader(resp(actionScrape, ""), respHeader{actionScrape, 7}))
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeUDP(pc)
+	//the URL of UDP trackers doesn't need an announce path
+	tr, err := NewTrackerURL("udp://" + pc.LocalAddr().String())
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), AnnounceReq{InfoHash: ihash, Port: 1, Left: 1})
+	require.NoError(t, err)
+	resp, err := tr.Scrape(context.Background(), ihash)
+	require.NoError(t, err)
+	assert.Equal(t, TorrentInfo{Leechers: 1}, resp.Torrents[string(ihash[:])])
+	_, err = tr.Scrape(context.Background(), make([][20]byte, MaxScrapeHashes+1)...)
+	assert.Error(t, err)
+}
+
+func TestUDPDialer(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeUDP(pc)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var mu sync.Mutex
+	var reqs []string
+	go (&socks5.Server{
+		OnRequest: func(cmd, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			reqs = append(reqs, cmd)
+		},
+	}).Serve(l)
+	tr, err := NewTrackerURL("udp://"+pc.LocalAddr().String(), WithDialer(&socks5.Dialer{ProxyAddr: l.Addr().String()}))
+	require.NoError(t, err)
+	_, err = tr.Announce(context.Background(), AnnounceReq{InfoHash: ihash, Port: 1, Left: 1})
+	require.NoError(t, err)
+	resp, err := tr.Scrape(context.Background(), ihash)
+	require.NoError(t, err)
+	assert.Equal(t, TorrentInfo{Leechers: 1}, resp.Torrents[string(ihash[:])])
+	//both requests went through the same association
+	mu.Lock()
+	assert.Equal(t, []string{"UDP ASSOCIATE"}, reqs)
+	mu.Unlock()
+}
+
+//blockingDialer never connects
+type blockingDialer struct {
+	dialing chan struct{}
+}
+
+func (d blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dialing <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUDPDialContext(t *testing.T) {
+	d := blockingDialer{make(chan struct{}, 1)}
+	tr, err := NewTrackerURL("udp://127.0.0.1:1", WithDialer(d))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		_, err := tr.Announce(ctx, AnnounceReq{Port: 1})
+		errC <- err
+	}()
+	<-d.dialing
+	//the tracker isn't locked while dialing
+	done := make(chan struct{})
+	go func() {
+		tr.(*UDPTrackerURL).isIPv6()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("dial holds the lock of the tracker")
+	}
+	select {
+	case err = <-errC:
+		assert.True(t, errors.Is(err, ErrTimeout))
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial ignores the context of the request")
+	}
+}
+
+//lossyConn drops the first packet of every kind of request
+type lossyConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	actions map[int32]int
+}
+
+func (c *lossyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || n < 12 {
+			return n, addr, err
+		}
+		action := int32(binary.BigEndian.Uint32(b[8:]))
+		c.mu.Lock()
+		c.actions[action]++
+		drop := c.actions[action] == 1
+		c.mu.Unlock()
+		if !drop {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *lossyConn) count(action int32) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.actions[action]
+}
+
+func TestUDPRequests(t *testing.T) {
+	defer func(base time.Duration) {
+		retransmitBase = base
+	}(retransmitBase)
+	retransmitBase = 250 * time.Millisecond
+	cfg := DefaultServerConfig()
+	var paths []string
+	var mu sync.Mutex
+	cfg.Allow = func(r *ServerRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Path)
+		return nil
+	}
+	s := NewServer(cfg)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lc := &lossyConn{PacketConn: pc, actions: make(map[int32]int)}
+	go s.ServeUDP(lc)
+	tr, err := NewTrackerURL("udp://" + pc.LocalAddr().String() + "/secret/announce?x=1")
+	require.NoError(t, err)
+	udpTr := tr.(*UDPTrackerURL)
+	//lost packets are retransmitted
+	_, err = tr.Announce(context.Background(), AnnounceReq{InfoHash: ihash, Port: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 2, lc.count(actionConnect))
+	assert.Equal(t, 2, lc.count(actionAnnounce))
+	//BEP 41
+	mu.Lock()
+	assert.Equal(t, []string{"/secret/announce"}, paths)
+	mu.Unlock()
+	//concurrent requests share the socket and the connection ID
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := AnnounceReq{InfoHash: ihash, Port: int16(i + 2)}
+			req.PeerID[0] = byte(i)
+			_, err := tr.Announce(context.Background(), req)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, lc.count(actionConnect))
+	assert.Equal(t, 22, lc.count(actionAnnounce))
+	resp, err := tr.Scrape(context.Background(), ihash)
+	require.NoError(t, err)
+	assert.EqualValues(t, 21, resp.Torrents[string(ihash[:])].Seeders)
+	//expired connection IDs are renewed
+	udpTr.mu.Lock()
+	udpTr.connIDTime = time.Now().Add(-connIDLifetime)
+	udpTr.mu.Unlock()
+	_, err = tr.Scrape(context.Background(), ihash)
+	require.NoError(t, err)
+	assert.Equal(t, 3, lc.count(actionConnect))
+	//the tracker forgot our connection ID before it expired
+	udpTr.mu.Lock()
+	udpTr.connID = 12345
+	udpTr.mu.Unlock()
+	_, err = tr.Scrape(context.Background(), ihash)
+	require.NoError(t, err)
+	assert.Equal(t, 4, lc.count(actionConnect))
+}
+
+func TestUDPURLData(t *testing.T) {
+	tr, err := NewTrackerURL("udp://tracker.invalid:6969")
+	require.NoError(t, err)
+	assert.Nil(t, tr.(*UDPTrackerURL).urlData())
+	data := "/announce?passkey=" + strings.Repeat("a", 300)
+	tr, err = NewTrackerURL("udp://tracker.invalid:6969" + data)
+	require.NoError(t, err)
+	opts := tr.(*UDPTrackerURL).urlData()
+	//the data is split in options of up to 255 bytes
+	require.Len(t, opts, 2+255+2+63)
+	assert.Equal(t, []byte{optionURLData, 255}, opts[:2])
+	assert.Equal(t, []byte{optionURLData, 63}, opts[257:259])
+	assert.Equal(t, data, string(opts[2:257])+string(opts[259:]))
+}
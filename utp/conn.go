@@ -0,0 +1,526 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//max payload of a single packet, keeps packets below a typical MTU
+	maxPayload = 1200
+	//our receive window
+	maxRecvWindow = 1 << 20
+	//we ignore out of order packets that are further than this from the next expected one
+	maxOutOfOrder = maxRecvWindow / maxPayload
+	minRTO        = 500 * time.Millisecond
+	maxRTO        = 10 * time.Second
+	//the connection fails if a packet is retransmitted more times than this
+	maxRetransmits = 6
+	//duplicate acks (or selective acks of later packets) that trigger a fast retransmit
+	dupAckThreshold = 3
+	//max length of the selective ack bitmask we send
+	maxSackLen = 32
+	//how long a closed connection waits for the remote FIN
+	lingerTimeout = 10 * time.Second
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+type outPacket struct {
+	typ       byte
+	seqNr     uint16
+	payload   []byte
+	sentAt    time.Time
+	transmits int
+	//true if the packet was acked selectively
+	acked bool
+}
+
+//Conn is a uTP connection.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex //guards following
+	state connState
+	//closed when something changes, then replaced with a new one
+	event chan struct{}
+	err   error
+	//true when the user has called Close
+	closed   bool
+	closedAt time.Time
+	readDL   time.Time
+	writeDL  time.Time
+	//sequence number of the next packet we send
+	seqNr uint16
+	//last in-order sequence number we received
+	ackNr uint16
+	//timestampDiff we echo back to the remote peer
+	replyMicros uint32
+	//sent but not acked packets, ordered by sequence number
+	unacked     []*outPacket
+	inflight    int
+	peerWnd     uint32
+	lastAckRecv uint16
+	dupAcks     int
+	rtt, rttVar time.Duration
+	rto         time.Duration
+	rtoDeadline time.Time
+	ledbat      ledbat
+	//received in-order data that the user hasn't read
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16]inPacket
+	//true when we have received the FIN of the remote peer
+	eof bool
+}
+
+type inPacket struct {
+	typ     byte
+	seqNr   uint16
+	payload []byte
+}
+
+func newConn(s *Socket, raddr net.Addr) *Conn {
+	return &Conn{
+		s:          s,
+		raddr:      raddr,
+		event:      make(chan struct{}),
+		rto:        time.Second,
+		peerWnd:    maxRecvWindow,
+		ledbat:     newLedbat(),
+		outOfOrder: make(map[uint16]inPacket),
+	}
+}
+
+//broadcast wakes up every goroutine that waits on the connection.
+func (c *Conn) broadcast() {
+	close(c.event)
+	c.event = make(chan struct{})
+}
+
+//wait blocks until something changes or the deadline expires. c.mu must be held.
+func (c *Conn) wait(deadline time.Time) error {
+	ev := c.event
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ev:
+		return nil
+	case <-timeout:
+		return timeoutError{}
+	}
+}
+
+//fail terminates the connection with err. c.mu must be held.
+func (c *Conn) fail(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	c.s.removeConn(c)
+	c.broadcast()
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if c.readBuf.Len() >= maxRecvWindow {
+		return 0
+	}
+	return uint32(maxRecvWindow - c.readBuf.Len())
+}
+
+func (c *Conn) sendPacket(typ byte, seqNr uint16, payload []byte) {
+	connID := c.sendID
+	if typ == stSyn {
+		connID = c.recvID
+	}
+	c.s.send(c.raddr, &header{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicros,
+		wndSize:       c.recvWindow(),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+		sack:          c.selectiveAcks(),
+	}, payload)
+}
+
+//selectiveAcks returns the bitmask of the out of order packets we have received.
+//The LSB of the first byte represents ackNr+2.
+func (c *Conn) selectiveAcks() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	b := make([]byte, maxSackLen)
+	n := 0
+	for seqNr := range c.outOfOrder {
+		i := int(seqNr - c.ackNr - 2)
+		if i < 0 || i >= len(b)*8 {
+			continue
+		}
+		b[i/8] |= 1 << uint(i%8)
+		if i/8+1 > n {
+			n = i/8 + 1
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	//the length should be a multiple of 4
+	return b[:(n+3)/4*4]
+}
+
+func (c *Conn) sendState() {
+	c.sendPacket(stState, c.seqNr, nil)
+}
+
+func (c *Conn) sendReset() {
+	c.sendPacket(stReset, c.seqNr, nil)
+}
+
+//push sends a packet that consumes a sequence number and needs to be acked.
+func (c *Conn) push(typ byte, payload []byte) {
+	p := &outPacket{
+		typ:       typ,
+		seqNr:     c.seqNr,
+		payload:   payload,
+		sentAt:    time.Now(),
+		transmits: 1,
+	}
+	if len(c.unacked) == 0 {
+		c.rtoDeadline = p.sentAt.Add(c.rto)
+	}
+	c.unacked = append(c.unacked, p)
+	c.inflight += len(payload)
+	c.seqNr++
+	c.sendPacket(p.typ, p.seqNr, p.payload)
+}
+
+func (c *Conn) resend(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmits++
+	c.sendPacket(p.typ, p.seqNr, p.payload)
+}
+
+//window is the max number of bytes we allow to be in flight.
+func (c *Conn) window() int {
+	w := c.ledbat.cwnd
+	if int(c.peerWnd) < w {
+		w = int(c.peerWnd)
+	}
+	return w
+}
+
+func (c *Conn) onTimestamp(h *header) {
+	c.replyMicros = nowMicros() - h.timestamp
+}
+
+func (c *Conn) handlePacket(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if h.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+	if h.typ == stSyn {
+		//our ack was lost
+		c.sendState()
+		return
+	}
+	c.onTimestamp(h)
+	c.peerWnd = h.wndSize
+	if c.state == stateSynSent {
+		if h.ackNr != c.seqNr-1 {
+			return
+		}
+		c.state = stateConnected
+		//the state packet that acks our SYN doesn't consume a sequence number
+		c.ackNr = h.seqNr - 1
+	}
+	c.onAck(h, len(payload) == 0 && h.typ == stState)
+	if h.typ == stData || h.typ == stFin {
+		c.onData(inPacket{h.typ, h.seqNr, payload})
+	}
+	c.broadcast()
+}
+
+func (c *Conn) onAck(h *header, pureAck bool) {
+	now := time.Now()
+	ackedPkts, acked := 0, 0
+	ackPacket := func(p *outPacket) {
+		p.acked = true
+		c.inflight -= len(p.payload)
+		acked += len(p.payload)
+		ackedPkts++
+		if p.transmits == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+	for len(c.unacked) > 0 && !seqLess(h.ackNr, c.unacked[0].seqNr) {
+		p := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		if !p.acked {
+			ackPacket(p)
+		}
+	}
+	if len(h.sack) > 0 && len(c.unacked) > 0 {
+		//unacked packets have consecutive sequence numbers
+		first := c.unacked[0].seqNr
+		sacked := 0
+		for i := len(h.sack)*8 - 1; i >= 0; i-- {
+			idx := int(h.ackNr + 2 + uint16(i) - first)
+			if idx < 0 || idx >= len(c.unacked) {
+				continue
+			}
+			p := c.unacked[idx]
+			if h.sack[i/8]&(1<<uint(i%8)) != 0 {
+				if !p.acked {
+					ackPacket(p)
+				}
+				sacked++
+			} else if !p.acked && sacked >= dupAckThreshold && now.Sub(p.sentAt) > c.rtt {
+				//packets after this one arrived, it is probably lost
+				c.resend(p)
+			}
+		}
+		//the packet right after ackNr is always missing
+		if p := c.unacked[0]; p.seqNr == h.ackNr+1 && sacked >= dupAckThreshold && now.Sub(p.sentAt) > c.rtt {
+			c.resend(p)
+		}
+	}
+	if ackedPkts > 0 {
+		c.lastAckRecv = h.ackNr
+		c.dupAcks = 0
+		c.rtoDeadline = now.Add(c.rto)
+		if h.timestampDiff != 0 {
+			c.ledbat.onAck(acked, h.timestampDiff, now)
+		}
+		return
+	}
+	if pureAck && len(c.unacked) > 0 && h.ackNr == c.lastAckRecv {
+		c.dupAcks++
+		if c.dupAcks == dupAckThreshold {
+			c.ledbat.onLoss()
+			c.resend(c.unacked[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+func (c *Conn) onData(p inPacket) {
+	defer c.sendState()
+	if !seqLess(c.ackNr, p.seqNr) || int(p.seqNr-c.ackNr) > maxOutOfOrder {
+		//duplicate or too far ahead
+		return
+	}
+	if p.seqNr != c.ackNr+1 {
+		c.outOfOrder[p.seqNr] = p
+		return
+	}
+	c.deliver(p)
+	for {
+		next, ok := c.outOfOrder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.outOfOrder, next.seqNr)
+		c.deliver(next)
+	}
+}
+
+func (c *Conn) deliver(p inPacket) {
+	c.ackNr = p.seqNr
+	if c.eof {
+		return
+	}
+	if p.typ == stFin {
+		c.eof = true
+		return
+	}
+	c.readBuf.Write(p.payload)
+}
+
+//tick retransmits packets whose timer has expired and cleans up closed connections.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if len(c.unacked) > 0 && now.After(c.rtoDeadline) {
+		p := c.unacked[0]
+		if p.transmits > maxRetransmits {
+			c.fail(errTimeout)
+			return
+		}
+		c.ledbat.onTimeout()
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+		c.rtoDeadline = now.Add(c.rto)
+		c.resend(p)
+		c.broadcast()
+		return
+	}
+	if c.state == stateFinSent && len(c.unacked) == 0 && (c.eof || now.Sub(c.closedAt) > lingerTimeout) {
+		c.fail(errClosed)
+	}
+}
+
+//Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.readBuf.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, errClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.readDL); err != nil {
+			return 0, err
+		}
+	}
+	wasFull := c.recvWindow() < maxPayload
+	n, _ := c.readBuf.Read(b)
+	if wasFull && c.state != stateClosed {
+		//let the remote peer know that it can send again
+		c.sendState()
+	}
+	return n, nil
+}
+
+//Write implements net.Conn.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		switch {
+		case c.closed:
+			return written, errClosed
+		case c.err != nil:
+			return written, c.err
+		}
+		n := len(b) - written
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if c.inflight > 0 && c.inflight+n > c.window() {
+			if err := c.wait(c.writeDL); err != nil {
+				return written, err
+			}
+			continue
+		}
+		c.push(stData, append([]byte(nil), b[written:written+n]...))
+		written += n
+	}
+	return written, nil
+}
+
+//Close sends a FIN to the remote peer. Data that have already been
+//written are still delivered.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	switch c.state {
+	case stateConnected:
+		c.push(stFin, nil)
+		c.state = stateFinSent
+	case stateSynSent:
+		c.fail(errClosed)
+	}
+	c.broadcast()
+	return nil
+}
+
+//LocalAddr implements net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+//RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+//SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL, c.writeDL = t, t
+	c.broadcast()
+	return nil
+}
+
+//SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	c.broadcast()
+	return nil
+}
+
+//SetWriteDeadline implements net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDL = t
+	c.broadcast()
+	return nil
+}
@@ -0,0 +1,91 @@
+package utp
+
+import "time"
+
+const (
+	//the queuing delay LEDBAT targets
+	targetDelay = 100 * time.Millisecond
+	//max bytes the congestion window grows per RTT
+	maxCwndIncrease = 3000
+	minCwnd         = 2 * maxPayload
+	//base delay is the min delay seen in the last baseDelayHistory minutes
+	baseDelayHistory = 2
+)
+
+//ledbat implements the LEDBAT congestion control (RFC 6817). The one-way
+//delay samples come from the timestamp differences that the remote peer
+//echoes back. Clocks of the peers aren't synchronized, so only the
+//difference from the base (min) delay is meaningful.
+type ledbat struct {
+	cwnd int
+	//min delay per minute
+	baseDelays   [baseDelayHistory]uint32
+	baseDelaySet [baseDelayHistory]bool
+	baseIdx      int
+	minuteStart  time.Time
+}
+
+func newLedbat() ledbat {
+	return ledbat{
+		cwnd: minCwnd,
+	}
+}
+
+//micros comparison taking wrap around into account
+func microsLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (l *ledbat) updateBaseDelay(sample uint32, now time.Time) {
+	if now.Sub(l.minuteStart) > time.Minute {
+		l.minuteStart = now
+		l.baseIdx = (l.baseIdx + 1) % baseDelayHistory
+		l.baseDelaySet[l.baseIdx] = false
+	}
+	if !l.baseDelaySet[l.baseIdx] || microsLess(sample, l.baseDelays[l.baseIdx]) {
+		l.baseDelays[l.baseIdx] = sample
+		l.baseDelaySet[l.baseIdx] = true
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	base := l.baseDelays[l.baseIdx]
+	for i, d := range l.baseDelays {
+		if l.baseDelaySet[i] && microsLess(d, base) {
+			base = d
+		}
+	}
+	return base
+}
+
+//onAck adjusts the congestion window when ackedBytes are acked and the
+//remote peer measured delay for our packets.
+func (l *ledbat) onAck(ackedBytes int, delay uint32, now time.Time) {
+	l.updateBaseDelay(delay, now)
+	queuing := time.Duration(delay-l.baseDelay()) * time.Microsecond
+	offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+	windowFactor := float64(ackedBytes) / float64(l.cwnd)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	l.cwnd += int(maxCwndIncrease * offTarget * windowFactor)
+	l.clamp()
+}
+
+func (l *ledbat) onLoss() {
+	l.cwnd /= 2
+	l.clamp()
+}
+
+func (l *ledbat) onTimeout() {
+	l.cwnd = minCwnd
+}
+
+func (l *ledbat) clamp() {
+	if l.cwnd < minCwnd {
+		l.cwnd = minCwnd
+	}
+	if l.cwnd > maxRecvWindow {
+		l.cwnd = maxRecvWindow
+	}
+}
@@ -0,0 +1,105 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+//packet types
+const (
+	stData byte = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+const (
+	version   = 1
+	headerLen = 20
+	//extension types
+	extNone          = 0
+	extSelectiveAcks = 1
+)
+
+var errBadPacket = errors.New("utp: malformed packet")
+
+type header struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	//bitmask of the packets after ackNr+1 that were received
+	sack []byte
+}
+
+//marshal encodes the header followed by the payload. The only extension we
+//send is selective acks.
+func (h *header) marshal(payload []byte) []byte {
+	extLen := 0
+	if len(h.sack) > 0 {
+		extLen = 2 + len(h.sack)
+	}
+	b := make([]byte, headerLen+extLen+len(payload))
+	b[0] = h.typ<<4 | version
+	b[1] = extNone
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	if extLen > 0 {
+		b[1] = extSelectiveAcks
+		b[headerLen] = extNone
+		b[headerLen+1] = byte(len(h.sack))
+		copy(b[headerLen+2:], h.sack)
+	}
+	copy(b[headerLen+extLen:], payload)
+	return b
+}
+
+//unmarshal decodes the header of b and returns the payload. Extensions other
+//than selective acks are skipped.
+func (h *header) unmarshal(b []byte) ([]byte, error) {
+	if len(b) < headerLen || b[0]&0xf != version || b[0]>>4 > stSyn {
+		return nil, errBadPacket
+	}
+	h.typ = b[0] >> 4
+	ext := b[1]
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+	b = b[headerLen:]
+	h.sack = nil
+	for ext != extNone {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errBadPacket
+		}
+		if ext == extSelectiveAcks {
+			h.sack = b[2 : 2+int(b[1])]
+		}
+		ext = b[0]
+		b = b[2+int(b[1]):]
+	}
+	return b, nil
+}
+
+var epoch = time.Now()
+
+//current time in microseconds (wraps around)
+func nowMicros() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
+
+//seqLess reports whether sequence number a is before b, taking wrap around into account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,272 @@
+/*
+Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+stream protocol on top of UDP. uTP uses LEDBAT congestion control, so it
+backs off when it detects queuing delay and doesn't hog the uplink of
+the user.
+
+A Socket both accepts incoming connections (it implements net.Listener) and
+dials new ones. Connections implement net.Conn.
+*/
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//how often the retransmission timers are checked
+const tickInterval = 50 * time.Millisecond
+
+var (
+	errClosed       = errors.New("utp: use of closed connection")
+	errSocketClosed = errors.New("utp: socket closed")
+	errReset        = errors.New("utp: connection reset by peer")
+	errTimeout      = errors.New("utp: connection timed out")
+)
+
+//timeoutError is returned when a deadline is exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "utp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+//Socket multiplexes uTP connections over a single UDP socket.
+type Socket struct {
+	pc      net.PacketConn
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	acceptC chan *Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+//NewSocket creates a socket listening at addr. network should be one of
+//"udp", "udp4" or "udp6".
+func NewSocket(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocketFromPacketConn(pc), nil
+}
+
+//NewSocketFromPacketConn creates a socket on top of pc. The socket takes
+//ownership of pc.
+func NewSocketFromPacketConn(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		acceptC: make(chan *Conn, 32),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+//Accept waits for the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptC:
+		return c, nil
+	case <-s.closed:
+		return nil, errSocketClosed
+	}
+}
+
+//Addr returns the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+//Close closes the socket and all of its connections.
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(errSocketClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+//Dial connects to the uTP peer at addr.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, 0)
+}
+
+//DialTimeout is like Dial but fails if the connection isn't established
+//before timeout. A zero timeout means no timeout (retransmissions of the SYN
+//will eventually give up though).
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if raddr.IP == nil || raddr.IP.IsUnspecified() {
+		//like the net package, dialing the unspecified address means the local system
+		raddr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	c := newConn(s, raddr)
+	s.mu.Lock()
+	for {
+		c.recvID = uint16(rand.Uint32())
+		if _, ok := s.conns[connKey{raddr.String(), c.recvID}]; !ok {
+			break
+		}
+	}
+	c.sendID = c.recvID + 1
+	s.conns[connKey{raddr.String(), c.recvID}] = c
+	s.mu.Unlock()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqNr = 1
+	c.push(stSyn, nil)
+	for c.state == stateSynSent && c.err == nil {
+		if err := c.wait(deadline); err != nil {
+			c.fail(err)
+			return nil, err
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 0x10000)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		var h header
+		payload, err := h.unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(&h, append([]byte(nil), payload...), addr)
+	}
+}
+
+func (s *Socket) dispatch(h *header, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	key := connKey{addr.String(), h.connID}
+	if h.typ == stSyn {
+		key.id++
+	}
+	c, ok := s.conns[key]
+	if !ok && h.typ == stReset {
+		//the reset might carry the connection id the peer uses for receiving
+		for k, cc := range s.conns {
+			if k.addr == key.addr && cc.sendID == h.connID {
+				c, ok = cc, true
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if ok {
+		c.handlePacket(h, payload)
+		return
+	}
+	switch h.typ {
+	case stSyn:
+		s.accept(h, addr)
+	case stReset:
+	default:
+		s.send(addr, &header{
+			typ:       stReset,
+			connID:    h.connID,
+			timestamp: nowMicros(),
+			ackNr:     h.seqNr,
+		}, nil)
+	}
+}
+
+//accept creates a new connection from a SYN packet
+func (s *Socket) accept(h *header, addr net.Addr) {
+	c := newConn(s, addr)
+	c.recvID = h.connID + 1
+	c.sendID = h.connID
+	c.seqNr = uint16(rand.Uint32())
+	c.ackNr = h.seqNr
+	c.lastAckRecv = c.seqNr - 1
+	c.state = stateConnected
+	c.mu.Lock()
+	c.onTimestamp(h)
+	c.peerWnd = h.wndSize
+	c.sendState()
+	c.mu.Unlock()
+	s.mu.Lock()
+	s.conns[connKey{addr.String(), c.recvID}] = c
+	s.mu.Unlock()
+	select {
+	case s.acceptC <- c:
+	default:
+		//nobody accepts connections, refuse it
+		c.mu.Lock()
+		c.sendReset()
+		c.fail(errReset)
+		c.mu.Unlock()
+	}
+}
+
+func (s *Socket) removeConn(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(addr net.Addr, h *header, payload []byte) {
+	s.pc.WriteTo(h.marshal(payload), addr)
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSocket(t *testing.T) *Socket {
+	s, err := NewSocket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	return s
+}
+
+//dial from a to b and return both ends of the connection
+func connPair(t *testing.T, a, b *Socket) (net.Conn, net.Conn) {
+	acceptC := make(chan net.Conn)
+	go func() {
+		c, err := b.Accept()
+		require.NoError(t, err)
+		acceptC <- c
+	}()
+	c, err := a.DialTimeout(b.Addr().String(), 5*time.Second)
+	require.NoError(t, err)
+	return c, <-acceptC
+}
+
+func testTransfer(t *testing.T, a, b *Socket, size int) {
+	ca, cb := connPair(t, a, b)
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		_, err := ca.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, ca.Close())
+	}()
+	cb.SetReadDeadline(time.Now().Add(20 * time.Second))
+	recv, err := ioutil.ReadAll(cb)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, recv))
+	require.NoError(t, cb.Close())
+}
+
+func TestEcho(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	defer a.Close()
+	defer b.Close()
+	ca, cb := connPair(t, a, b)
+	go io.Copy(cb, cb)
+	_, err := ca.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(ca, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, b.Addr().String(), ca.RemoteAddr().String())
+}
+
+func TestTransfer(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	defer a.Close()
+	defer b.Close()
+	testTransfer(t, a, b, 4<<20)
+}
+
+//lossyPacketConn drops every nth packet it writes
+type lossyPacketConn struct {
+	net.PacketConn
+	n     int32
+	count int32
+}
+
+func (lpc *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt32(&lpc.count, 1)%lpc.n == 0 {
+		return len(b), nil
+	}
+	return lpc.PacketConn.WriteTo(b, addr)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	a := NewSocketFromPacketConn(&lossyPacketConn{PacketConn: pc, n: 10})
+	b := newTestSocket(t)
+	defer a.Close()
+	defer b.Close()
+	testTransfer(t, a, b, 1<<20)
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	defer a.Close()
+	defer b.Close()
+	ca, _ := connPair(t, a, b)
+	ca.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := ca.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+}
+
+func TestDialTimeout(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+	//nobody listens at this address
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	_, err = a.DialTimeout(pc.LocalAddr().String(), 100*time.Millisecond)
+	require.Error(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	a.mu.Lock()
+	assert.Len(t, a.conns, 0)
+	a.mu.Unlock()
+}
+
+func TestReset(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	defer a.Close()
+	ca, _ := connPair(t, a, b)
+	b.Close()
+	//the remote socket was replaced by one that knows nothing about the connection
+	b2, err := NewSocket("udp4", b.Addr().String())
+	require.NoError(t, err)
+	defer b2.Close()
+	_, err = ca.Write([]byte("hello"))
+	require.NoError(t, err)
+	ca.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ca.Read(make([]byte, 1))
+	assert.Equal(t, errReset, err)
+}
+
+func TestHeader(t *testing.T) {
+	h := header{
+		typ:           stData,
+		connID:        1,
+		timestamp:     2,
+		timestampDiff: 3,
+		wndSize:       4,
+		seqNr:         5,
+		ackNr:         6,
+	}
+	b := h.marshal([]byte("payload"))
+	var h2 header
+	payload, err := h2.unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, h, h2)
+	assert.Equal(t, "payload", string(payload))
+	//with an extension
+	b = append(b[:headerLen:headerLen], 0, 2, 0xff, 0xff)
+	b[1] = 1
+	payload, err = h2.unmarshal(b)
+	require.NoError(t, err)
+	assert.Len(t, payload, 0)
+	_, err = h2.unmarshal(b[:10])
+	assert.Equal(t, errBadPacket, err)
+}
+
+func TestSelectiveAcks(t *testing.T) {
+	c := newConn(nil, nil)
+	c.ackNr = 10
+	assert.Nil(t, c.selectiveAcks())
+	//12 is the first bit, 21 the 10th
+	c.outOfOrder[12] = inPacket{}
+	c.outOfOrder[21] = inPacket{}
+	sack := c.selectiveAcks()
+	assert.Equal(t, []byte{0x01, 0x02, 0, 0}, sack)
+	h := header{typ: stState, sack: sack}
+	var h2 header
+	payload, err := h2.unmarshal(h.marshal([]byte("x")))
+	require.NoError(t, err)
+	assert.Equal(t, sack, h2.sack)
+	assert.Equal(t, "x", string(payload))
+}